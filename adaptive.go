@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With -adaptive, vcprompt picks how to check the work tree of each repository
+// from how long the dirty and untracked checks took there, recorded in
+// adaptive.json in the cache directory: with its own checks (native), with
+// git (exec), or, when neither is fast enough, not at all, with the state of
+// the git directory from the cache (cached). The strategy which is not picked
+// is tried again after adaptRetry, so that the choice follows the repository
+// as it changes.
+
+// adaptiveFile is the name of the timings file in the cache directory.
+const adaptiveFile = "adaptive.json"
+
+// adaptRetry is the time after which the strategies which were not picked are
+// tried again.
+const adaptRetry = time.Hour
+
+// adaptFast is the time of the work tree checks under which the other
+// strategy is not tried.
+const adaptFast = 10 * time.Millisecond
+
+// adaptSlow is the time of the work tree checks above which the cached
+// strategy is picked, unless -t is lower.
+const adaptSlow = 200 * time.Millisecond
+
+// The strategies of -adaptive.
+const (
+	strategyNative = "native"
+	strategyExec   = "exec"
+	strategyCached = "cached"
+)
+
+// strategyTiming is the record of a strategy in a repository.
+type strategyTiming struct {
+	Took time.Duration `json:"took"` // moving average
+	Last time.Time     `json:"last"` // of the last run
+}
+
+// repoTimings are the records of the strategies of a repository.
+type repoTimings struct {
+	Native   strategyTiming `json:"native"`
+	Exec     strategyTiming `json:"exec"`
+	Strategy string         `json:"strategy"` // picked
+	Since    time.Time      `json:"since"`    // when it was picked
+}
+
+// readAdaptive returns the records of the strategies, by repository.
+func readAdaptive() map[string]repoTimings {
+	records := map[string]repoTimings{}
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir(), adaptiveFile))
+	if err != nil {
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		debugf("adaptive: %s: %v", adaptiveFile, err)
+	}
+	return records
+}
+
+// adaptLimit returns the time of the work tree checks above which the cached
+// strategy is picked, with the timeout of -t.
+func adaptLimit(timeout time.Duration) time.Duration {
+	if timeout > 0 && timeout < adaptSlow {
+		return timeout
+	}
+	return adaptSlow
+}
+
+// best returns the strategy which t says is the fastest, with the timeout of
+// -t.
+func (t repoTimings) best(timeout time.Duration) string {
+	limit := adaptLimit(timeout)
+	native, exec := t.Native.Took, t.Exec.Took
+	switch {
+	case t.Native.Last.IsZero():
+		return strategyNative
+	case t.Exec.Last.IsZero():
+		if native > limit {
+			// exec is tried first.
+			return strategyExec
+		}
+		return strategyNative
+	case native <= exec && native <= limit:
+		return strategyNative
+	case exec <= limit:
+		return strategyExec
+	}
+	return strategyCached
+}
+
+// pickStrategy returns how to check the work tree of the repository at root:
+// the strategy picked from its records, or one which was not tried for
+// adaptRetry. It is always the native one unless o turns on -adaptive.
+func pickStrategy(root string, o collectOptions) string {
+	if !o.adaptive {
+		return strategyNative
+	}
+	t := readAdaptive()[root]
+	picked := t.Strategy
+	if picked == "" {
+		picked = t.best(o.timeout)
+	}
+
+	switch {
+	case picked == strategyCached && time.Since(t.Since) >= adaptRetry:
+		picked = t.best(o.timeout)
+		if picked == strategyCached {
+			// the strategy which was tried the longest ago is tried again.
+			picked = strategyNative
+			if t.Exec.Last.Before(t.Native.Last) {
+				picked = strategyExec
+			}
+		}
+	case picked == strategyNative && t.Native.Took > adaptFast && time.Since(t.Exec.Last) >= adaptRetry:
+		picked = strategyExec
+	case picked == strategyExec && t.Exec.Took > adaptFast && time.Since(t.Native.Last) >= adaptRetry:
+		picked = strategyNative
+	}
+	debugf("adaptive: %s strategy for %s", picked, root)
+	return picked
+}
+
+// recordStrategy records that the work tree checks of the repository at root
+// took took with strategy, or were cut by -t if timedOut, and picks the
+// strategy of the next runs, if o turns on -adaptive.
+func recordStrategy(root string, o collectOptions, strategy string, took time.Duration, timedOut bool) {
+	if !o.adaptive {
+		return
+	}
+	records := readAdaptive()
+	t := records[root]
+	old := t
+
+	if limit := adaptLimit(o.timeout); timedOut && took < limit {
+		took = limit
+	}
+	update := func(s *strategyTiming) {
+		if s.Last.IsZero() {
+			s.Took = took
+		} else {
+			s.Took = (3*s.Took + took) / 4
+		}
+		s.Last = time.Now()
+	}
+	switch strategy {
+	case strategyNative:
+		update(&t.Native)
+	case strategyExec:
+		update(&t.Exec)
+	}
+	// the file is only written when the records change enough, or
+	// another strategy than the picked one was tried.
+	picked := t.best(o.timeout)
+	if picked == t.Strategy && strategy == picked && !moved(old, t, strategy) {
+		return
+	}
+	if picked != t.Strategy {
+		debugf("adaptive: picking the %s strategy for %s", picked, root)
+	}
+	t.Strategy, t.Since = picked, time.Now()
+	records[root] = t
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = os.MkdirAll(cacheDir(), 0700)
+	}
+	if err == nil {
+		err = writeAtomic(filepath.Join(cacheDir(), adaptiveFile), data)
+	}
+	if err != nil {
+		debugf("adaptive: %v", err)
+	}
+}
+
+// moved reports whether the average time of strategy moved by more than a
+// tenth from old to t.
+func moved(old, t repoTimings, strategy string) bool {
+	var a, b time.Duration
+	switch strategy {
+	case strategyNative:
+		a, b = old.Native.Took, t.Native.Took
+	case strategyExec:
+		a, b = old.Exec.Took, t.Exec.Took
+	default:
+		return false
+	}
+	d := b - a
+	if d < 0 {
+		d = -d
+	}
+	return d > a/10
+}
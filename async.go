@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// With -async, vcprompt returns at once and runs again in the background,
+// detached from the shell, to write the output to -state-file or -output-file
+// and signal -notify-pid, so that slow repositories never block the prompt.
+// -state-file holds the directory on its first line, and the output after it,
+// so that shells can tell whether it is for the current directory. Each run
+// replaces it at once, unless a run started later replaced it already.
+
+// asyncEnv is set in the environment of the background runs of -async, to the
+// time the foreground run started, in nanoseconds since the epoch.
+const asyncEnv = "VCPROMPT_ASYNC"
+
+// asyncStart returns the time the foreground run of -async started, if this
+// is its background run.
+func asyncStart() (time.Time, bool) {
+	ns, err := strconv.ParseInt(os.Getenv(asyncEnv), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// startAsync runs vcprompt again in the background, with the same arguments,
+// and returns the exit status of the foreground run.
+func startAsync() int {
+	if *stateFile == "" && *outputFile == "" {
+		fmt.Fprintln(os.Stderr, "vcprompt: -async needs -state-file or -output-file")
+		return 2
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: -async: %v\n", err)
+		return 2
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), asyncEnv+"="+strconv.FormatInt(time.Now().UnixNano(), 10))
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: -async: %v\n", err)
+		return 2
+	}
+	debugf("async: running in pid %d", cmd.Process.Pid)
+	cmd.Process.Release()
+	return 0
+}
+
+// stateDir is the directory written on the first line of -state-file.
+var stateDir string
+
+// writeState replaces -state-file with stateDir and out, and reports false if
+// a background run of -async which started later replaced it already.
+func writeState(out []byte) (bool, error) {
+	if start, ok := asyncStart(); ok {
+		if fi, err := os.Stat(*stateFile); err == nil && fi.ModTime().After(start) {
+			debugf("async: %s is newer than this run", *stateFile)
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(*stateFile), 0700); err != nil {
+		return false, err
+	}
+	data := make([]byte, 0, len(stateDir)+1+len(out))
+	data = append(append(append(data, stateDir...), '\n'), out...)
+	return true, writeAtomic(*stateFile, data)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchPhase is a phase of a run of vcprompt, as timed by bench.
+type benchPhase struct {
+	name string
+	run  func(dir string, v vcs)
+}
+
+var benchPhases = []benchPhase{
+	{"detection", func(dir string, v vcs) {
+		probeParent(dir)
+	}},
+	{"status", func(dir string, v vcs) {
+		root := probeParent(dir)
+		for _, step := range doctorSteps {
+			if step.off == nil || !*step.off {
+				step.run(root)
+			}
+		}
+	}},
+	{"format", func(dir string, v vcs) {
+		outputs[*output](v)
+	}},
+}
+
+// benchPair is a step which vcprompt does natively, and the git command which
+// would do the same, compared by bench.
+type benchPair struct {
+	name   string
+	native func(root string)
+	exec   []string
+}
+
+var benchPairs = []benchPair{
+	{"detection", func(root string) { probeParent(root) }, []string{"rev-parse", "--git-dir"}},
+	{"dirty", func(root string) { nativeModified(root) }, []string{"diff", "--no-ext-diff", "--quiet", "--exit-code"}},
+	{"head", func(root string) { readFirstLine(filepath.Join(root, githead)) }, []string{"symbolic-ref", "-q", "HEAD"}},
+	{"upstream", func(root string) { nativeAheadBehind(root) }, []string{"rev-list", "--left-right", "--count", "HEAD...@{upstream}"}},
+	{"stash", func(root string) { stashCount(root) }, []string{"rev-list", "--walk-reflogs", "--count", "refs/stash", "--"}},
+}
+
+// percentiles returns the 50th and 95th percentiles of ds, which it sorts.
+func percentiles(ds []time.Duration) (time.Duration, time.Duration) {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds[(len(ds)-1)*50/100], ds[(len(ds)-1)*95/100]
+}
+
+// measure runs f n times, and returns the 50th and 95th percentiles of its
+// duration.
+func measure(n int, f func()) (time.Duration, time.Duration) {
+	ds := make([]time.Duration, n)
+	for i := range ds {
+		start := time.Now()
+		f()
+		ds[i] = time.Since(start)
+	}
+	return percentiles(ds)
+}
+
+// runBench times the phases of vcprompt for the directory given in args, as in
+// "vcprompt bench [-n runs] [path]".
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	n := fs.Int("n", 20, "run each phase `n` times")
+
+	// the path may come before or after the flags.
+	var path string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		path, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || path != "" && fs.NArg() > 0 || *n < 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt bench [-n runs] [path]")
+		return 2
+	}
+	if path == "" {
+		path = fs.Arg(0)
+	}
+
+	dir, err := targetDir(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	if err := configure(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	root := probeParent(dir)
+	if root == "" {
+		fmt.Fprintf(os.Stderr, "vcprompt: no repository at %s\n", dir)
+		return 1
+	}
+
+	// the first run warms up the caches of the file system and of git.
+	v := gitInfo(dir, flagOptions())
+
+	fmt.Printf("repository: %s\n", root)
+	fmt.Printf("runs: %d\n", *n)
+	fmt.Println()
+	fmt.Printf("%-10s %10s %10s\n", "phase", "p50", "p95")
+	var total50, total95 time.Duration
+	for _, phase := range benchPhases {
+		p50, p95 := measure(*n, func() { phase.run(dir, v) })
+		total50 += p50
+		total95 += p95
+		fmt.Printf("%-10s %10s %10s\n", phase.name, round(p50), round(p95))
+	}
+	fmt.Printf("%-10s %10s %10s\n", "total", round(total50), round(total95))
+
+	fmt.Println()
+	fmt.Printf("%-10s %10s %10s  %s\n", "native", "p50", "exec p50", "command")
+	for _, pair := range benchPairs {
+		native, _ := measure(*n, func() { pair.native(root) })
+		exec, _ := measure(*n, func() { git(root, pair.exec...).Run() })
+		fmt.Printf("%-10s %10s %10s  git %s\n", pair.name, round(native), round(exec), strings.Join(pair.exec, " "))
+	}
+	return 0
+}
+
+// round rounds d to microseconds, for printing.
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// -budget bounds the time vcprompt takes to collect the state, rather than the
+// time of the checks as -t does: the branch is read first, and the checks start
+// in order of cost, dirty before ahead/behind. When the budget is spent, the
+// checks which are not done are cancelled, and their fields show the pending
+// symbol.
+
+// budgetEnd is the time the budget of -budget is spent, if there is one, and
+// budgetCancel cancels ctx then.
+var (
+	budgetEnd    time.Time
+	budgetCancel context.CancelFunc
+)
+
+// budgetSpent reports whether the budget of -budget is spent.
+func budgetSpent() bool {
+	return !budgetEnd.IsZero() && !time.Now().Before(budgetEnd)
+}
+
+// check is a check of the state of a repository.
+type check struct {
+	name string
+	run  func()
+}
+
+// maxChecks is the number of checks run at the same time.
+const maxChecks = 4
+
+// runChecks runs checks, at most maxChecks at a time and in order, and waits
+// for them. They share the deadline of -t, so that it bounds the slowest check
+// rather than their sum. When the budget of -budget is spent, it stops
+// waiting, cancels the checks which are not done, and returns their names.
+func runChecks(checks []check) (pending []string) {
+	if budgetSpent() {
+		for _, c := range checks {
+			pending = append(pending, c.name)
+		}
+		return pending
+	}
+	if len(checks) == 1 && budgetEnd.IsZero() {
+		checks[0].run()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxChecks)
+	done := make(chan int, len(checks))
+	stop := make(chan struct{})
+	launched := make(chan struct{})
+	go func() {
+		defer close(launched)
+		for i, c := range checks {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int, c check) {
+				defer wg.Done()
+				c.run()
+				<-sem
+				done <- i
+			}(i, c)
+		}
+	}()
+
+	var spent <-chan time.Time
+	if !budgetEnd.IsZero() {
+		t := time.NewTimer(time.Until(budgetEnd))
+		defer t.Stop()
+		spent = t.C
+	}
+	finished := make([]bool, len(checks))
+	for n := 0; n < len(checks); n++ {
+		select {
+		case i := <-done:
+			finished[i] = true
+		case <-spent:
+			// the cancelled checks are waited for, so that they do not
+			// write to the state after it is returned.
+			close(stop)
+			budgetCancel()
+			<-launched
+			wg.Wait()
+			for i, c := range checks {
+				if !finished[i] {
+					debugf("%s check pending after -budget %s", c.name, *budget)
+					pending = append(pending, c.name)
+				}
+			}
+			return pending
+		}
+	}
+	<-launched
+	wg.Wait()
+	return nil
+}
+
+// setPending records that the checks names are pending.
+func (v *vcs) setPending(names []string) {
+	for _, name := range names {
+		if v.pending == nil {
+			v.pending = map[string]bool{}
+		}
+		v.pending[name] = true
+	}
+}
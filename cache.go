@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The cache keeps the state of repositories between runs, in a directory with
+// a JSON file per repository, named after a hash of its root, and the hit and
+// miss counters in stats.json. The directory is shared by all shells: a lock
+// file next to each entry makes the shells which miss it at the same time
+// wait for the one which collects the state. Files are replaced with a rename,
+// so that readers never see half of one, and entries written by another
+// version of the schema are ignored.
+
+// cacheStatsFile is the name of the counters file in the cache directory.
+const cacheStatsFile = "stats.json"
+
+// cacheVersion is the version of the schema of cache entries. It changes when
+// cacheEntry or wireState change, so that the entries of older versions are
+// collected again rather than misread.
+const cacheVersion = 1
+
+// errCacheVersion is returned for entries of another version of the schema.
+var errCacheVersion = errors.New("entry of another version")
+
+// cacheDir returns the cache directory, $XDG_CACHE_HOME/vcprompt.
+func cacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "vcprompt")
+}
+
+// cacheEntry is the cached state of a repository. It is valid as long as the
+// files of the git directory which the state depends on keep the same
+// fingerprint, and it holds the checks which are needed.
+type cacheEntry struct {
+	Version     int        `json:"version"`
+	Root        string     `json:"root"`
+	Fingerprint string     `json:"fingerprint"`
+	Checks      []string   `json:"checks"`
+	State       wireState  `json:"state"`
+	Last        *lastState `json:"last,omitempty"` // for -stale
+}
+
+// lastState is the last complete state of a repository, with the checks which
+// were run.
+type lastState struct {
+	Checks  []string  `json:"checks"`
+	State   wireState `json:"state"`
+	Time    time.Time `json:"time"`
+	Refresh time.Time `json:"refresh"` // when a refresh started, for -cached-max-age
+}
+
+// cachePath returns the path of the cache entry of the repository at root.
+// Where paths do not differ in case, neither do the entries.
+func cachePath(root string) string {
+	if foldCase {
+		root = strings.ToLower(root)
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(cacheDir(), hex.EncodeToString(sum[:8])+".json")
+}
+
+// fingerprintFiles are the files of the git directory which the cached state
+// depends on, besides the refs of the branch and its upstream.
+var fingerprintFiles = []string{
+	"HEAD",
+	"index",
+	"config",
+	"packed-refs",
+	"logs/refs/stash",
+	"MERGE_HEAD",
+	"CHERRY_PICK_HEAD",
+	"REVERT_HEAD",
+	"BISECT_LOG",
+	"rebase-merge",
+	"rebase-apply",
+}
+
+// fingerprint returns a digest of the sizes and modification times of the
+// files of the repository at root which the state depends on.
+func fingerprint(root string) string {
+	gitDir := filepath.Join(root, ".git")
+	files := append([]string(nil), fingerprintFiles...)
+	if line, err := readHead(root); err == nil && strings.HasPrefix(line, refPrefix) {
+		branch := line[len(refPrefix):]
+		files = append(files, "refs/heads/"+branch)
+		if cfg, err := readRepoConfig(root); err == nil {
+			remote, merge := cfg["branch."+branch+".remote"], cfg["branch."+branch+".merge"]
+			if remote != "" && remote != "." && strings.HasPrefix(merge, "refs/heads/") {
+				files = append(files, "refs/remotes/"+remote+"/"+strings.TrimPrefix(merge, "refs/heads/"))
+			}
+		}
+	}
+
+	h := sha256.New()
+	for _, name := range files {
+		fi, err := os.Stat(filepath.Join(gitDir, filepath.FromSlash(name)))
+		if err != nil {
+			fmt.Fprintf(h, "%s -\n", name)
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// readCacheEntry returns the cache entry of the repository at root.
+func readCacheEntry(root string) (cacheEntry, error) {
+	var e cacheEntry
+	data, err := ioutil.ReadFile(cachePath(root))
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return cacheEntry{}, fmt.Errorf("%s: %v", cachePath(root), err)
+	}
+	if e.Version != cacheVersion {
+		return cacheEntry{}, fmt.Errorf("%s: version %d: %w", cachePath(root), e.Version, errCacheVersion)
+	}
+	if e.Root != root {
+		return cacheEntry{}, fmt.Errorf("%s: entry of %s", cachePath(root), e.Root)
+	}
+	return e, nil
+}
+
+// updateCacheEntry changes the cache entry of the repository at root with
+// update, and writes it.
+func updateCacheEntry(root string, update func(e *cacheEntry)) error {
+	e, err := readCacheEntry(root)
+	if err != nil && !os.IsNotExist(err) {
+		debugf("cache: %v", err)
+	}
+	e.Version, e.Root = cacheVersion, root
+	update(&e)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir(), 0700); err != nil {
+		return err
+	}
+	return writeAtomic(cachePath(root), data)
+}
+
+// lockWait bounds the time lockCache waits for the lock without -t.
+const lockWait = 2 * time.Second
+
+// lockCache takes the lock of the cache entry of the repository at root, so
+// that shells which collect its state at the same time wait for the first one
+// and use its state, rather than all collecting it. unlock releases it.
+func lockCache(root string) (unlock func()) {
+	return lockCacheFile(strings.TrimSuffix(cachePath(root), ".json")+".lock", root)
+}
+
+// lockCacheFile takes the lock file at path of the cache directory, for what.
+// It gives up on the lock at the deadline of -t, or after lockWait.
+func lockCacheFile(path, what string) (unlock func()) {
+	nothing := func() {}
+	if err := os.MkdirAll(cacheDir(), 0700); err != nil {
+		debugf("cache: %v", err)
+		return nothing
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		debugf("cache: %v", err)
+		return nothing
+	}
+
+	start := time.Now()
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			debugf("cache: %v", err)
+			f.Close()
+			return nothing
+		}
+		if ok {
+			if waited := time.Since(start); waited > 10*time.Millisecond {
+				debugf("cache: waited %s for another run on %s", waited.Round(time.Millisecond), what)
+			}
+			return func() { f.Close() }
+		}
+		if ctx.Err() != nil || time.Since(start) > lockWait {
+			debugf("cache: %s is still locked, going on without the lock", what)
+			f.Close()
+			return nothing
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readCache returns the cached state of the repository at root, if it has the
+// fingerprint fp and all of checks.
+func readCache(root, fp string, checks []string) (wireState, bool) {
+	e, err := readCacheEntry(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debugf("cache: %v", err)
+		}
+		return wireState{}, false
+	}
+	if e.Fingerprint != fp || !containsAll(e.Checks, checks) {
+		return wireState{}, false
+	}
+	return e.State, true
+}
+
+// containsAll reports whether list contains all of items.
+func containsAll(list, items []string) bool {
+	for _, s := range items {
+		if !contains(list, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCache stores the state w of the repository at root, with the
+// fingerprint fp and the checks which were run.
+func writeCache(root, fp string, checks []string, w wireState) error {
+	return updateCacheEntry(root, func(e *cacheEntry) {
+		e.Fingerprint, e.Checks, e.State = fp, checks, w
+	})
+}
+
+// countCache adds a hit or a miss to the counters of the cache. They are
+// locked, so that the counts of shells which run at the same time add up.
+func countCache(hit bool) {
+	defer lockCacheFile(filepath.Join(cacheDir(), "stats.lock"), cacheStatsFile)()
+	stats := readCacheStats()
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	data, err := json.Marshal(stats)
+	if err == nil {
+		err = os.MkdirAll(cacheDir(), 0700)
+	}
+	if err == nil {
+		err = writeAtomic(filepath.Join(cacheDir(), cacheStatsFile), data)
+	}
+	if err != nil {
+		debugf("cache: %v", err)
+	}
+}
+
+// cacheStats are the hit and miss counters of the cache.
+type cacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// readCacheStats returns the counters of the cache. They are zero if there
+// are none yet.
+func readCacheStats() cacheStats {
+	var stats cacheStats
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir(), cacheStatsFile))
+	if err != nil {
+		return stats
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		debugf("cache: %s: %v", cacheStatsFile, err)
+	}
+	return stats
+}
+
+// cacheFileInfo describes a file of the cache directory.
+type cacheFileInfo struct {
+	path  string
+	root  string // repository, if the entry can be read
+	size  int64
+	mtime time.Time
+}
+
+// cacheEntries returns the entries of the cache, sorted by repository.
+func cacheEntries() ([]cacheFileInfo, error) {
+	files, err := ioutil.ReadDir(cacheDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []cacheFileInfo
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || f.Name() == cacheStatsFile {
+			continue
+		}
+
+		info := cacheFileInfo{
+			path:  filepath.Join(cacheDir(), f.Name()),
+			size:  f.Size(),
+			mtime: f.ModTime(),
+		}
+		var e cacheEntry
+		if data, err := ioutil.ReadFile(info.path); err == nil && json.Unmarshal(data, &e) == nil {
+			info.root = e.Root
+		}
+		entries = append(entries, info)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].root < entries[j].root })
+	return entries, nil
+}
+
+// runCache manages the cache, as in "vcprompt cache stats|clear|path".
+func runCache(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt cache <stats|clear|path>")
+		return 2
+	}
+
+	dir := cacheDir()
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "vcprompt: no cache directory")
+		return 1
+	}
+
+	switch args[0] {
+	case "path":
+		fmt.Println(dir)
+		return 0
+	case "stats":
+		entries, err := cacheEntries()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			return 1
+		}
+
+		var size int64
+		for _, e := range entries {
+			size += e.size
+		}
+		stats := readCacheStats()
+
+		fmt.Printf("path: %s\n", dir)
+		fmt.Printf("entries: %d (%d bytes)\n", len(entries), size)
+		fmt.Printf("hits: %d\n", stats.Hits)
+		fmt.Printf("misses: %d\n", stats.Misses)
+		for _, e := range entries {
+			fmt.Printf("%s\t%s\t%d\n", orNone(e.root), e.mtime.Format(time.RFC3339), e.size)
+		}
+		return 0
+	case "clear":
+		entries, err := cacheEntries()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			return 1
+		}
+		status := 0
+		for _, e := range entries {
+			if err := os.Remove(e.path); err != nil {
+				fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+				status = 1
+			}
+		}
+		if err := os.Remove(filepath.Join(dir, cacheStatsFile)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			status = 1
+		}
+		return status
+	}
+
+	fmt.Fprintf(os.Stderr, "vcprompt: unknown cache command %q\n", args[0])
+	return 2
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageFingerprint sets the modification time of the files of the fingerprint
+// of the repository at root to an hour ago, so that changing them shows even
+// where file times are coarse.
+func ageFingerprint(t *testing.T, root string) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	filepath.Walk(filepath.Join(root, ".git"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+}
+
+func TestFingerprint(t *testing.T) {
+	dir := testRepo(t)
+	writeFiles(t, dir, map[string]string{"f": "a\n"})
+	runGit(t, dir, "add", "f")
+	runGit(t, dir, "commit", "-qm", "a")
+	runGit(t, dir, "config", "branch.main.remote", "origin")
+	runGit(t, dir, "config", "branch.main.merge", "refs/heads/main")
+	runGit(t, dir, "update-ref", "refs/remotes/origin/main", "HEAD")
+	runGit(t, dir, "branch", "other")
+
+	changes := []struct {
+		name    string
+		change  func()
+		changed bool
+	}{
+		{"nothing", func() {}, false},
+		{"work tree", func() { writeFiles(t, dir, map[string]string{"f": "b\n", "g": "c\n"}) }, false},
+		{"other branch", func() { runGit(t, dir, "update-ref", "refs/heads/other", "HEAD") }, false},
+		{"index", func() { runGit(t, dir, "add", "f") }, true},
+		{"branch", func() { runGit(t, dir, "commit", "-qm", "b") }, true},
+		{"upstream", func() { runGit(t, dir, "update-ref", "refs/remotes/origin/main", "HEAD") }, true},
+		{"HEAD", func() { runGit(t, dir, "symbolic-ref", "HEAD", "refs/heads/other") }, true},
+		{"packed refs", func() { runGit(t, dir, "pack-refs", "--all") }, true},
+		{"stash", func() {
+			writeFiles(t, dir, map[string]string{"f": "c\n"})
+			runGit(t, dir, "stash", "-q")
+		}, true},
+		{"config", func() { runGit(t, dir, "config", "core.x", "1") }, true},
+	}
+	for _, c := range changes {
+		ageFingerprint(t, dir)
+		before := fingerprint(dir)
+		c.change()
+		if changed := fingerprint(dir) != before; changed != c.changed {
+			t.Errorf("%s: the fingerprint changed: %v, want %v", c.name, changed, c.changed)
+		}
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	root := filepath.Join(t.TempDir(), "repo")
+	w := wireState{Available: true, Name: "git", Branch: "main", Stash: 2}
+	checks := []string{"conflict", "stash"}
+	if err := writeCache(root, "fp", checks, w); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		fp     string
+		checks []string
+		ok     bool
+	}{
+		{"same", "fp", checks, true},
+		{"fewer checks", "fp", []string{"stash"}, true},
+		{"other fingerprint", "fp2", checks, false},
+		{"other checks", "fp", []string{"stash", "upstream"}, false},
+	}
+	for _, tt := range tests {
+		got, ok := readCache(root, tt.fp, tt.checks)
+		if ok != tt.ok || ok && got.Stash != w.Stash {
+			t.Errorf("%s: %+v, %v; want %v", tt.name, got, ok, tt.ok)
+		}
+	}
+
+	// bad entries are collected again, and replaced.
+	data, err := ioutil.ReadFile(cachePath(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string]string{
+		"empty":         "",
+		"truncated":     string(data[:len(data)/2]),
+		"not JSON":      "\x00\xff garbage",
+		"wrong type":    `{"version": "1", "root": 2}`,
+		"other version": strings.Replace(string(data), `"version":1`, `"version":99`, 1),
+		"other root":    strings.Replace(string(data), root, root+"2", 1),
+	} {
+		if err := ioutil.WriteFile(cachePath(root), []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := readCache(root, "fp", checks); ok {
+			t.Errorf("%s entry: got %+v", name, got)
+		}
+		if err := writeCache(root, "fp", checks, w); err != nil {
+			t.Errorf("%s entry: %v", name, err)
+		}
+		if _, ok := readCache(root, "fp", checks); !ok {
+			t.Errorf("%s entry: not replaced", name)
+		}
+	}
+}
+
+func TestGitInfoCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := testRepo(t)
+	writeFiles(t, dir, map[string]string{"f": "a\n"})
+	runGit(t, dir, "add", "f")
+	runGit(t, dir, "commit", "-qm", "a")
+
+	oldFormat, oldCache := *format, *useCache
+	*format, *useCache = "%b %s", true
+	defer func() { *format, *useCache = oldFormat, oldCache }()
+
+	stash := func(name string, want int) {
+		t.Helper()
+		if v := gitInfo(dir, flagOptions()); v.stash != want {
+			t.Errorf("%s: %d stashes, want %d", name, v.stash, want)
+		}
+	}
+	stash("first run", 0)
+	if _, err := os.Stat(cachePath(probeParent(dir))); err != nil {
+		t.Fatalf("no cache entry: %v", err)
+	}
+	stash("cached", 0)
+	if s := readCacheStats(); s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("%d hits and %d misses, want 1 and 1", s.Hits, s.Misses)
+	}
+	ageFingerprint(t, dir)
+	writeFiles(t, dir, map[string]string{"f": "b\n"})
+	runGit(t, dir, "stash", "-q")
+	stash("after git stash", 1)
+
+	if err := ioutil.WriteFile(cachePath(probeParent(dir)), []byte("{bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stash("corrupt entry", 1)
+	if s := readCacheStats(); s.Hits != 1 || s.Misses != 3 {
+		t.Errorf("%d hits and %d misses, want 1 and 3", s.Hits, s.Misses)
+	}
+}
+
+func TestLockCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	root := "/repo"
+	unlock := lockCache(root)
+
+	f, err := os.Open(strings.TrimSuffix(cachePath(root), ".json") + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := tryLock(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		unlock()
+		t.Skip("no file locks on this platform")
+	}
+
+	// another run waits for the lock, until it is released.
+	got := make(chan time.Time)
+	go func() {
+		defer lockCache(root)()
+		got <- time.Now()
+	}()
+	select {
+	case <-got:
+		t.Fatal("took the lock which is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	released := time.Now()
+	unlock()
+	select {
+	case at := <-got:
+		if at.Before(released) {
+			t.Errorf("took the lock before it was released")
+		}
+	case <-time.After(lockWait):
+		t.Fatal("the lock was not taken after it was released")
+	}
+}
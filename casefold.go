@@ -0,0 +1,7 @@
+//go:build windows || darwin
+
+package main
+
+// foldCase reports whether paths which only differ in case are the same, as
+// on the file systems of Windows and macOS by default.
+const foldCase = true
@@ -0,0 +1,6 @@
+//go:build !windows && !darwin
+
+package main
+
+// foldCase reports whether paths which only differ in case are the same.
+const foldCase = false
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The daemon keeps a git cat-file --batch process for each repository, and
+// asks it for what the upstream check cannot read itself: the commits which
+// are only in packs, and the upstream of branches whose remote has another
+// refspec than the default one. One process answers the requests of many
+// prompts, instead of one git rev-list for each.
+
+// catFileIdle is the time after which the daemon stops the process of a
+// repository no request was about.
+const catFileIdle = 5 * time.Minute
+
+// catFile is a git cat-file --batch process of a repository.
+type catFile struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    *bufio.Reader
+	config time.Time // the time .git/config changed when it started
+	used   time.Time
+	broken bool
+}
+
+// catFiles are the processes of the daemon, by repository.
+var catFiles = struct {
+	sync.Mutex
+	m map[string]*catFile
+}{m: map[string]*catFile{}}
+
+// repoCatFile returns the process of the repository at root, and starts it if
+// there is none. It returns nil outside of the daemon. The processes of other
+// repositories which were not used for catFileIdle are stopped, and so is the
+// one of root if its config changed, which git only reads at the start.
+func repoCatFile(root string) *catFile {
+	if !inDaemon {
+		return nil
+	}
+	var config time.Time
+	if fi, err := os.Stat(filepath.Join(root, ".git", "config")); err == nil {
+		config = fi.ModTime()
+	}
+
+	catFiles.Lock()
+	defer catFiles.Unlock()
+	for r, c := range catFiles.m {
+		if c.idle() || r == root && (c.broken || !c.config.Equal(config)) {
+			debugf("daemon: %s: stopping git cat-file", r)
+			c.close()
+			delete(catFiles.m, r)
+		}
+	}
+	if c, ok := catFiles.m[root]; ok {
+		return c
+	}
+
+	cmd := gitCommand(context.Background(), "cat-file", "--batch")
+	cmd.Dir = root
+	logCommand(root, cmd.Args)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		debugf("daemon: %v", err)
+		return nil
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		debugf("daemon: %v", err)
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		debugf("daemon: git cat-file: %v", err)
+		return nil
+	}
+	c := &catFile{cmd: cmd, in: in, out: bufio.NewReader(out), config: config, used: time.Now()}
+	catFiles.m[root] = c
+	return c
+}
+
+// closeCatFiles stops the processes of the daemon.
+func closeCatFiles() {
+	catFiles.Lock()
+	defer catFiles.Unlock()
+	for r, c := range catFiles.m {
+		c.close()
+		delete(catFiles.m, r)
+	}
+}
+
+// idle reports whether c was not used for catFileIdle.
+func (c *catFile) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.used) > catFileIdle
+}
+
+// close stops the process.
+func (c *catFile) close() {
+	c.in.Close()
+	if err := c.cmd.Wait(); err != nil && !c.broken {
+		debugf("daemon: git cat-file: %v", err)
+	}
+}
+
+// errMissing is returned for objects and names git does not know.
+var errMissing = errors.New("missing")
+
+// object returns the object name, the kind of it and its content. name is
+// anything git rev-parse takes, such as an object name in hexadecimal. The
+// process is killed if ctx is done first, as it would answer too late.
+func (c *catFile) object(name string) (oid []byte, kind string, data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return nil, "", nil, errors.New("git cat-file stopped")
+	}
+	c.used = time.Now()
+	tracef("daemon: git cat-file %s", name)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	defer func() {
+		if err != nil && err != errMissing {
+			c.broken = true
+		}
+	}()
+
+	if _, err := io.WriteString(c.in, name+"\n"); err != nil {
+		return nil, "", nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	header, err := c.out.ReadString('\n')
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	// "<oid> <kind> <size>", or "<name> missing".
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return nil, "", nil, errMissing
+	}
+	if len(fields) != 3 {
+		return nil, "", nil, fmt.Errorf("git cat-file: bad header %q", header)
+	}
+	oid, err = hex.DecodeString(fields[0])
+	size, err2 := strconv.Atoi(fields[2])
+	if err != nil || err2 != nil {
+		return nil, "", nil, fmt.Errorf("git cat-file: bad header %q", header)
+	}
+	// the content is followed by a newline.
+	data = make([]byte, size+1)
+	if _, err := io.ReadFull(c.out, data); err != nil {
+		return nil, "", nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	return oid, fields[1], data[:size], nil
+}
+
+// commit returns the parents of the commit oid.
+func (c *catFile) commit(oid string) ([]string, error) {
+	name := hex.EncodeToString([]byte(oid))
+	_, kind, data, err := c.object(name)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %v", name, err)
+	}
+	if kind != "commit" {
+		return nil, fmt.Errorf("object %s is not a commit", name)
+	}
+	return commitParents(bufio.NewReader(bytes.NewReader(data)), name, len(oid))
+}
+
+// resolve returns the object name of the commit name, e.g. HEAD@{upstream}.
+// It returns errNoUpstream if git does not know it.
+func (c *catFile) resolve(name string) (string, error) {
+	oid, kind, _, err := c.object(name)
+	if err == errMissing {
+		return "", fmt.Errorf("%s: %w", name, errNoUpstream)
+	}
+	if err != nil {
+		return "", err
+	}
+	if kind != "commit" {
+		return "", fmt.Errorf("%s is a %s", name, kind)
+	}
+	return string(oid), nil
+}
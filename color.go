@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// colors maps color directive names, as in "%{red}", to ANSI SGR codes. The
+// names are the same as the ones accepted by fish's set_color.
+var colors = map[string]int{
+	"reset":     0,
+	"normal":    0,
+	"bold":      1,
+	"black":     30,
+	"red":       31,
+	"green":     32,
+	"yellow":    33,
+	"blue":      34,
+	"magenta":   35,
+	"cyan":      36,
+	"white":     37,
+	"brblack":   90,
+	"brred":     91,
+	"brgreen":   92,
+	"bryellow":  93,
+	"brblue":    94,
+	"brmagenta": 95,
+	"brcyan":    96,
+	"brwhite":   97,
+}
+
+// colorSeq returns the escape sequence of the color directive name, which is
+// a color name, a 256-color index such as "208" or a hex color such as
+// "#ff8700". A "bg:" prefix selects the background color, as in "%{bg:blue}".
+//
+// 256 and hex colors are downgraded to what the terminal supports.
+func colorSeq(name string) (string, bool) {
+	if s, ok := colorSeqs.Load(name); ok {
+		s := s.(knownColorSeq)
+		return s.seq, s.ok
+	}
+	seq, ok := makeColorSeq(name)
+	colorSeqs.Store(name, knownColorSeq{seq, ok})
+	return seq, ok
+}
+
+// knownColorSeq is a result of colorSeq.
+type knownColorSeq struct {
+	seq string
+	ok  bool
+}
+
+// colorSeqs holds the results of colorSeq, by directive, which only depend on
+// the terminal.
+var colorSeqs sync.Map
+
+// makeColorSeq is colorSeq, without colorSeqs.
+func makeColorSeq(name string) (string, bool) {
+	bg := strings.HasPrefix(name, "bg:")
+	name = strings.TrimPrefix(name, "bg:")
+
+	if code, ok := colors[name]; ok {
+		if bg {
+			if code < 30 {
+				return "", false
+			}
+			// background colors are 10 above their foreground counterparts.
+			code += 10
+		}
+		return fmt.Sprintf("\x1b[%dm", code), true
+	}
+
+	var r, g, b int
+	switch {
+	case strings.HasPrefix(name, "#") && len(name) == 7:
+		n, err := strconv.ParseUint(name[1:], 16, 32)
+		if err != nil {
+			return "", false
+		}
+		r, g, b = int(n>>16), int(n>>8&0xff), int(n&0xff)
+		if colorLevel() == trueColor {
+			return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", extCode(bg), r, g, b), true
+		}
+	default:
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 || n > 255 {
+			return "", false
+		}
+		if colorLevel() >= color256 {
+			return fmt.Sprintf("\x1b[%d;5;%dm", extCode(bg), n), true
+		}
+		r, g, b = paletteRGB(n)
+	}
+
+	if colorLevel() >= color256 {
+		return fmt.Sprintf("\x1b[%d;5;%dm", extCode(bg), rgbTo256(r, g, b)), true
+	}
+	code := rgbTo16(r, g, b)
+	if bg {
+		code += 10
+	}
+	return fmt.Sprintf("\x1b[%dm", code), true
+}
+
+// extCode returns the SGR code of extended colors.
+func extCode(bg bool) int {
+	if bg {
+		return 48
+	}
+	return 38
+}
+
+// useColor reports whether colors are printed. With -color=auto, they are
+// unless $NO_COLOR is set, and only if the output goes to a terminal or is
+// quoted for a shell with -shell, or $CLICOLOR_FORCE is set.
+func useColor() bool {
+	switch *colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if force := os.Getenv("CLICOLOR_FORCE"); force != "" && force != "0" {
+		return true
+	}
+	return (*shell != "" || outputIsTerminal()) && consoleANSI()
+}
+
+// color levels supported by terminals.
+const (
+	color16 = iota
+	color256
+	trueColor
+)
+
+var (
+	colorLevelOnce  sync.Once
+	colorLevelValue int
+)
+
+// colorLevel detects the colors supported by the terminal from $COLORTERM,
+// $TERM and its terminfo entry. Windows Terminal, which sets $WT_SESSION, and
+// its shells on WSL, support true colors.
+func colorLevel() int {
+	colorLevelOnce.Do(func() {
+		switch os.Getenv("COLORTERM") {
+		case "truecolor", "24bit":
+			colorLevelValue = trueColor
+			return
+		}
+		if os.Getenv("WT_SESSION") != "" {
+			colorLevelValue = trueColor
+			return
+		}
+
+		term := os.Getenv("TERM")
+		switch {
+		case strings.HasSuffix(term, "-direct"):
+			colorLevelValue = trueColor
+		case strings.Contains(term, "256color"), terminfoColors(term) >= 256:
+			colorLevelValue = color256
+		default:
+			colorLevelValue = color16
+		}
+	})
+	return colorLevelValue
+}
+
+// terminfoColors returns the max_colors capability of term from its compiled
+// terminfo entry, or 0 if it is unknown.
+func terminfoColors(term string) int {
+	if term == "" || strings.ContainsRune(term, '/') {
+		return 0
+	}
+
+	dirs := []string{os.Getenv("TERMINFO")}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".terminfo"))
+	}
+	dirs = append(dirs, "/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo")
+
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		// entries are stored by their first letter, or its hex code on
+		// some systems.
+		for _, sub := range []string{term[:1], fmt.Sprintf("%x", term[0])} {
+			data, err := os.ReadFile(filepath.Join(dir, sub, term))
+			if err == nil {
+				return parseTerminfoColors(data)
+			}
+		}
+	}
+	return 0
+}
+
+// parseTerminfoColors extracts max_colors from a compiled terminfo entry, as
+// described in term(5).
+func parseTerminfoColors(data []byte) int {
+	const maxColors = 13 // index of max_colors in the numbers section
+
+	if len(data) < 12 {
+		return 0
+	}
+	header := func(i int) int { return int(binary.LittleEndian.Uint16(data[2*i:])) }
+
+	numSize := 2
+	switch header(0) {
+	case 0432:
+	case 01036:
+		numSize = 4
+	default:
+		return 0
+	}
+
+	off := 12 + header(1) + header(2)
+	if off%2 == 1 {
+		off++
+	}
+	if header(3) <= maxColors {
+		return 0
+	}
+	off += maxColors * numSize
+	if off+numSize > len(data) {
+		return 0
+	}
+
+	if numSize == 2 {
+		return int(int16(binary.LittleEndian.Uint16(data[off:])))
+	}
+	return int(int32(binary.LittleEndian.Uint32(data[off:])))
+}
+
+// basicRGB holds the usual values of the 16 basic colors, and their SGR
+// foreground codes.
+var basicRGB = []struct{ r, g, b, code int }{
+	{0, 0, 0, 30}, {205, 0, 0, 31}, {0, 205, 0, 32}, {205, 205, 0, 33},
+	{0, 0, 238, 34}, {205, 0, 205, 35}, {0, 205, 205, 36}, {229, 229, 229, 37},
+	{127, 127, 127, 90}, {255, 0, 0, 91}, {0, 255, 0, 92}, {255, 255, 0, 93},
+	{92, 92, 255, 94}, {255, 0, 255, 95}, {0, 255, 255, 96}, {255, 255, 255, 97},
+}
+
+// cubeLevels are the values of each component in the 6x6x6 color cube of the
+// 256-color palette.
+var cubeLevels = []int{0, 95, 135, 175, 215, 255}
+
+// paletteRGB returns the color of index n of the 256-color palette.
+func paletteRGB(n int) (r, g, b int) {
+	switch {
+	case n < 16:
+		c := basicRGB[n]
+		return c.r, c.g, c.b
+	case n < 232:
+		n -= 16
+		return cubeLevels[n/36], cubeLevels[n/6%6], cubeLevels[n%6]
+	default:
+		v := 8 + (n-232)*10
+		return v, v, v
+	}
+}
+
+// rgbTo256 returns the closest color of the 256-color palette, excluding the
+// basic colors which are often redefined by themes.
+func rgbTo256(r, g, b int) int {
+	best, bestDist := 16, -1
+	for n := 16; n < 256; n++ {
+		pr, pg, pb := paletteRGB(n)
+		if d := colorDist(r, g, b, pr, pg, pb); bestDist < 0 || d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	return best
+}
+
+// rgbTo16 returns the SGR foreground code of the closest basic color.
+func rgbTo16(r, g, b int) int {
+	best, bestDist := 30, -1
+	for _, c := range basicRGB {
+		if d := colorDist(r, g, b, c.r, c.g, c.b); bestDist < 0 || d < bestDist {
+			best, bestDist = c.code, d
+		}
+	}
+	return best
+}
+
+func colorDist(r1, g1, b1, r2, g2, b2 int) int {
+	dr, dg, db := r1-r2, g1-g2, b1-b2
+	return dr*dr + dg*dg + db*db
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// %x{name} expands to the output of the command name of the commands table of
+// the user's config file, or of the command given as name if there is none,
+// for what only the organization knows, such as the environment a checkout
+// deploys to. It runs with the shell, at the root of the repository, with
+// VCP_ROOT and the fields of -o env in its environment, empty for the checks
+// the format does not need, and its output is trimmed and kept on a single
+// line. Commands are bounded by -t, or by commandTimeout, after which they
+// show the timeout symbol.
+//
+// Repositories cannot run commands: their config files have no commands
+// table, and the formats of those which use %x{} only run the commands of the
+// user's config file.
+
+// commandTimeout bounds the time commands run without -t.
+const commandTimeout = time.Second
+
+var (
+	// userCommands are the commands of the user's config file, by name.
+	userCommands map[string]string
+	// inlineCommands is false if the config file of the repository uses
+	// %x{}, where commands which are not named are not run.
+	inlineCommands = true
+)
+
+// commandsOf returns the commands table of cfg, by name.
+func commandsOf(cfg config) map[string]string {
+	commands := map[string]string{}
+	for key, value := range cfg {
+		if name := strings.TrimPrefix(key, "commands."); name != key {
+			if s, ok := value.(string); ok {
+				commands[name] = s
+			}
+		}
+	}
+	return commands
+}
+
+// usesCommands reports whether any of the settings of cfg holds %x{}.
+func usesCommands(cfg config) bool {
+	for _, value := range cfg {
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if s, ok := v.(string); ok && strings.Contains(s, "%x{") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// command returns the output of the command of %x{name}, for v.
+func (v vcs) command(name string) string {
+	line, ok := userCommands[name]
+	if !ok {
+		if !inlineCommands {
+			debugf("command: %q is not run, the config file of the repository uses %%x{}", name)
+			return ""
+		}
+		line = name
+	}
+	if !canExec {
+		return symbolSet.skipped
+	}
+	assertOffline("%x{"+name+"}", true)
+
+	limit := commandTimeout
+	if *timeout > 0 {
+		limit = *timeout
+	}
+	cctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+
+	args := []string{"sh", "-c", line}
+	if runtime.GOOS == "windows" {
+		args = []string{"cmd", "/C", line}
+	}
+	cmd := exec.CommandContext(cctx, args[0], args[1:]...)
+	cmd.Dir = v.root
+	cmd.Env = append(os.Environ(), "VCP_ROOT="+v.root)
+	for _, kv := range v.fields() {
+		// the fields of the checks which were not run are unknown.
+		check := kv.key
+		if check == "ahead" || check == "behind" {
+			check = "upstream"
+		}
+		if off, ok := checkFlags[check]; ok && !needed(check, off) {
+			kv.value = ""
+		}
+		cmd.Env = append(cmd.Env, "VCP_"+strings.ToUpper(kv.key)+"="+kv.value)
+	}
+	logCommand(v.root, cmd.Args)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		debugf("command: %q: %v", name, err)
+		return ""
+	}
+	// the output is read apart from Wait, which would also wait for the
+	// processes the command started, and which still hold the pipe once it
+	// is killed.
+	done := make(chan []byte, 1)
+	go func() {
+		out, _ := io.ReadAll(stdout)
+		done <- out
+	}()
+	select {
+	case out := <-done:
+		if err := cmd.Wait(); err != nil {
+			debugf("command: %q: %v", name, err)
+		}
+		return printable(commandLines.Replace(strings.TrimSpace(string(out))))
+	case <-cctx.Done():
+		debugf("command: %q timed out after %s", name, limit)
+		go func() {
+			<-done
+			cmd.Wait()
+		}()
+		return symbolSet.timeout
+	}
+}
+
+// commandLines joins the lines of the output of commands.
+var commandLines = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ")
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The upstream check walks the commits of HEAD and its upstream itself, as git
+// rev-list does, without running git: refs are read from their files and from
+// packed-refs, and commits from the commit-graph, or from loose objects for
+// the commits written since. Repositories without a commit-graph, and commits
+// which are only in packs, are left to git rev-list, but for the daemon, which
+// reads the latter from git cat-file (see catfile.go).
+
+// errNoUpstream is returned when the branch has no upstream, or either ref
+// does not exist yet.
+var errNoUpstream = errors.New("no upstream")
+
+// graphParentNone marks a missing parent in the commit data of a commit-graph,
+// and graphExtraEdges the second parent field which points to the edge list
+// of an octopus merge.
+const (
+	graphParentNone = 0x70000000
+	graphExtraEdges = 0x80000000
+)
+
+// graphLayer is a commit-graph file. The layers of a chain share the positions
+// of their commits, in order.
+type graphLayer struct {
+	base   uint32 // position of the first commit
+	n      uint32
+	fanout []byte // OIDF chunk
+	oids   []byte // OIDL chunk
+	data   []byte // CDAT chunk
+	edges  []byte // EDGE chunk
+}
+
+// commitGraph is the commit-graph of a repository.
+type commitGraph struct {
+	hashSize int
+	layers   []graphLayer
+}
+
+// readCommitGraph reads the commit-graph of the git directory gitDir, which is
+// either a single file or a chain of them, as git does. It returns
+// errNotNative if there is none.
+func readCommitGraph(gitDir string, hashSize int) (*commitGraph, error) {
+	info := filepath.Join(gitDir, "objects", "info")
+	paths := []string{filepath.Join(info, "commit-graph")}
+	if _, err := os.Stat(paths[0]); os.IsNotExist(err) {
+		data, err := ioutil.ReadFile(filepath.Join(info, "commit-graphs", "commit-graph-chain"))
+		if err != nil {
+			return nil, fmt.Errorf("no commit-graph: %w", errNotNative)
+		}
+		// the base layer comes first.
+		paths = nil
+		for _, line := range strings.Fields(string(data)) {
+			paths = append(paths, filepath.Join(info, "commit-graphs", "graph-"+line+".graph"))
+		}
+	}
+
+	g := &commitGraph{hashSize: hashSize}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no commit-graph: %w", errNotNative)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// bad files would give wrong counts, and the layers of chains are
+		// also named after the checksum they end with.
+		if len(data) < hashSize || !bytes.Equal(indexHash(data[:len(data)-hashSize], hashSize), data[len(data)-hashSize:]) {
+			return nil, fmt.Errorf("%s: commit-graph checksum mismatch: %w", path, errNotNative)
+		}
+		if filepath.Base(path) != "commit-graph" {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "graph-"), ".graph")
+			if hex.EncodeToString(data[len(data)-hashSize:]) != name {
+				return nil, fmt.Errorf("%s: commit-graph checksum mismatch: %w", path, errNotNative)
+			}
+		}
+		var base uint32
+		if n := len(g.layers); n > 0 {
+			base = g.layers[n-1].base + g.layers[n-1].n
+		}
+		// git rev-list reads the commits of bad files from their objects.
+		l, err := parseGraphLayer(data, hashSize, base)
+		if err != nil && !errors.Is(err, errNotNative) {
+			err = fmt.Errorf("%v: %w", err, errNotNative)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		g.layers = append(g.layers, l)
+	}
+	return g, nil
+}
+
+// parseGraphLayer parses the commit-graph file data, whose first commit is at
+// position base.
+func parseGraphLayer(data []byte, hashSize int, base uint32) (graphLayer, error) {
+	var l graphLayer
+	if len(data) < 8 || string(data[:4]) != "CGPH" {
+		return l, errors.New("not a commit-graph")
+	}
+	if data[4] != 1 {
+		return l, fmt.Errorf("commit-graph version %d: %w", data[4], errNotNative)
+	}
+	hashVersion := byte(1)
+	if hashSize == sha256.Size {
+		hashVersion = 2
+	}
+	if data[5] != hashVersion {
+		return l, fmt.Errorf("commit-graph hash version %d: %w", data[5], errNotNative)
+	}
+
+	chunks := int(data[6])
+	table := data[8:]
+	if len(table) < (chunks+1)*12 {
+		return l, errors.New("commit-graph truncated")
+	}
+	for i := 0; i < chunks; i++ {
+		start, end := binary.BigEndian.Uint64(table[i*12+4:]), binary.BigEndian.Uint64(table[i*12+16:])
+		if start > end || end > uint64(len(data)) {
+			return l, errors.New("commit-graph chunk out of bounds")
+		}
+		chunk := data[start:end]
+		switch string(table[i*12 : i*12+4]) {
+		case "OIDF":
+			l.fanout = chunk
+		case "OIDL":
+			l.oids = chunk
+		case "CDAT":
+			l.data = chunk
+		case "EDGE":
+			l.edges = chunk
+		}
+	}
+	if len(l.fanout) != 256*4 {
+		return l, errors.New("commit-graph without fanout")
+	}
+	l.base = base
+	l.n = binary.BigEndian.Uint32(l.fanout[255*4:])
+	if l.n >= graphParentNone-base {
+		return l, errors.New("commit-graph too large")
+	}
+	if len(l.oids) != int(l.n)*hashSize || len(l.data) != int(l.n)*(hashSize+16) {
+		return l, errors.New("commit-graph chunks do not match")
+	}
+	// the fanout bounds the searches of position.
+	var last uint32
+	for i := 0; i < 256; i++ {
+		count := binary.BigEndian.Uint32(l.fanout[i*4:])
+		if count < last || count > l.n {
+			return l, errors.New("commit-graph fanout out of order")
+		}
+		last = count
+	}
+	return l, nil
+}
+
+// position returns the position of the commit oid in g.
+func (g *commitGraph) position(oid string) (uint32, bool) {
+	for _, l := range g.layers {
+		first := oid[0]
+		var lo uint32
+		if first > 0 {
+			lo = binary.BigEndian.Uint32(l.fanout[(int(first)-1)*4:])
+		}
+		hi := binary.BigEndian.Uint32(l.fanout[int(first)*4:])
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			switch c := strings.Compare(string(l.oids[int(mid)*g.hashSize:int(mid+1)*g.hashSize]), oid); {
+			case c == 0:
+				return l.base + mid, true
+			case c < 0:
+				lo = mid + 1
+			default:
+				hi = mid
+			}
+		}
+	}
+	return 0, false
+}
+
+// commit returns the parents of the commit at pos, and its generation number.
+// Parents are in the same layer or in the layers below, and have lower
+// generation numbers.
+func (g *commitGraph) commit(pos uint32) ([]string, uint32, error) {
+	for _, l := range g.layers {
+		if pos < l.base || pos >= l.base+l.n {
+			continue
+		}
+		rec := g.record(pos)
+		p1, p2 := binary.BigEndian.Uint32(rec), binary.BigEndian.Uint32(rec[4:])
+		gen := binary.BigEndian.Uint32(rec[8:]) >> 2
+
+		var positions []uint32
+		if p1 != graphParentNone {
+			positions = append(positions, p1)
+		}
+		switch {
+		case p2 == graphParentNone:
+		case p2&graphExtraEdges != 0:
+			for i := int(p2 &^ graphExtraEdges); ; i++ {
+				if (i+1)*4 > len(l.edges) {
+					return nil, 0, errors.New("commit-graph edge out of bounds")
+				}
+				e := binary.BigEndian.Uint32(l.edges[i*4:])
+				positions = append(positions, e&^graphExtraEdges)
+				if e&graphExtraEdges != 0 {
+					break
+				}
+			}
+		default:
+			positions = append(positions, p2)
+		}
+
+		parents := make([]string, len(positions))
+		for i, p := range positions {
+			oid, ok := g.oid(p)
+			if !ok || p >= l.base+l.n || p == pos {
+				return nil, 0, errors.New("commit-graph parent out of bounds")
+			}
+			// a generation of 0 is that of graphs written without them,
+			// which the walk leaves to git.
+			if pgen := binary.BigEndian.Uint32(g.record(p)[8:]) >> 2; gen != 0 && pgen >= gen {
+				return nil, 0, errors.New("commit-graph generation out of order")
+			}
+			parents[i] = oid
+		}
+		return parents, gen, nil
+	}
+	return nil, 0, errors.New("commit-graph position out of bounds")
+}
+
+// record returns the commit data of the commit at pos, after its tree, which
+// must be in g.
+func (g *commitGraph) record(pos uint32) []byte {
+	for _, l := range g.layers {
+		if pos >= l.base && pos < l.base+l.n {
+			return l.data[int(pos-l.base)*(g.hashSize+16)+g.hashSize:]
+		}
+	}
+	return nil
+}
+
+// oid returns the name of the commit at pos.
+func (g *commitGraph) oid(pos uint32) (string, bool) {
+	for _, l := range g.layers {
+		if pos >= l.base && pos < l.base+l.n {
+			i := int(pos - l.base)
+			return string(l.oids[i*g.hashSize : (i+1)*g.hashSize]), true
+		}
+	}
+	return "", false
+}
+
+// readLooseCommit returns the parents of the loose commit object oid of the
+// git directory gitDir. It returns errNotNative if the object is not loose.
+func readLooseCommit(gitDir, oid string) ([]string, error) {
+	name := hex.EncodeToString([]byte(oid))
+	f, err := os.Open(filepath.Join(gitDir, "objects", name[:2], name[2:]))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("commit %s is packed: %w", name, errNotNative)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %v", name, err)
+	}
+	defer z.Close()
+
+	r := bufio.NewReader(z)
+	header, err := r.ReadString(0)
+	if err != nil || !strings.HasPrefix(header, "commit ") {
+		return nil, fmt.Errorf("object %s is not a commit", name)
+	}
+	return commitParents(r, name, len(oid))
+}
+
+// commitParents returns the parents of the commit name read from r, after the
+// header of its object.
+func commitParents(r *bufio.Reader, name string, hashSize int) ([]string, error) {
+	var parents []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %v", name, err)
+		}
+		if line == "\n" {
+			// the end of the headers.
+			return parents, nil
+		}
+		if strings.HasPrefix(line, "parent ") {
+			p, err := hex.DecodeString(strings.TrimSpace(line[len("parent "):]))
+			if err != nil || len(p) != hashSize {
+				return nil, fmt.Errorf("commit %s: bad parent", name)
+			}
+			parents = append(parents, string(p))
+		}
+	}
+}
+
+// graphCommit is a commit of a walk.
+type graphCommit struct {
+	parents []string
+	gen     uint32 // greater than the generations of the parents
+}
+
+// commitWalk reads the commits of a repository, as they are needed.
+type commitWalk struct {
+	root    string
+	gitDir  string
+	graph   *commitGraph
+	commits map[string]graphCommit
+}
+
+// commit returns the commit oid, from the commit-graph, from its loose object,
+// or from the git cat-file process of the daemon.
+func (w *commitWalk) commit(oid string) (graphCommit, error) {
+	if c, ok := w.commits[oid]; ok {
+		return c, nil
+	}
+
+	var c graphCommit
+	if pos, ok := w.graph.position(oid); ok {
+		parents, gen, err := w.graph.commit(pos)
+		if err != nil {
+			return c, fmt.Errorf("%v: %w", err, errNotNative)
+		}
+		if gen == 0 || gen == 1<<30-1 {
+			return c, fmt.Errorf("commit-graph without generation numbers: %w", errNotNative)
+		}
+		c = graphCommit{parents, gen}
+	} else {
+		parents, err := readLooseCommit(w.gitDir, oid)
+		if errors.Is(err, errNotNative) {
+			if cat := repoCatFile(w.root); cat != nil {
+				parents, err = cat.commit(oid)
+			}
+		}
+		if err != nil {
+			return c, err
+		}
+		c.parents, c.gen = parents, 1
+		for _, p := range parents {
+			pc, err := w.commit(p)
+			if err != nil {
+				return c, err
+			}
+			if pc.gen >= c.gen {
+				c.gen = pc.gen + 1
+			}
+		}
+	}
+	w.commits[oid] = c
+	return c, nil
+}
+
+// commitQueue is a queue of commits, by decreasing generation, so that the
+// commits are taken after all of their children in the walk.
+type commitQueue struct {
+	oids []string
+	w    *commitWalk
+}
+
+func (q commitQueue) Len() int { return len(q.oids) }
+func (q commitQueue) Less(i, j int) bool {
+	return q.w.commits[q.oids[i]].gen > q.w.commits[q.oids[j]].gen
+}
+func (q commitQueue) Swap(i, j int)       { q.oids[i], q.oids[j] = q.oids[j], q.oids[i] }
+func (q *commitQueue) Push(x interface{}) { q.oids = append(q.oids, x.(string)) }
+func (q *commitQueue) Pop() interface{} {
+	oid := q.oids[len(q.oids)-1]
+	q.oids = q.oids[:len(q.oids)-1]
+	return oid
+}
+
+// aheadBehindOf counts the commits reachable from left but not from right, and
+// from right but not from left. Commits are marked with the sides they are
+// reachable from, and the walk stops when only commits of both sides are left.
+func (w *commitWalk) aheadBehindOf(left, right string) (int, int, error) {
+	const (
+		fromLeft  = 1
+		fromRight = 2
+		fromBoth  = fromLeft | fromRight
+	)
+	marks := map[string]int{}
+	queued := map[string]bool{}
+	q := &commitQueue{w: w}
+	interesting := 0 // queued commits which are not from both sides
+
+	mark := func(oid string, m int) error {
+		if _, err := w.commit(oid); err != nil {
+			return err
+		}
+		old := marks[oid]
+		marks[oid] = old | m
+		switch {
+		case !queued[oid]:
+			queued[oid] = true
+			heap.Push(q, oid)
+			if old|m != fromBoth {
+				interesting++
+			}
+		case old != fromBoth && old|m == fromBoth:
+			interesting--
+		}
+		return nil
+	}
+	if err := mark(left, fromLeft); err != nil {
+		return 0, 0, err
+	}
+	if err := mark(right, fromRight); err != nil {
+		return 0, 0, err
+	}
+
+	var ahead, behind int
+	for interesting > 0 {
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		oid := heap.Pop(q).(string)
+		m := marks[oid]
+		switch m {
+		case fromLeft:
+			ahead++
+		case fromRight:
+			behind++
+		}
+		if m != fromBoth {
+			interesting--
+		}
+		for _, p := range w.commits[oid].parents {
+			if err := mark(p, m); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return ahead, behind, nil
+}
+
+// resolveRef returns the object name of the ref name of the git directory
+// gitDir, following symbolic refs, from its file or from packed-refs.
+func resolveRef(gitDir, name string, hashSize int) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		line, err := readFirstLine(filepath.Join(gitDir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			line, err = packedRef(gitDir, name)
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(line, "ref: ") {
+			name = strings.TrimSpace(line[len("ref: "):])
+			continue
+		}
+		oid, err := hex.DecodeString(strings.TrimSpace(line))
+		if err != nil || len(oid) != hashSize {
+			return "", fmt.Errorf("ref %s: bad object name", name)
+		}
+		return string(oid), nil
+	}
+	return "", fmt.Errorf("ref %s: too many levels of symbolic refs", name)
+}
+
+// packedRef returns the object name of the ref name in the packed-refs file of
+// the git directory gitDir, in hexadecimal. It returns errNoUpstream if it is
+// not there.
+func packedRef(gitDir, name string) (string, error) {
+	data, err := readPackedRefs(gitDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if i := bytes.IndexByte(line, ' '); i >= 0 && string(line[i+1:]) == name {
+			return string(line[:i]), nil
+		}
+	}
+	return "", fmt.Errorf("ref %s: %w", name, errNoUpstream)
+}
+
+// upstreamRef returns the name of the ref of the upstream branch of branch, as
+// configured in cfg.
+func upstreamRef(cfg map[string]string, branch string) (string, error) {
+	remote, merge := cfg["branch."+branch+".remote"], cfg["branch."+branch+".merge"]
+	if remote == "" || merge == "" {
+		return "", fmt.Errorf("branch %s: %w", branch, errNoUpstream)
+	}
+	if remote == "." {
+		return merge, nil
+	}
+	// only the default refspec of remotes is mapped.
+	fetch := cfg["remote."+remote+".fetch"]
+	if fetch != "+refs/heads/*:refs/remotes/"+remote+"/*" || !strings.HasPrefix(merge, "refs/heads/") {
+		return "", fmt.Errorf("refspec of remote %s: %w", remote, errNotNative)
+	}
+	return "refs/remotes/" + remote + "/" + strings.TrimPrefix(merge, "refs/heads/"), nil
+}
+
+// nativeAheadBehind is aheadBehind without git. It returns errNoUpstream if
+// there is no upstream, and errNotNative if git rev-list has to be run
+// instead.
+func nativeAheadBehind(root string) (int, int, error) {
+	cfg, err := readNativeConfig(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	hashSize := sha1.Size
+	switch cfg["extensions.objectformat"] {
+	case "", "sha1":
+	case "sha256":
+		hashSize = sha256.Size
+	default:
+		return 0, 0, fmt.Errorf("object format %s: %w", cfg["extensions.objectformat"], errNotNative)
+	}
+
+	// history which git rewrites is left to it.
+	gitDir := filepath.Join(root, ".git")
+	for _, name := range []string{"shallow", "info/grafts", "refs/replace", "objects/info/alternates"} {
+		if _, err := os.Stat(filepath.Join(gitDir, filepath.FromSlash(name))); err == nil {
+			return 0, 0, fmt.Errorf("%s: %w", name, errNotNative)
+		}
+	}
+	if data, err := readPackedRefs(gitDir); err == nil && bytes.Contains(data, []byte(" refs/replace/")) {
+		return 0, 0, fmt.Errorf("replace refs: %w", errNotNative)
+	}
+
+	line, err := readHead(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !strings.HasPrefix(line, refPrefix) {
+		return 0, 0, fmt.Errorf("detached HEAD: %w", errNoUpstream)
+	}
+	head, err := resolveRef(gitDir, "HEAD", hashSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	var up string
+	upstream, err := upstreamRef(cfg, line[len(refPrefix):])
+	if errors.Is(err, errNotNative) {
+		// the daemon lets git map the refspec.
+		if cat := repoCatFile(root); cat != nil {
+			up, err = cat.resolve("HEAD@{upstream}")
+		}
+	} else if err == nil {
+		up, err = resolveRef(gitDir, upstream, hashSize)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if head == up {
+		return 0, 0, nil
+	}
+	graph, err := readCommitGraph(gitDir, hashSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := &commitWalk{root: root, gitDir: gitDir, graph: graph, commits: map[string]graphCommit{}}
+	return w.aheadBehindOf(head, up)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// graphEntry is a commit of a synthesized commit-graph layer, with the
+// parents and the generation written in its commit data.
+type graphEntry struct {
+	oid    string
+	p1, p2 uint32
+	gen    uint32
+}
+
+// graphOID returns the object name of the commit i of the tests, which sort
+// in the order of i.
+func graphOID(i int) string {
+	oid := make([]byte, sha1.Size)
+	oid[0] = byte(i * 10)
+	oid[1] = byte(i)
+	return string(oid)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// writeGraph returns a commit-graph file with entries, sorted by oid, and the
+// extra edges of octopus merges.
+func writeGraph(entries []graphEntry, edges []uint32) []byte {
+	fanout := make([]byte, 256*4)
+	for i := 0; i < 256; i++ {
+		n := 0
+		for _, e := range entries {
+			if int(e.oid[0]) <= i {
+				n++
+			}
+		}
+		binary.BigEndian.PutUint32(fanout[i*4:], uint32(n))
+	}
+	var oids, data []byte
+	for _, e := range entries {
+		oids = append(oids, e.oid...)
+		rec := make([]byte, sha1.Size+16)
+		binary.BigEndian.PutUint32(rec[sha1.Size:], e.p1)
+		binary.BigEndian.PutUint32(rec[sha1.Size+4:], e.p2)
+		binary.BigEndian.PutUint32(rec[sha1.Size+8:], e.gen<<2)
+		data = append(data, rec...)
+	}
+	chunks := []struct {
+		id   string
+		data []byte
+	}{{"OIDF", fanout}, {"OIDL", oids}, {"CDAT", data}}
+	if len(edges) > 0 {
+		var b []byte
+		for _, e := range edges {
+			b = appendUint32(b, e)
+		}
+		chunks = append(chunks, struct {
+			id   string
+			data []byte
+		}{"EDGE", b})
+	}
+
+	file := []byte{'C', 'G', 'P', 'H', 1, 1, byte(len(chunks)), 0}
+	off := uint64(len(file) + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		file = append(file, c.id...)
+		file = appendUint64(file, off)
+		off += uint64(len(c.data))
+	}
+	file = append(file, 0, 0, 0, 0)
+	file = appendUint64(file, off)
+	for _, c := range chunks {
+		file = append(file, c.data...)
+	}
+	sum := sha1.Sum(file)
+	return append(file, sum[:]...)
+}
+
+// testGraph is the history of the tests, by position:
+//
+//	0 - 1 - 2 - 3 ---- 6
+//	     \            /|
+//	      4 - 5 -----' |
+//	 \_________________/
+//
+// where 6 is an octopus merge of 3, 5 and 0.
+var testGraph = []graphEntry{
+	{graphOID(0), graphParentNone, graphParentNone, 1},
+	{graphOID(1), 0, graphParentNone, 2},
+	{graphOID(2), 1, graphParentNone, 3},
+	{graphOID(3), 2, graphParentNone, 4},
+	{graphOID(4), 1, graphParentNone, 3},
+	{graphOID(5), 4, graphParentNone, 4},
+	{graphOID(6), 3, graphExtraEdges | 0, 5},
+}
+
+// testEdges are the extra edges of 6, after its first parent.
+var testEdges = []uint32{5, graphExtraEdges | 0}
+
+// testGraphs returns testGraph as a single layer, and as a chain of two.
+func testGraphs(t *testing.T) map[string]*commitGraph {
+	t.Helper()
+	single, err := parseGraphLayer(writeGraph(testGraph, testEdges), sha1.Size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := parseGraphLayer(writeGraph(testGraph[:4], nil), sha1.Size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := parseGraphLayer(writeGraph(testGraph[4:], testEdges), sha1.Size, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*commitGraph{
+		"single": {hashSize: sha1.Size, layers: []graphLayer{single}},
+		"chain":  {hashSize: sha1.Size, layers: []graphLayer{base, top}},
+	}
+}
+
+func TestCommitGraph(t *testing.T) {
+	for name, g := range testGraphs(t) {
+		for i, e := range testGraph {
+			pos, ok := g.position(e.oid)
+			if !ok || pos != uint32(i) {
+				t.Errorf("%s: position of %d = %d, %v", name, i, pos, ok)
+			}
+			if oid, ok := g.oid(pos); !ok || oid != e.oid {
+				t.Errorf("%s: oid of %d = %x, %v", name, i, oid, ok)
+			}
+			_, gen, err := g.commit(pos)
+			if err != nil || gen != e.gen {
+				t.Errorf("%s: commit %d has generation %d, %v; want %d", name, i, gen, err, e.gen)
+			}
+		}
+		if _, ok := g.position(graphOID(7)); ok {
+			t.Errorf("%s: found a commit which is not in the graph", name)
+		}
+		parents, _, err := g.commit(6)
+		if want := []string{graphOID(3), graphOID(5), graphOID(0)}; err != nil || fmt.Sprint(parents) != fmt.Sprint(want) {
+			t.Errorf("%s: parents of the octopus merge = %x, %v; want %x", name, parents, err, want)
+		}
+	}
+}
+
+func TestAheadBehindOf(t *testing.T) {
+	tests := []struct {
+		left, right   int
+		ahead, behind int
+	}{
+		{6, 5, 3, 0},
+		{5, 6, 0, 3},
+		{3, 5, 2, 2},
+		{2, 4, 1, 1},
+		{6, 0, 6, 0},
+		{0, 0, 0, 0},
+		{1, 3, 0, 2},
+	}
+	for name, g := range testGraphs(t) {
+		for _, tt := range tests {
+			w := &commitWalk{graph: g, commits: map[string]graphCommit{}}
+			ahead, behind, err := w.aheadBehindOf(graphOID(tt.left), graphOID(tt.right))
+			if err != nil || ahead != tt.ahead || behind != tt.behind {
+				t.Errorf("%s: %d...%d = %d %d, %v; want %d %d", name, tt.left, tt.right, ahead, behind, err, tt.ahead, tt.behind)
+			}
+		}
+	}
+}
+
+func TestCorruptCommitGraph(t *testing.T) {
+	data := writeGraph(testGraph, testEdges)
+	for n := 0; n < len(data)-sha1.Size; n++ {
+		if _, err := parseGraphLayer(data[:n], sha1.Size, 0); err == nil {
+			t.Errorf("no error for the commit-graph truncated to %d of %d bytes", n, len(data))
+		}
+	}
+
+	// each change to the commit-graph either fails or gives a graph which
+	// can be walked without panicking.
+	corrupt := make([]byte, len(data))
+	for i := range data {
+		for _, b := range []byte{0, 0xff, data[i] ^ 0x01, data[i] ^ 0x80} {
+			copy(corrupt, data)
+			corrupt[i] = b
+			l, err := parseGraphLayer(corrupt, sha1.Size, 0)
+			if err != nil {
+				continue
+			}
+			w := &commitWalk{graph: &commitGraph{hashSize: sha1.Size, layers: []graphLayer{l}}, commits: map[string]graphCommit{}}
+			for left := range testGraph {
+				w.aheadBehindOf(graphOID(left), graphOID(5))
+			}
+		}
+	}
+
+	bad := map[string]func(entries []graphEntry) ([]graphEntry, []uint32){
+		"parent out of bounds": func(e []graphEntry) ([]graphEntry, []uint32) {
+			e[2].p1 = 9
+			return e, testEdges
+		},
+		"parent itself": func(e []graphEntry) ([]graphEntry, []uint32) {
+			e[2].p1 = 2
+			return e, testEdges
+		},
+		"generation out of order": func(e []graphEntry) ([]graphEntry, []uint32) {
+			e[1].gen = 7
+			return e, testEdges
+		},
+		"edge out of bounds": func(e []graphEntry) ([]graphEntry, []uint32) {
+			e[6].p2 = graphExtraEdges | 5
+			return e, testEdges
+		},
+		"unterminated edges": func(e []graphEntry) ([]graphEntry, []uint32) {
+			return e, []uint32{5, 0}
+		},
+		"edge out of the graph": func(e []graphEntry) ([]graphEntry, []uint32) {
+			return e, []uint32{5, graphExtraEdges | 40}
+		},
+	}
+	for name, change := range bad {
+		entries := append([]graphEntry(nil), testGraph...)
+		entries, edges := change(entries)
+		l, err := parseGraphLayer(writeGraph(entries, edges), sha1.Size, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		w := &commitWalk{graph: &commitGraph{hashSize: sha1.Size, layers: []graphLayer{l}}, commits: map[string]graphCommit{}}
+		if _, _, err := w.aheadBehindOf(graphOID(6), graphOID(0)); !errors.Is(err, errNotNative) {
+			t.Errorf("%s: %v, want errNotNative", name, err)
+		}
+	}
+
+	fanout := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(fanout[8+5*12+10*4:], 0)
+	if _, err := parseGraphLayer(fanout, sha1.Size, 0); err == nil {
+		t.Error("no error for a fanout out of order")
+	}
+	binary.BigEndian.PutUint32(fanout[8+5*12+10*4:], 1000)
+	if _, err := parseGraphLayer(fanout, sha1.Size, 0); err == nil {
+		t.Error("no error for a fanout above the number of commits")
+	}
+}
+
+// commitAt commits an empty tree in dir, with the given parents, and returns
+// its name.
+func commitAt(t *testing.T, dir, message string, parents ...string) string {
+	t.Helper()
+	args := []string{"commit-tree", "4b825dc642cb6eb9a060e54bf8d69288fbee4904", "-m", message}
+	for _, p := range parents {
+		args = append(args, "-p", p)
+	}
+	return strings.TrimSpace(runGit(t, dir, args...))
+}
+
+func TestNativeAheadBehind(t *testing.T) {
+	dir := testRepo(t)
+	c0 := commitAt(t, dir, "0")
+	c1 := commitAt(t, dir, "1", c0)
+	c2 := commitAt(t, dir, "2", c1)
+	c3 := commitAt(t, dir, "3", c2)
+	c4 := commitAt(t, dir, "4", c1)
+	c5 := commitAt(t, dir, "5", c4)
+	c6 := commitAt(t, dir, "6", c3, c5, c0)
+	runGit(t, dir, "update-ref", "refs/heads/main", c6)
+	runGit(t, dir, "update-ref", "refs/heads/up", c5)
+	runGit(t, dir, "config", "branch.main.remote", ".")
+	runGit(t, dir, "config", "branch.main.merge", "refs/heads/up")
+	runGit(t, dir, "repack", "-adq")
+	// the graph holds the commits up to 5, and 6 and the later ones are
+	// loose.
+	runGit(t, dir, "commit-graph", "write", "--reachable", "--split=no-merge")
+	c7 := commitAt(t, dir, "7", c6)
+	runGit(t, dir, "update-ref", "refs/heads/main", c7)
+	runGit(t, dir, "cat-file", "-e", c7)
+	runGit(t, dir, "commit-graph", "write", "--reachable", "--split=no-merge")
+	c8 := commitAt(t, dir, "8", c7)
+	runGit(t, dir, "update-ref", "refs/heads/main", c8)
+
+	chain := filepath.Join(dir, ".git", "objects", "info", "commit-graphs", "commit-graph-chain")
+	layers, err := ioutil.ReadFile(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(string(layers))); n != 2 {
+		t.Fatalf("the chain has %d layers, want 2", n)
+	}
+
+	want := strings.Fields(runGit(t, dir, "rev-list", "--left-right", "--count", "HEAD...@{upstream}"))
+	ahead, behind, err := nativeAheadBehind(dir)
+	if err != nil || fmt.Sprint(ahead, behind) != strings.Join(want, " ") {
+		t.Fatalf("nativeAheadBehind = %d %d, %v; git says %v", ahead, behind, err, want)
+	}
+
+	// bad files are left to git.
+	top := filepath.Join(filepath.Dir(chain), "graph-"+strings.Fields(string(layers))[1]+".graph")
+	checkBadGraph(t, dir, top, want)
+	runGit(t, dir, "commit-graph", "write", "--reachable")
+	single := filepath.Join(dir, ".git", "objects", "info", "commit-graph")
+	if ahead, behind, err := nativeAheadBehind(dir); err != nil || fmt.Sprint(ahead, behind) != strings.Join(want, " ") {
+		t.Fatalf("nativeAheadBehind = %d %d, %v; git says %v", ahead, behind, err, want)
+	}
+	checkBadGraph(t, dir, single, want)
+}
+
+// checkBadGraph checks that truncated commit-graph files at path, and ones
+// whose checksum does not match, are left to git, which counts want.
+func checkBadGraph(t *testing.T, dir, path string, want []string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte(nil), data...)
+	changed[len(changed)-1] ^= 0xff
+	os.Chmod(path, 0644)
+	for name, corrupt := range map[string][]byte{
+		"truncated": data[:len(data)/2],
+		"changed":   changed,
+	} {
+		if err := ioutil.WriteFile(path, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := nativeAheadBehind(dir); !errors.Is(err, errNotNative) {
+			t.Errorf("%s %s: %v, want errNotNative", filepath.Base(path), name, err)
+		}
+		if ahead, behind := aheadBehind(dir); fmt.Sprint(ahead, behind) != strings.Join(want, " ") {
+			t.Errorf("%s %s: aheadBehind = %d %d, git says %v", filepath.Base(path), name, ahead, behind, want)
+		}
+	}
+}
+
+func TestNativeAheadBehindConfig(t *testing.T) {
+	dir := testRepo(t)
+	c0 := commitAt(t, dir, "0")
+	c1 := commitAt(t, dir, "1", c0)
+	runGit(t, dir, "update-ref", "refs/heads/main", c1)
+	runGit(t, dir, "update-ref", "refs/remotes/origin/main", c0)
+	runGit(t, dir, "commit-graph", "write", "--reachable")
+	files := t.TempDir()
+	writeFiles(t, files, map[string]string{
+		"global":  "[branch \"main\"]\n\tremote = origin\n\tmerge = refs/heads/main\n[remote \"origin\"]\n\turl = /nowhere\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n",
+		"include": "[includeIf \"gitdir:/\"]\n\tpath = " + filepath.Join(files, "global") + "\n",
+	})
+
+	if _, _, err := nativeAheadBehind(dir); !errors.Is(err, errNoUpstream) {
+		t.Errorf("without an upstream: %v, want errNoUpstream", err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(files, "global"))
+	if ahead, behind, err := nativeAheadBehind(dir); err != nil || ahead != 1 || behind != 0 {
+		t.Errorf("with the upstream in $GIT_CONFIG_GLOBAL: %d %d, %v; want 1 0", ahead, behind, err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(files, "include"))
+	if _, _, err := nativeAheadBehind(dir); !errors.Is(err, errNotNative) {
+		t.Errorf("with includeIf: %v, want errNotNative", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// subcommands are completed by "vcprompt completion".
+var subcommands = []struct {
+	name, desc string
+}{
+	{"init", "print a snippet which sets up the shell prompt"},
+	{"install", "set up vcprompt in a prompt framework"},
+	{"completion", "print shell completions"},
+	{"fmt-check", "check a format string"},
+	{"config", "print the effective settings and their sources"},
+	{"doctor", "show how long each step takes, and how to make it faster"},
+	{"bench", "time each phase over several runs"},
+	{"explain", "show where each part of the prompt comes from"},
+	{"placeholders", "list the placeholders as JSON"},
+	{"cache", "show or clear the cache"},
+	{"hook", "install git hooks which refresh the cache"},
+	{"serve", "run a daemon which keeps the state of repositories"},
+	{"gitstatusd", "answer gitstatusd requests on stdin, for powerlevel10k"},
+	{"rpc", "answer JSON-RPC requests on stdin, for editor statuslines"},
+	{"self-update", "replace vcprompt with the latest release"},
+	{"version", "print the version and build metadata"},
+}
+
+// completions generate the completion script of each shell.
+var completions = map[string]func() string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// runCompletion prints the completion script of the shell given in args.
+func runCompletion(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt completion <bash|zsh|fish>")
+		return 2
+	}
+
+	gen, ok := completions[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "vcprompt: unknown shell %q\n", args[0])
+		return 2
+	}
+
+	fmt.Print(gen())
+	return 0
+}
+
+// compFlag is a flag as seen by the completion scripts.
+type compFlag struct {
+	name, desc string
+	isBool     bool
+	values     []string // completed values, if known
+}
+
+// compFlags returns all flags, with the values completed for each.
+func compFlags() []compFlag {
+	values := map[string][]string{
+		"theme":          keys(themes),
+		"icons":          keys(iconSets),
+		"shell":          keys(shellModes),
+		"o":              keys(outputs),
+		"backends":       keys(backendFuncs),
+		"color":          []string{"auto", "always", "never"},
+		"unknown-escape": []string{"echo", "drop", "error"},
+	}
+
+	var flags []compFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		_, desc := flag.UnquoteUsage(f)
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, compFlag{
+			name:   f.Name,
+			desc:   desc,
+			isBool: ok && b.IsBoolFlag(),
+			values: values[f.Name],
+		})
+	})
+	return flags
+}
+
+// keys returns the non-empty keys of m, sorted. m must be a map with string
+// keys.
+func keys(m interface{}) []string {
+	var names []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		if k.String() != "" {
+			names = append(names, k.String())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subcommandArgs returns the arguments completed after each subcommand.
+func subcommandArgs() map[string][]string {
+	return map[string][]string{
+		"init":        append(keys(initScripts), "-async"),
+		"completion":  []string{"bash", "fish", "zsh"},
+		"install":     append(keys(installers), "-print"),
+		"cache":       []string{"clear", "path", "stats"},
+		"hook":        []string{"install", "uninstall", "-print"},
+		"serve":       []string{"-max-age", "-idle"},
+		"bench":       []string{"-n"},
+		"self-update": []string{"-check", "-version"},
+	}
+}
+
+func bashCompletion() string {
+	var buf bytes.Buffer
+
+	var names, flagNames []string
+	for _, c := range subcommands {
+		names = append(names, c.name)
+	}
+	for _, f := range compFlags() {
+		flagNames = append(flagNames, "-"+f.name)
+	}
+
+	fmt.Fprintf(&buf, "_vcprompt() {\n")
+	fmt.Fprintf(&buf, "    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} i\n")
+	fmt.Fprintf(&buf, "    if [ \"$prev\" = \"=\" ]; then\n")
+	fmt.Fprintf(&buf, "        prev=${COMP_WORDS[COMP_CWORD-2]}\n")
+	fmt.Fprintf(&buf, "    elif [ \"$cur\" = \"=\" ]; then\n")
+	fmt.Fprintf(&buf, "        cur=\n")
+	fmt.Fprintf(&buf, "    fi\n")
+	fmt.Fprintf(&buf, "    case $prev in\n")
+	for _, f := range compFlags() {
+		if f.isBool {
+			continue
+		}
+		words := f.values
+		if f.name == "f" {
+			for _, p := range placeholders {
+				words = append(words, "%"+string(p.verb))
+			}
+		}
+		fmt.Fprintf(&buf, "    -%s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;\n", f.name, shellQuote(strings.Join(words, " ")))
+	}
+	fmt.Fprintf(&buf, "    esac\n")
+	fmt.Fprintf(&buf, "    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(&buf, "        case ${COMP_WORDS[i]} in\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(&buf, "        %s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;\n", c.name, shellQuote(strings.Join(subcommandArgs()[c.name], " ")))
+	}
+	fmt.Fprintf(&buf, "        esac\n")
+	fmt.Fprintf(&buf, "    done\n")
+	fmt.Fprintf(&buf, "    COMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(append(names, flagNames...), " ")))
+	fmt.Fprintf(&buf, "}\n")
+	fmt.Fprintf(&buf, "complete -F _vcprompt vcprompt\n")
+	return buf.String()
+}
+
+// zshDesc escapes s for descriptions in _arguments and _describe specs.
+func zshDesc(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func zshCompletion() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "#compdef vcprompt\n\n")
+	fmt.Fprintf(&buf, "_vcprompt() {\n")
+	fmt.Fprintf(&buf, "    local state\n")
+	fmt.Fprintf(&buf, "    local -a subcommands placeholders\n")
+	fmt.Fprintf(&buf, "    subcommands=(\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(&buf, "        %s\n", shellQuote(c.name+":"+zshDesc(c.desc)))
+	}
+	fmt.Fprintf(&buf, "    )\n")
+	fmt.Fprintf(&buf, "    placeholders=(\n")
+	for _, p := range placeholders {
+		fmt.Fprintf(&buf, "        %s\n", shellQuote("%"+string(p.verb)+":"+zshDesc(p.desc)))
+	}
+	fmt.Fprintf(&buf, "    )\n")
+	fmt.Fprintf(&buf, "    _arguments -s \\\n")
+	for _, f := range compFlags() {
+		desc := zshDesc(f.desc)
+		switch {
+		case f.isBool:
+			fmt.Fprintf(&buf, "        %s \\\n", shellQuote("-"+f.name+"["+desc+"]"))
+		case f.name == "f":
+			fmt.Fprintf(&buf, "        %s \\\n", shellQuote("-"+f.name+"=["+desc+"]:format:->format"))
+		case len(f.values) == 0:
+			fmt.Fprintf(&buf, "        %s \\\n", shellQuote("-"+f.name+"=["+desc+"]:"+f.name+": "))
+		default:
+			fmt.Fprintf(&buf, "        %s \\\n", shellQuote("-"+f.name+"=["+desc+"]:"+f.name+":("+strings.Join(f.values, " ")+")"))
+		}
+	}
+	fmt.Fprintf(&buf, "        '1: :->command' \\\n")
+	fmt.Fprintf(&buf, "        '*:: :->args'\n")
+	fmt.Fprintf(&buf, "    case $state in\n")
+	fmt.Fprintf(&buf, "    format) _describe placeholder placeholders ;;\n")
+	fmt.Fprintf(&buf, "    command) _describe command subcommands ;;\n")
+	fmt.Fprintf(&buf, "    args)\n")
+	fmt.Fprintf(&buf, "        case $words[1] in\n")
+	for _, c := range subcommands {
+		if args := subcommandArgs()[c.name]; len(args) > 0 {
+			fmt.Fprintf(&buf, "        %s) compadd -- %s ;;\n", c.name, strings.Join(args, " "))
+		}
+	}
+	fmt.Fprintf(&buf, "        esac\n")
+	fmt.Fprintf(&buf, "        ;;\n")
+	fmt.Fprintf(&buf, "    esac\n")
+	fmt.Fprintf(&buf, "}\n\n")
+	fmt.Fprintf(&buf, "compdef _vcprompt vcprompt\n")
+	return buf.String()
+}
+
+func fishCompletion() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "complete -c vcprompt -f\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(&buf, "complete -c vcprompt -n __fish_use_subcommand -a %s -d %s\n", c.name, shellQuote(c.desc))
+	}
+	for _, c := range subcommands {
+		if args := subcommandArgs()[c.name]; len(args) > 0 {
+			fmt.Fprintf(&buf, "complete -c vcprompt -n '__fish_seen_subcommand_from %s' -a %s\n", c.name, shellQuote(strings.Join(args, " ")))
+		}
+	}
+	for _, f := range compFlags() {
+		switch {
+		case f.isBool:
+			fmt.Fprintf(&buf, "complete -c vcprompt -o %s -d %s\n", f.name, shellQuote(f.desc))
+		case f.name == "f":
+			fmt.Fprintf(&buf, "complete -c vcprompt -o %s -x -d %s\n", f.name, shellQuote(f.desc))
+			for _, p := range placeholders {
+				fmt.Fprintf(&buf, "complete -c vcprompt -o %s -x -a %s -d %s\n", f.name, shellQuote("%"+string(p.verb)), shellQuote(p.desc))
+			}
+		case len(f.values) == 0:
+			fmt.Fprintf(&buf, "complete -c vcprompt -o %s -x -d %s\n", f.name, shellQuote(f.desc))
+		default:
+			fmt.Fprintf(&buf, "complete -c vcprompt -o %s -x -a %s -d %s\n", f.name, shellQuote(strings.Join(f.values, " ")), shellQuote(f.desc))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// config holds the values of a config file, keyed by their dotted names, such
+// as "formats.short". Values are strings, int64s, bools or []interface{}s.
+//
+// Config files are written in a subset of TOML: tables, dotted keys, basic and
+// literal strings, integers, booleans and single-line arrays.
+type config map[string]interface{}
+
+// configPath returns the path of the user's config file.
+func configPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "vcprompt", "config.toml")
+}
+
+// repoConfigNames are the names of per-repository config files, looked for at
+// the root of the repository.
+var repoConfigNames = []string{".vcprompt", ".vcprompt.toml"}
+
+// ignoreMarker is the name of the files which turn vcprompt off in the
+// directory which holds them and beneath it, e.g. in backups or vendored
+// mirrors, as do repository config files with enabled = false.
+const ignoreMarker = ".vcprompt-ignore"
+
+// disabledBy returns the path of the marker or of the config file which turns
+// vcprompt off in dir, or an empty string if there is none. They are looked
+// for in dir and in all of its parents, inside repositories or not.
+func disabledBy(dir string) string {
+	for {
+		if p := filepath.Join(dir, ignoreMarker); fileExists(p) {
+			return p
+		}
+		for _, name := range repoConfigNames {
+			p := filepath.Join(dir, name)
+			if !fileExists(p) {
+				continue
+			}
+			cfg, err := loadConfig(p)
+			if err != nil {
+				// the config file of the repository fails later on.
+				debugf("config: %v", err)
+				continue
+			}
+			if enabled, ok := cfg["enabled"].(bool); ok && !enabled {
+				return p
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// fileExists reports whether p is a regular file.
+func fileExists(p string) bool {
+	f, err := os.Stat(p)
+	return err == nil && f.Mode().IsRegular()
+}
+
+// userOnlyKeys are the keys which the config files of repositories cannot
+// set: how the output is quoted and printed is up to the prompt which runs
+// vcprompt.
+var userOnlyKeys = map[string]bool{"shell": true, "output": true}
+
+// checkRepoConfig returns an error if the config cfg of a repository, read
+// from file, sets userOnlyKeys, or holds strings which are not printable, such
+// as escape sequences, which would reach the terminal as they are.
+func checkRepoConfig(cfg config, file string) error {
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if userOnlyKeys[key] {
+			return fmt.Errorf("%s: %s can only be set in %s", file, key, configPath())
+		}
+		values, ok := cfg[key].([]interface{})
+		if !ok {
+			values = []interface{}{cfg[key]}
+		}
+		for _, v := range values {
+			if s, ok := v.(string); ok && printable(s) != s {
+				return fmt.Errorf("%s: %s holds control characters", file, key)
+			}
+		}
+	}
+	return nil
+}
+
+// repoConfigPath returns the path of the config file of the repository which
+// contains dir, or an empty string if there is none.
+func repoConfigPath(dir string) string {
+	for {
+		if pathExists(filepath.Join(dir, ".git")) {
+			for _, name := range repoConfigNames {
+				if p := filepath.Join(dir, name); fileExists(p) {
+					return p
+				}
+			}
+			return ""
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the config file at path. A missing file is not an error and
+// results in an empty config.
+func loadConfig(path string) (config, error) {
+	if path == "" {
+		return config{}, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig parses a config file read from r.
+func parseConfig(r io.Reader) (config, error) {
+	cfg := config{}
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("%d: bad table header", n)
+			}
+			table = strings.TrimSpace(line[1:end])
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%d: expected key = value", n)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+
+		value, rest, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", n, err)
+		}
+		if !isComment(rest) {
+			return nil, fmt.Errorf("%d: unexpected %q after value", n, rest)
+		}
+		cfg[key] = value
+	}
+
+	return cfg, scanner.Err()
+}
+
+// parseValue parses the value at the start of s, and returns the rest of s.
+func parseValue(s string) (interface{}, string, error) {
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch s[0] {
+	case '"':
+		// basic strings use the same escape sequences as Go.
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		value, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, "", fmt.Errorf("bad string %s", s[:end+1])
+		}
+		return value, s[end+1:], nil
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '[':
+		var values []interface{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(s, "]") {
+				return values, s[1:], nil
+			}
+			value, rest, err := parseValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, value)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, " \t#,]")
+	if end < 0 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("bad value %q", word)
+	}
+	return n, rest, nil
+}
+
+// isComment reports whether s is empty or only holds a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// getString returns the string value of key.
+func (c config) getString(key string) (string, bool) {
+	s, ok := c[key].(string)
+	return s, ok
+}
+
+// configKeys maps the keys of the config file to the flags they set. Keys in
+// the formats table define format aliases instead, those of the commands
+// table the commands of %x{}, exclude and include hold path rules, and
+// enabled = false turns vcprompt off.
+var configKeys = map[string]string{
+	"format":          "f",
+	"narrow":          "narrow",
+	"theme":           "theme",
+	"icons":           "icons",
+	"ascii":           "ascii",
+	"ellipsis":        "ellipsis",
+	"shell":           "shell",
+	"output":          "o",
+	"strict-format":   "strict-format",
+	"strict":          "strict",
+	"unknown-escape":  "unknown-escape",
+	"cache":           "cache",
+	"stale":           "stale",
+	"cached-max-age":  "cached-max-age",
+	"skip-slow":       "skip-slow",
+	"adaptive":        "adaptive",
+	"untracked-limit": "untracked-limit",
+	"daemon":          "daemon",
+	"memo":            "memo",
+	"set-title":       "set-title",
+	"title-format":    "title-format",
+	"rprompt":         "rprompt",
+	"backends":        "backends",
+	"profile":         "profile",
+	"timeout":         "t",
+	"budget":          "budget",
+	"prefix":          "prefix",
+	"suffix":          "suffix",
+	"newline":         "newline",
+	"color":           "color",
+	"no-dirty":        "no-dirty",
+	"no-untracked":    "no-untracked",
+	"no-ahead-behind": "no-ahead-behind",
+}
+
+func init() {
+	for _, name := range symbolNames {
+		configKeys["symbols."+name] = "symbol-" + name
+	}
+}
+
+// sources records where the value of each flag which is not at its default
+// came from: the command line, an environment variable or a config file.
+var sources = map[string]string{}
+
+// setFlag sets the flag name to value unless it was set from another source
+// already, which takes precedence.
+func setFlag(name, value, source string) error {
+	if s, ok := sources[name]; ok && s != source {
+		return nil
+	}
+	if err := flag.Set(name, value); err != nil {
+		return fmt.Errorf("%s: invalid value %q for %s: %v", source, value, name, err)
+	}
+	sources[name] = source
+	return nil
+}
+
+// envName returns the environment variable of a config key, e.g.
+// VCPROMPT_STRICT_FORMAT for strict-format and VCPROMPT_SYMBOL_DIRTY for
+// symbols.dirty.
+func envName(key string) string {
+	key = strings.Replace(key, "symbols.", "symbol.", 1)
+	return "VCPROMPT_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// applyEnv sets the flags which were not given on the command line from the
+// environment. It must be called right after flag.Parse.
+func applyEnv() error {
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "command line"
+	})
+
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		env := envName(key)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setFlag(configKeys[key], value, "$"+env); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// envDisabled reports whether vcprompt is disabled with $VCPROMPT_DISABLE.
+func envDisabled() bool {
+	switch os.Getenv("VCPROMPT_DISABLE") {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+// applyConfig sets the flags which were not set on the command line, from the
+// environment or from a previously applied config file from cfg, read from
+// the given file.
+func applyConfig(cfg config, file string) error {
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, "formats.") || strings.HasPrefix(key, "commands.") || key == "exclude" || key == "include" {
+			continue
+		}
+		if key == "enabled" {
+			// read with the exclusions.
+			if _, ok := cfg[key].(bool); !ok {
+				return fmt.Errorf("%s: enabled must be true or false", file)
+			}
+			continue
+		}
+		name, ok := configKeys[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown key %q", file, key)
+		}
+
+		values, isList := cfg[key].([]interface{})
+		if !isList {
+			values = []interface{}{cfg[key]}
+		}
+		switch {
+		case name == "backends":
+			// lists of backends are comma separated on the command line.
+			var names []string
+			for _, v := range values {
+				names = append(names, fmt.Sprint(v))
+			}
+			values = []interface{}{strings.Join(names, ",")}
+		case isList && name != "narrow":
+			return fmt.Errorf("%s: %s takes a single value", file, key)
+		}
+
+		for _, v := range values {
+			if err := setFlag(name, fmt.Sprint(v), file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getStrings returns the list of strings value of key.
+func (c config) getStrings(key string) ([]string, error) {
+	values, ok := c[key].([]interface{})
+	if !ok && c[key] != nil {
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	var list []string
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of strings", key)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// isExcluded reports whether dir matches one of the exclude rules of cfg and
+// none of its include rules. Rules are path prefixes, or globs where "**"
+// matches any number of directories, and may start with "~/".
+func (c config) isExcluded(dir string) (bool, error) {
+	exclude, err := c.getStrings("exclude")
+	if err != nil {
+		return false, err
+	}
+	include, err := c.getStrings("include")
+	if err != nil {
+		return false, err
+	}
+	return matchAny(exclude, dir) && !matchAny(include, dir), nil
+}
+
+func matchAny(rules []string, dir string) bool {
+	for _, rule := range rules {
+		if matchPath(rule, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the absolute path p matches rule. Rules may use
+// either separator on Windows, and match regardless of case where paths do.
+func matchPath(rule, p string) bool {
+	rule = filepath.ToSlash(rule)
+	if strings.HasPrefix(rule, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false
+		}
+		rule = filepath.Join(home, rule[2:])
+	}
+	rule = filepath.ToSlash(filepath.Clean(rule))
+	p = filepath.ToSlash(filepath.Clean(p))
+	if foldCase {
+		rule, p = strings.ToLower(rule), strings.ToLower(p)
+	}
+
+	if !strings.ContainsAny(rule, "*?[") {
+		return p == rule || strings.HasPrefix(p, strings.TrimSuffix(rule, "/")+"/")
+	}
+	return matchSegments(strings.Split(rule, "/"), strings.Split(p, "/"))
+}
+
+// matchSegments matches path segments against glob segments, where "**"
+// matches zero or more segments.
+func matchSegments(glob, segs []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(glob[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], segs[0]); !ok {
+			return false
+		}
+		glob, segs = glob[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// withProfile returns c with the settings of the named profile, from the
+// profiles.<name> table, replacing the top-level ones. The other profiles are
+// left out. It reports whether c has that profile.
+func (c config) withProfile(name string) (config, bool) {
+	prefix := "profiles." + name + "."
+	out := config{}
+	found := false
+	for key, value := range c {
+		if !strings.HasPrefix(key, "profiles.") {
+			if _, ok := out[key]; !ok {
+				out[key] = value
+			}
+			continue
+		}
+		if name != "" && strings.HasPrefix(key, prefix) {
+			out[key[len(prefix):]] = value
+			found = true
+		}
+	}
+	return out, found
+}
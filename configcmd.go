@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runConfig prints the settings in effect and where they came from, as in
+// "vcprompt config [path]".
+func runConfig(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt config [path]")
+		return 2
+	}
+
+	dir, err := targetDir(strings.Join(args, ""))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	if err := configure(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	fmt.Printf("# config file: %s\n", orNone(configPath()))
+	fmt.Printf("# repository config file: %s\n", orNone(repoConfigPath(dir)))
+
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		if !strings.HasPrefix(key, "symbols.") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := configKeys[key]
+		fmt.Printf("%s = %s # %s\n", key, configValue(name), source(name))
+	}
+
+	fmt.Println()
+	fmt.Println("[symbols]")
+	for _, name := range symbolNames {
+		from := symbolsSource
+		if isFlagSet("symbol-" + name) {
+			from = source("symbol-" + name)
+		}
+		fmt.Printf("%s = %q # %s\n", name, *symbolSet.lookup(name), from)
+	}
+	return 0
+}
+
+// configValue returns the value of the flag name in config file syntax.
+func configValue(name string) string {
+	switch name {
+	case "narrow":
+		var list []string
+		for _, f := range narrowFormats {
+			list = append(list, strconv.Quote(fmt.Sprintf("%d:%s", f.width, f.format)))
+		}
+		return "[" + strings.Join(list, ", ") + "]"
+	case "backends":
+		var list []string
+		for _, b := range strings.Split(*backends, ",") {
+			if b != "" {
+				list = append(list, strconv.Quote(b))
+			}
+		}
+		return "[" + strings.Join(list, ", ") + "]"
+	}
+
+	f := flag.Lookup(name)
+	if g, ok := f.Value.(flag.Getter); ok {
+		if b, ok := g.Get().(bool); ok {
+			return strconv.FormatBool(b)
+		}
+	}
+	return strconv.Quote(f.Value.String())
+}
+
+// source returns where the value of the flag name came from.
+func source(name string) string {
+	if s, ok := sources[name]; ok {
+		return s
+	}
+	return "default"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// consoleANSI reports whether the terminal interprets ANSI escape sequences.
+func consoleANSI() bool {
+	return true
+}
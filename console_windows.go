@@ -0,0 +1,66 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// enableVirtualTerminalProcessing is the mode of consoles which interpret
+// ANSI escape sequences.
+const enableVirtualTerminalProcessing = 0x4
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+var (
+	consoleANSIOnce  sync.Once
+	consoleANSIValue bool
+)
+
+// consoleANSI reports whether the terminal interprets ANSI escape sequences.
+// Windows Terminal, ConEmu, ANSICON and the terminals which set $TERM, such as
+// mintty, do. The console of Windows 10 and later does once asked to, which
+// vcprompt does: the mode stays set after it exits, so that the shell prints
+// the colors of the prompt too. The legacy console, and that of older
+// versions of Windows, does not, and shows colors as garbage.
+func consoleANSI() bool {
+	consoleANSIOnce.Do(func() {
+		if os.Getenv("WT_SESSION") != "" || os.Getenv("ConEmuANSI") == "ON" || os.Getenv("ANSICON") != "" || os.Getenv("TERM") != "" {
+			consoleANSIValue = true
+			return
+		}
+		consoleANSIValue = enableVT()
+	})
+	return consoleANSIValue
+}
+
+// enableVT turns on ANSI escape sequences in the console, which may be that
+// of the shell reading the output from a pipe, and reports whether it could.
+func enableVT() bool {
+	name, err := syscall.UTF16PtrFromString("CONOUT$")
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		debugf("console: %v", err)
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var mode uint32
+	if err := syscall.GetConsoleMode(h, &mode); err != nil {
+		debugf("console: %v", err)
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminalProcessing)); r == 0 {
+		debugf("console: legacy console without ANSI escape sequences: %v", err)
+		return false
+	}
+	return true
+}
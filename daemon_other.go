@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// detach does nothing: the daemon shares the console of vcprompt.
+func detach(cmd *exec.Cmd) {}
+
+// checkPrivate accepts any directory, as there are no owners and modes to
+// check here.
+func checkPrivate(path string, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detach makes cmd run in its own session, so that it outlives the shell.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// checkPrivate reports an error unless fi, the info of path, is owned by the
+// user and has mode 0700.
+func checkPrivate(path string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by uid %d", path, os.Getuid())
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("%s has mode %#o, not 0700", path, perm)
+	}
+	return nil
+}
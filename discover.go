@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The probe which finds the repository reads what the checks need of its git
+// directory in the same pass: it opens .git once, and reads HEAD, config and
+// packed-refs from the open directory, which the checks would each look up
+// from the root again otherwise. This saves most of the system calls of runs
+// which find the file system caches cold. Each probe reads them again, so that
+// they are never older than the run.
+
+// gitDirFiles are the files of a git directory, as read by the probe.
+type gitDirFiles struct {
+	root       string
+	head       []byte
+	headErr    error
+	config     []byte
+	configErr  error
+	packedRefs []byte
+	packedErr  error
+}
+
+// probed are the files read by the last probe which found a repository.
+var probed struct {
+	sync.Mutex
+	files *gitDirFiles
+}
+
+// probeGitDir reports whether dir has a .git directory, and reads its files
+// if it has.
+func probeGitDir(dir string) bool {
+	d, err := os.Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+	if fi, err := d.Stat(); err != nil || !fi.IsDir() {
+		return false
+	}
+
+	files := &gitDirFiles{root: dir}
+	files.head, files.headErr = readFileAt(d, "HEAD")
+	files.config, files.configErr = readFileAt(d, "config")
+	files.packedRefs, files.packedErr = readFileAt(d, "packed-refs")
+	probed.Lock()
+	probed.files = files
+	probed.Unlock()
+	return true
+}
+
+// readFileAt reads the file name of the open directory dir.
+func readFileAt(dir *os.File, name string) ([]byte, error) {
+	f, err := openAt(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// probedFiles returns the files of the git directory of root read by the last
+// probe, or nil if it found another repository.
+func probedFiles(root string) *gitDirFiles {
+	probed.Lock()
+	defer probed.Unlock()
+	if probed.files == nil || probed.files.root != root {
+		return nil
+	}
+	return probed.files
+}
+
+// readHead returns the first line of .git/HEAD of the repository at root.
+func readHead(root string) (string, error) {
+	f := probedFiles(root)
+	if f == nil {
+		return readFirstLine(filepath.Join(root, githead))
+	}
+	if f.headErr != nil {
+		return "", f.headErr
+	}
+	i := bytes.IndexByte(f.head, '\n')
+	if i < 0 {
+		return "", fmt.Errorf("unable to read first line of %s", filepath.Join(root, githead))
+	}
+	return strings.TrimSpace(string(f.head[:i])), nil
+}
+
+// readRepoConfig reads .git/config of the repository at root, as readGitConfig.
+func readRepoConfig(root string) (map[string]string, error) {
+	f := probedFiles(root)
+	if f == nil {
+		return readGitConfig(filepath.Join(root, ".git", "config"))
+	}
+	if f.configErr != nil {
+		return nil, f.configErr
+	}
+	return parseGitConfig(bytes.NewReader(f.config))
+}
+
+// readPackedRefs returns the packed-refs file of the git directory gitDir.
+func readPackedRefs(gitDir string) ([]byte, error) {
+	f := probedFiles(filepath.Dir(gitDir))
+	if f == nil || filepath.Base(gitDir) != ".git" {
+		return ioutil.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	}
+	return f.packedRefs, f.packedErr
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slowStep is the duration above which doctor suggests speeding up a step.
+const slowStep = 50 * time.Millisecond
+
+// doctorStep is a step of the collection of git state, as timed by doctor.
+type doctorStep struct {
+	name string
+	uses string // git command or file
+	off  *bool  // flag which disables the step, if any
+	run  func(root string) string
+}
+
+var doctorSteps = []doctorStep{
+	{"head", ".git/HEAD", nil, func(root string) string {
+		line, err := readHead(root)
+		if err != nil {
+			return err.Error()
+		}
+		return line
+	}},
+	{"dirty", ".git/index, or git diff --no-ext-diff --quiet --exit-code", noDirty, func(root string) string {
+		return strconv.FormatBool(isModified(root))
+	}},
+	{"untracked", "the work tree and .gitignore files, or git ls-files --others --exclude-standard --directory --no-empty-directory", noUntrack, func(root string) string {
+		found, complete := hasUntracked(root)
+		if !complete {
+			return fmt.Sprintf("unknown, none in the first %d directories", *maxUntrack)
+		}
+		return strconv.FormatBool(found)
+	}},
+	{"conflict", "git ls-files --unmerged", nil, func(root string) string {
+		return strconv.FormatBool(hasConflicts(root))
+	}},
+	{"upstream", ".git/objects/info/commit-graph, or git rev-list --left-right --count HEAD...@{upstream}", noUpstream, func(root string) string {
+		ahead, behind := aheadBehind(root)
+		return fmt.Sprintf("ahead %d, behind %d", ahead, behind)
+	}},
+	{"stash", ".git/logs/refs/stash", nil, func(root string) string {
+		return strconv.Itoa(stashCount(root))
+	}},
+	{"operation", ".git/{rebase-merge,rebase-apply,MERGE_HEAD,...}", nil, func(root string) string {
+		return orNone(gitOperation(root))
+	}},
+}
+
+// runDoctor reports how vcprompt sees the directory given in args, how long
+// each step takes and what could make it faster, as in "vcprompt doctor
+// [path]".
+func runDoctor(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt doctor [path]")
+		return 2
+	}
+
+	dir, err := targetDir(strings.Join(args, ""))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	if err := configure(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	var suggestions []string
+
+	fmt.Printf("vcprompt: %s\n", buildVersion())
+	fmt.Printf("directory: %s\n", dir)
+	fmt.Printf("config file: %s\n", orNone(configPath()))
+	fmt.Printf("repository config file: %s\n", orNone(repoConfigPath(dir)))
+	fmt.Printf("backends: %s\n", orNone(*backends))
+	if *timeout > 0 {
+		fmt.Printf("timeout: %s\n", *timeout)
+	} else {
+		fmt.Println("timeout: none")
+	}
+	if *useCache {
+		fmt.Printf("cache: %s\n", cacheDir())
+	} else {
+		fmt.Println("cache: off")
+	}
+	if err := checkSocketDir(filepath.Dir(socketPath())); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("daemon: not used: %v\n", err)
+		suggestions = append(suggestions, "remove "+filepath.Dir(socketPath())+", or set $XDG_RUNTIME_DIR")
+	} else if conn, err := net.Dial("unix", socketPath()); err == nil {
+		conn.Close()
+		fmt.Printf("daemon: running at %s\n", socketPath())
+	} else {
+		fmt.Println("daemon: not running")
+	}
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		fmt.Println("git: not found")
+		suggestions = append(suggestions, "install git, or add it to $PATH")
+	} else {
+		out, _ := exec.Command(gitPath, "--version").Output()
+		fmt.Printf("git: %s (%s)\n", gitPath, strings.TrimSpace(string(out)))
+	}
+
+	start := time.Now()
+	root := probeParent(dir)
+	fmt.Printf("repository: %s (%s)\n", orNone(root), time.Since(start).Round(time.Microsecond))
+	if root == "" {
+		return 1
+	}
+	if t, ok := readAdaptive()[root]; ok && *adaptive {
+		fmt.Printf("adaptive: %s strategy since %s (work tree checks: %s native, %s with git)\n",
+			t.Strategy, t.Since.Format(time.RFC3339), strategySummary(t.Native), strategySummary(t.Exec))
+	} else if *adaptive {
+		fmt.Println("adaptive: no timings yet")
+	} else {
+		fmt.Println("adaptive: off")
+	}
+
+	fmt.Println()
+	var total time.Duration
+	for _, step := range doctorSteps {
+		if step.off != nil && *step.off {
+			fmt.Printf("%-10s %10s  disabled\n", step.name, "")
+			continue
+		}
+
+		start := time.Now()
+		result := step.run(root)
+		d := time.Since(start)
+		total += d
+
+		fmt.Printf("%-10s %10s  %s\n", step.name, d.Round(time.Microsecond), result)
+		fmt.Printf("%-10s %10s  uses %s\n", "", "", step.uses)
+
+		if d > slowStep {
+			suggestions = append(suggestions, slowSuggestion(root, step.name))
+		}
+	}
+	fmt.Printf("%-10s %10s\n", "total", total.Round(time.Microsecond))
+
+	if total > slowStep && !*adaptive {
+		suggestions = append(suggestions, "let vcprompt pick how to check the work tree of each repository: -adaptive or adaptive = true")
+	}
+	if total > slowStep && *timeout == 0 {
+		suggestions = append(suggestions, `set a timeout, e.g. -t 100ms or timeout = "100ms", so that the prompt never waits longer`)
+	}
+
+	if len(suggestions) > 0 {
+		fmt.Println()
+		for _, s := range suggestions {
+			if s != "" {
+				fmt.Printf("suggestion: %s\n", s)
+			}
+		}
+	}
+	return 0
+}
+
+// strategySummary describes the record s of a strategy of -adaptive.
+func strategySummary(s strategyTiming) string {
+	if s.Last.IsZero() {
+		return "not tried"
+	}
+	return s.Took.Round(time.Microsecond).String()
+}
+
+// slowSuggestion returns how to speed up the slow step name of the repository
+// at root, or an empty string if doctor does not know.
+func slowSuggestion(root, name string) string {
+	config := func(key string) string {
+		out, _ := git(root, "config", "--get", key).Output()
+		return strings.TrimSpace(string(out))
+	}
+
+	switch name {
+	case "dirty":
+		if config("core.fsmonitor") == "" {
+			return "enable the file system monitor: git config core.fsmonitor true"
+		}
+	case "untracked":
+		if config("core.untrackedCache") != "true" {
+			return "enable the untracked cache: git config core.untrackedCache true"
+		}
+		return "ignore the directories with many untracked files in .gitignore"
+	}
+	return ""
+}
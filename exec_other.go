@@ -0,0 +1,6 @@
+//go:build !js && !wasip1
+
+package main
+
+// canExec reports whether vcprompt can start processes.
+const canExec = true
@@ -0,0 +1,8 @@
+//go:build js || wasip1
+
+package main
+
+// canExec reports whether vcprompt can start processes. WebAssembly hosts,
+// such as web-based terminals, cannot, and the checks which need git are
+// skipped there: only what vcprompt reads itself is shown.
+const canExec = false
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runExplain prints the prompt for the directory given in args, and where
+// each part of it comes from, as in "vcprompt explain [path]".
+func runExplain(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt explain [path]")
+		return 2
+	}
+
+	dir, err := targetDir(strings.Join(args, ""))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	if err := configure(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	fmt.Printf("format: %q (%s)\n", *format, source("f"))
+	if by, _ := excludedBy(dir); by != "" {
+		fmt.Printf("%s is excluded by %s\n", dir, by)
+		return 1
+	}
+
+	// the daemon does not know where the state comes from.
+	v := collectLocal(dir)
+	if !v.available {
+		fmt.Printf("no repository at %s among -backends %s\n", dir, orNone(*backends))
+		return 1
+	}
+	root := probeParent(dir)
+	fmt.Printf("repository: %s (%s)\n", root, v.name)
+
+	p := v.pieces()
+	var text strings.Builder
+	for _, pc := range p {
+		if !pc.color {
+			text.WriteString(pc.s)
+		}
+	}
+	fmt.Printf("prompt: %q\n", text.String())
+	fmt.Println()
+
+	shown := map[rune]bool{}
+	for i := 0; i < len(p); i++ {
+		pc := p[i]
+		switch {
+		case pc.color:
+			fmt.Printf("%-16s %-6s color\n", fmt.Sprintf("%%{%s}", pc.s), "")
+		case pc.verb != 0:
+			shown[pc.verb] = true
+			fmt.Printf("%-16q %%%-5c %s\n", pc.s, pc.verb, fieldSource(v, pc.verb, root))
+		default:
+			// consecutive characters are printed together.
+			s := pc.s
+			for i+1 < len(p) && !p[i+1].color && p[i+1].verb == 0 {
+				i++
+				s += p[i].s
+			}
+			fmt.Printf("%-16q %-6s text\n", s, "")
+		}
+	}
+
+	for _, verb := range lintFormat(*format).verbs {
+		if !shown[verb] {
+			fmt.Printf("%-16s %%%-5c %s, in a conditional section which is hidden\n", "", verb, fieldSource(v, verb, root))
+		}
+	}
+	return 0
+}
+
+// stepUses returns the git command or file used by the doctor step name.
+func stepUses(name string) string {
+	for _, step := range doctorSteps {
+		if step.name == name {
+			return step.uses
+		}
+	}
+	return ""
+}
+
+// checkSource describes the result of the check step of v, which found
+// something if found is true, and is disabled by the flag name off.
+func checkSource(v vcs, step string, found bool, what, off string) string {
+	f := flag.Lookup(off)
+	switch {
+	case f != nil && f.Value.String() == "true":
+		return fmt.Sprintf("not checked, because of -%s", off)
+	case v.skipped[step] && !canExec:
+		return fmt.Sprintf("%s check skipped, it needs git, which cannot run here, skipped symbol", step)
+	case v.skipped[step] && (v.strategy == strategyCached || *skipSlow <= 0):
+		return fmt.Sprintf("%s check skipped, too slow in this repository for -adaptive, skipped symbol", step)
+	case v.skipped[step]:
+		return fmt.Sprintf("%s check skipped, slower than -skip-slow %s %d times in a row, skipped symbol", step, *skipSlow, slowRuns)
+	case v.pending[step]:
+		return fmt.Sprintf("%s check not done within -budget %s, pending symbol", step, *budget)
+	case v.timedOut[step]:
+		return fmt.Sprintf("%s check cut after -t %s, timeout symbol", step, *timeout)
+	case found:
+		return fmt.Sprintf("%s, found by %s", what, stepUses(step))
+	}
+	return fmt.Sprintf("no %s, checked with %s", what, stepUses(step))
+}
+
+// fieldSource describes where the value of the placeholder verb comes from.
+func fieldSource(v vcs, verb rune, root string) string {
+	switch verb {
+	case 'n':
+		return fmt.Sprintf("%s repository at %s", v.name, root)
+	case 'b':
+		if v.branch == "" {
+			return "no branch, HEAD is detached in " + stepUses("head")
+		}
+		return "branch HEAD points to, in " + stepUses("head")
+	case 'r':
+		if v.revision == "" {
+			return "no revision, HEAD is a branch in " + stepUses("head")
+		}
+		return "detached HEAD, in " + stepUses("head")
+	case 'm':
+		return checkSource(v, "dirty", v.isModified, "uncommitted changes", "no-dirty")
+	case 'u':
+		return checkSource(v, "untracked", v.untracked, "untracked files", "no-untracked")
+	case 'c':
+		return checkSource(v, "conflict", v.conflict, "unmerged files", "")
+	case 'p':
+		return checkSource(v, "upstream", v.ahead > 0, counted(v.ahead, "commits ahead of upstream"), "no-ahead-behind")
+	case 'P':
+		return checkSource(v, "upstream", v.behind > 0, counted(v.behind, "commits behind upstream"), "no-ahead-behind")
+	case 's':
+		return fmt.Sprintf("%d stashed changes, in %s", v.stash, stepUses("stash"))
+	case 'N':
+		return "icon of " + v.name + ", from -icons or -theme"
+	case 'B':
+		return "branch icon, from -icons or -theme"
+	case 'R':
+		return "name of the directory of the repository at " + root
+	case 'x':
+		return "output of a command, run with the shell at " + root
+	}
+	return ""
+}
+
+// counted puts n before what, unless it is zero.
+func counted(n int, what string) string {
+	if n == 0 {
+		return what
+	}
+	return strconv.Itoa(n) + " " + what
+}
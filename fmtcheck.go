@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runFmtCheck checks the format given in args, as in "vcprompt fmt-check
+// <format>", and prints the problems it finds and the vcs which support all of
+// the placeholders it uses.
+func runFmtCheck(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt fmt-check <format>")
+		return 2
+	}
+
+	info := lintFormat(args[0])
+	for _, p := range info.problems {
+		fmt.Printf("error: %s\n", p)
+	}
+
+	var verbs []string
+	for _, v := range info.verbs {
+		verbs = append(verbs, "%"+string(v))
+	}
+	fmt.Printf("placeholders: %s\n", strings.Join(verbs, " "))
+
+	supported := supportedBy(info.verbs)
+	if len(supported) == 0 {
+		fmt.Println("supported by: none")
+	} else {
+		fmt.Printf("supported by: %s\n", strings.Join(supported, " "))
+	}
+
+	if len(info.problems) > 0 {
+		return 1
+	}
+	return 0
+}
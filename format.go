@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+func (v vcs) String() string {
+	return outputs[""](v)
+}
+
+// pieces expands the format string for v.
+func (v vcs) pieces() pieces {
+	return v.piecesOf(*format)
+}
+
+// piecesOf expands the format string f for v.
+func (v vcs) piecesOf(f string) pieces {
+	if v.timedOut["fs"] {
+		// the file system did not answer in time.
+		return pieces{{s: symbolSet.timeout}}
+	}
+	if !v.available {
+		return nil
+	}
+
+	p := getPieces()
+	v.render(&p, compileFormat(f))
+	return p
+}
+
+// vcsNames are the names accepted in vcs-conditional sections, as in
+// "%(git:...)". It includes systems vcprompt does not support, so that format
+// strings can be shared with other implementations.
+var vcsNames = map[string]bool{
+	"git":    true,
+	"hg":     true,
+	"svn":    true,
+	"bzr":    true,
+	"fossil": true,
+	"darcs":  true,
+	"cvs":    true,
+}
+
+// readVCSCondition reads the "name:" prefix of a vcs-conditional section from
+// r, and returns the name. It returns an empty string and reads nothing if the
+// section does not start with one.
+func readVCSCondition(r *bufio.Reader) string {
+	buf, _ := r.Peek(8)
+	i := bytes.IndexByte(buf, ':')
+	if i < 0 || !vcsNames[string(buf[:i])] {
+		return ""
+	}
+	r.Discard(i + 1)
+	return string(buf[:i])
+}
+
+// toASCII replaces every non-ASCII character of s with "?".
+func toASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= utf8.RuneSelf {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// nodeKind is the kind of a node of a compiled format.
+type nodeKind int
+
+const (
+	textNode    nodeKind = iota // text, printed as-is
+	colorNode                   // a color, named by text
+	fieldNode                   // the placeholder verb
+	unknownNode                 // an unknown escape, written as text
+	sectionNode                 // a conditional section, of nodes
+	commandNode                 // a command, named by text
+)
+
+// node is an element of a compiled format.
+type node struct {
+	kind  nodeKind
+	text  string
+	verb  rune
+	spec  spec
+	vcs   string // the vcs of vcs-conditional sections
+	nodes []node
+}
+
+// maxCompiled bounds the number of compiled formats which are kept.
+const maxCompiled = 64
+
+// compiled holds the compiled formats, by format string, so that the daemon
+// and -watch parse their formats once.
+var compiled = struct {
+	sync.Mutex
+	formats map[string][]node
+}{formats: map[string][]node{}}
+
+// compileFormat returns the compiled form of format.
+func compileFormat(format string) []node {
+	compiled.Lock()
+	defer compiled.Unlock()
+	if nodes, ok := compiled.formats[format]; ok {
+		return nodes
+	}
+	if len(compiled.formats) >= maxCompiled {
+		compiled.formats = map[string][]node{}
+	}
+	nodes := compile(bufio.NewReader(strings.NewReader(format)), false)
+	compiled.formats[format] = nodes
+	return nodes
+}
+
+// compile parses the format read from reader. If section is true, it stops at
+// the ")" which closes the current conditional section.
+func compile(reader *bufio.Reader, section bool) []node {
+	var nodes []node
+	// the text since the last node which is not text.
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, node{kind: textNode, text: text.String()})
+			text.Reset()
+		}
+	}
+	add := func(n node) {
+		flush()
+		nodes = append(nodes, n)
+	}
+
+	var eof rune = 0
+	for {
+		r, _, _ := reader.ReadRune()
+		if r == eof {
+			break
+		}
+
+		if r == ')' && section {
+			break
+		}
+
+		// write ordinary characters.
+		if r != '%' {
+			text.WriteRune(r)
+			continue
+		}
+
+		// we have format string
+		spec := readSpec(reader)
+
+		next, _, err := reader.ReadRune()
+		if err != nil {
+			if raw := spec.String(); raw != "%" {
+				// so is a spec without a placeholder, as an unknown escape.
+				add(node{kind: unknownNode, text: raw})
+			} else {
+				// a lone "%" at the end is printed as-is.
+				text.WriteByte('%')
+			}
+			break
+		}
+
+		switch next {
+		case '%': // literal percent
+			text.WriteByte('%')
+		case ')': // literal parenthesis, in conditional sections
+			text.WriteByte(')')
+		case '{': // color
+			raw, _ := reader.ReadString('}')
+			name := strings.TrimSuffix(raw, "}")
+			if _, ok := colorSeq(name); ok {
+				add(node{kind: colorNode, text: name})
+			} else {
+				add(node{kind: unknownNode, text: spec.String() + "{" + raw})
+			}
+		case '(': // conditional section
+			name := readVCSCondition(reader)
+			add(node{kind: sectionNode, vcs: name, nodes: compile(reader, true)})
+		case 'x': // command
+			if name, ok := readCommand(reader); ok {
+				add(node{kind: commandNode, text: name, spec: spec})
+			} else {
+				add(node{kind: unknownNode, text: spec.String() + "x" + name})
+			}
+		default:
+			if _, ok := (vcs{}).field(next); !ok {
+				add(node{kind: unknownNode, text: spec.String() + string(next)})
+				continue
+			}
+			add(node{kind: fieldNode, verb: next, spec: spec})
+		}
+	}
+	flush()
+	return nodes
+}
+
+// render appends the expansion of the compiled format nodes to p, in place,
+// so that sections which are left out cost no copy. It reports whether any
+// placeholder expanded to a non-empty value, and whether there were any
+// placeholders at all.
+func (v vcs) render(p *pieces, nodes []node) (found, fields bool) {
+	for _, n := range nodes {
+		switch n.kind {
+		case textNode:
+			p.text(n.text)
+		case colorNode:
+			p.color(n.text)
+		case unknownNode:
+			if *unknownEsc == "echo" {
+				p.text(n.text)
+			}
+		case sectionNode:
+			start := len(*p)
+			ok, hasFields := v.render(p, n.nodes)
+			fields = fields || hasFields
+			if n.vcs != "" {
+				// vcs-conditional sections without placeholders only
+				// depend on the vcs.
+				ok = n.vcs == v.name && (ok || !hasFields)
+			}
+			if ok {
+				found = true
+			} else {
+				*p = (*p)[:start]
+			}
+		case fieldNode:
+			value, _ := v.field(n.verb)
+			fields = true
+			if value != "" {
+				found = true
+			}
+			p.field(n.verb, n.spec.apply(value))
+		case commandNode:
+			value := v.command(n.text)
+			fields = true
+			if value != "" {
+				found = true
+			}
+			p.field('x', n.spec.apply(value))
+		}
+	}
+	return found, fields
+}
+
+// readCommand reads the "{name}" of a command placeholder from r, and returns
+// the name. It reports false if there is no "{", or no "}" after it, and
+// returns what it read.
+func readCommand(r *bufio.Reader) (string, bool) {
+	if b, err := r.Peek(1); err != nil || b[0] != '{' {
+		return "", false
+	}
+	r.Discard(1)
+	name, err := r.ReadString('}')
+	if err != nil {
+		return "{" + name, false
+	}
+	return strings.TrimSuffix(name, "}"), true
+}
+
+// checkFormat reports the first problem in format, for -strict-format.
+func checkFormat(format string) error {
+	if problems := lintFormat(format).problems; len(problems) > 0 {
+		return errors.New(problems[0])
+	}
+	return nil
+}
+
+// formatInfo is the result of lintFormat.
+type formatInfo struct {
+	problems []string
+	verbs    []rune // placeholders used, without duplicates
+	commands bool   // whether %x{} is used
+}
+
+// lintFormat parses format, and reports unknown escapes and colors, and
+// unterminated colors and conditional sections.
+func lintFormat(format string) formatInfo {
+	var info formatInfo
+
+	sr := strings.NewReader(format)
+	reader := bufio.NewReader(sr)
+	pos := func() int { return len(format) - sr.Len() - reader.Buffered() }
+
+	var sections []int // offsets of open conditional sections
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			break
+		}
+		if r == ')' && len(sections) > 0 {
+			sections = sections[:len(sections)-1]
+			continue
+		}
+		if r != '%' {
+			continue
+		}
+
+		start := pos() - 1
+		spec := readSpec(reader)
+		if spec.clamped {
+			info.problems = append(info.problems, fmt.Sprintf("width or precision above %d at offset %d", maxSpec, start))
+		}
+
+		next, _, err := reader.ReadRune()
+		if err != nil {
+			if raw := spec.String(); raw != "%" {
+				info.problems = append(info.problems, fmt.Sprintf("unterminated escape %s at offset %d", raw, start))
+			}
+			break
+		}
+
+		switch next {
+		case '%', ')':
+		case '(':
+			sections = append(sections, start)
+			readVCSCondition(reader)
+		case '{':
+			name, err := reader.ReadString('}')
+			if err != nil {
+				info.problems = append(info.problems, fmt.Sprintf("unterminated color %%{%s at offset %d", name, start))
+				continue
+			}
+			name = strings.TrimSuffix(name, "}")
+			if _, ok := colorSeq(name); !ok {
+				info.problems = append(info.problems, fmt.Sprintf("unknown color %q at offset %d", name, start))
+			}
+		case 'x':
+			name, ok := readCommand(reader)
+			switch {
+			case strings.HasPrefix(name, "{"):
+				info.problems = append(info.problems, fmt.Sprintf("unterminated command %%x%s at offset %d", name, start))
+			case !ok:
+				info.problems = append(info.problems, fmt.Sprintf("unknown escape %%x at offset %d", start))
+			default:
+				info.commands = true
+				if !strings.ContainsRune(string(info.verbs), 'x') {
+					info.verbs = append(info.verbs, 'x')
+				}
+			}
+		default:
+			if _, ok := (vcs{}).field(next); !ok {
+				info.problems = append(info.problems, fmt.Sprintf("unknown escape %%%c at offset %d", next, start))
+				continue
+			}
+			if !strings.ContainsRune(string(info.verbs), next) {
+				info.verbs = append(info.verbs, next)
+			}
+		}
+	}
+
+	for _, start := range sections {
+		info.problems = append(info.problems, fmt.Sprintf("unterminated conditional section at offset %d", start))
+	}
+	return info
+}
+
+// placeholder describes a format placeholder.
+type placeholder struct {
+	verb     rune
+	desc     string
+	backends []string // vcs which provide it
+}
+
+var placeholders = []placeholder{
+	{'n', "vcs name", []string{"git"}},
+	{'b', "branch", []string{"git"}},
+	{'r', "revision", []string{"git"}},
+	{'m', "modified", []string{"git"}},
+	{'u', "untracked", []string{"git"}},
+	{'c', "conflicts", []string{"git"}},
+	{'p', "commits ahead of upstream", []string{"git"}},
+	{'P', "commits behind upstream", []string{"git"}},
+	{'s', "stash count", []string{"git"}},
+	{'N', "vcs icon", []string{"git"}},
+	{'B', "branch icon", []string{"git"}},
+	{'R', "repository name", []string{"git"}},
+	{'x', "output of a command, as in %x{command}", []string{"git"}},
+}
+
+// supportedBy returns the vcs which provide all of the placeholders verbs.
+func supportedBy(verbs []rune) []string {
+	var names []string
+	for _, p := range placeholders {
+		for _, b := range p.backends {
+			if !contains(names, b) {
+				names = append(names, b)
+			}
+		}
+	}
+
+	var supported []string
+	for _, name := range names {
+		ok := true
+		for _, verb := range verbs {
+			for _, p := range placeholders {
+				if p.verb == verb && !contains(p.backends, name) {
+					ok = false
+				}
+			}
+		}
+		if ok {
+			supported = append(supported, name)
+		}
+	}
+	return supported
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// field returns the value of the placeholder verb, and reports whether verb is
+// a known placeholder.
+func (v vcs) field(verb rune) (string, bool) {
+	switch verb {
+	case 'n': // version control system name
+		return v.name, true
+	case 'b': // branch name
+		return v.branch, true
+	case 'r': // revision number
+		return v.revision, true
+	case 'm': // is modified flag
+		if v.pending["dirty"] {
+			return symbolSet.pending, true
+		}
+		if v.skipped["dirty"] {
+			return symbolSet.skipped, true
+		}
+		if v.timedOut["dirty"] {
+			return symbolSet.timeout, true
+		}
+		if v.isModified {
+			return symbolSet.modified, true
+		}
+		return "", true
+	case 'u': // untracked files flag
+		if v.pending["untracked"] {
+			return symbolSet.pending, true
+		}
+		if v.skipped["untracked"] {
+			return symbolSet.skipped, true
+		}
+		if v.timedOut["untracked"] {
+			return symbolSet.timeout, true
+		}
+		if v.untracked {
+			return symbolSet.untracked, true
+		}
+		return "", true
+	case 'c': // conflict flag
+		if v.pending["conflict"] {
+			return symbolSet.pending, true
+		}
+		if v.skipped["conflict"] {
+			return symbolSet.skipped, true
+		}
+		if v.timedOut["conflict"] {
+			return symbolSet.timeout, true
+		}
+		if v.conflict {
+			return symbolSet.conflict, true
+		}
+		return "", true
+	case 's': // stash count
+		if v.pending["stash"] {
+			return symbolSet.pending, true
+		}
+		return count(symbolSet.stash, v.stash), true
+	case 'p': // commits ahead of upstream
+		if v.pending["upstream"] {
+			return symbolSet.pending, true
+		}
+		if v.skipped["upstream"] {
+			return symbolSet.skipped, true
+		}
+		if v.timedOut["upstream"] {
+			return symbolSet.timeout, true
+		}
+		return count(symbolSet.ahead, v.ahead), true
+	case 'P': // commits behind upstream
+		if v.pending["upstream"] {
+			return symbolSet.pending, true
+		}
+		if v.skipped["upstream"] {
+			return symbolSet.skipped, true
+		}
+		if v.timedOut["upstream"] {
+			return symbolSet.timeout, true
+		}
+		return count(symbolSet.behind, v.behind), true
+	case 'N': // vcs icon
+		return symbolSet.vcs[v.name], true
+	case 'B': // branch icon
+		if v.branch == "" {
+			return "", true
+		}
+		return symbolSet.branch, true
+	case 'R': // repository name
+		if v.root == "" {
+			return "", true
+		}
+		return printable(filepath.Base(v.root)), true
+	}
+	return "", false
+}
+
+// count returns symbol followed by n, or an empty string if n is zero.
+func count(symbol string, n int) string {
+	if n == 0 {
+		return ""
+	}
+	return symbol + strconv.Itoa(n)
+}
+
+// spec holds the printf-like modifiers of a placeholder, as in "%-10.20b".
+type spec struct {
+	left      bool   // pad on the right instead of the left
+	width     int    // minimum width, 0 if unset
+	precision int    // maximum width, -1 if unset
+	clamped   bool   // the width or the precision was above maxSpec
+	raw       string // as written, after the "%"
+}
+
+// maxSpec bounds widths and precisions, so that formats cannot ask for more
+// memory than a prompt needs. Larger values are clamped to it.
+const maxSpec = 1000
+
+// String returns s as written in a format, from the "%" to the placeholder.
+func (s spec) String() string {
+	return "%" + s.raw
+}
+
+// readSpec reads the optional flags, width and precision of a placeholder
+// from r.
+func readSpec(r *bufio.Reader) spec {
+	s := spec{precision: -1}
+	var raw strings.Builder
+
+	if c, _, _ := r.ReadRune(); c == '-' {
+		s.left = true
+		raw.WriteByte('-')
+	} else {
+		r.UnreadRune()
+	}
+
+	var clamped bool
+	s.width, clamped = readNumber(r, &raw)
+	s.clamped = clamped
+
+	if c, _, _ := r.ReadRune(); c == '.' {
+		raw.WriteByte('.')
+		s.precision, clamped = readNumber(r, &raw)
+		s.clamped = s.clamped || clamped
+	} else {
+		r.UnreadRune()
+	}
+
+	s.raw = raw.String()
+	return s
+}
+
+// readNumber reads a decimal number from r, at most maxSpec, and reports
+// whether it was clamped. It returns 0 if there is none. The digits are
+// written to raw as they are read.
+func readNumber(r *bufio.Reader, raw *strings.Builder) (int, bool) {
+	n, clamped := 0, false
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return n, clamped
+		}
+		if c < '0' || c > '9' {
+			r.UnreadRune()
+			return n, clamped
+		}
+		raw.WriteRune(c)
+		if n = n*10 + int(c-'0'); n > maxSpec {
+			n, clamped = maxSpec, true
+		}
+	}
+}
+
+// apply truncates and pads value according to s.
+func (s spec) apply(value string) string {
+	if s.precision >= 0 {
+		value = truncate(value, s.precision, *ellipsis)
+	}
+
+	pad := s.width - stringWidth(value)
+	if pad <= 0 {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value) + pad)
+	if s.left {
+		b.WriteString(value)
+	}
+	for i := 0; i < pad; i++ {
+		b.WriteByte(' ')
+	}
+	if !s.left {
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// truncate shortens s to at most n columns. If s is cut, its end is replaced
+// with ellipsis.
+func truncate(s string, n int, ellipsis string) string {
+	if stringWidth(s) <= n {
+		return s
+	}
+
+	e := stringWidth(ellipsis)
+	if n <= e {
+		return s[:widthOffset(s, n)]
+	}
+	return s[:widthOffset(s, n-e)] + ellipsis
+}
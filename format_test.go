@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestSpecClamped(t *testing.T) {
+	for _, s := range []string{"1000000000000000000000", "-99999999999999999999999", ".1000000000000000000000", "5.1001"} {
+		spec := readSpec(bufio.NewReader(strings.NewReader(s + "b")))
+		if !spec.clamped || spec.width > maxSpec || spec.precision > maxSpec {
+			t.Errorf("%%%sb: spec = %+v, want clamped to %d", s, spec, maxSpec)
+		}
+		if got := spec.apply("main"); len(got) > maxSpec {
+			t.Errorf("%%%sb: apply gives %d bytes", s, len(got))
+		}
+		if problems := lintFormat("%" + s + "b").problems; len(problems) == 0 {
+			t.Errorf("%%%sb: no problem reported", s)
+		}
+	}
+	for _, s := range []string{"1000", "-12", ".1000", "5.3", ""} {
+		spec := readSpec(bufio.NewReader(strings.NewReader(s + "b")))
+		if spec.clamped {
+			t.Errorf("%%%sb: clamped", s)
+		}
+		if problems := lintFormat("%" + s + "b").problems; len(problems) > 0 {
+			t.Errorf("%%%sb: %v", s, problems)
+		}
+	}
+}
+
+func TestUnknownEscapes(t *testing.T) {
+	tests := []struct {
+		format, echo, drop string
+	}{
+		{"a%yb", "a%yb", "ab"},
+		{"a%-5.2yb", "a%-5.2yb", "ab"},
+		{"a%{nope}b", "a%{nope}b", "ab"},
+		{"a%5{nope}b", "a%5{nope}b", "ab"},
+		{"a%{nope", "a%{nope", "a"},
+		{"a%{red}b", "ab", "ab"},
+		{"a%", "a%", "a%"},
+		{"a%-5", "a%-5", "a"},
+		{"a%.3", "a%.3", "a"},
+		{"a%007", "a%007", "a"},
+		{"a%5.", "a%5.", "a"},
+	}
+	old := *unknownEsc
+	defer func() { *unknownEsc = old }()
+	for _, tt := range tests {
+		for mode, want := range map[string]string{"echo": tt.echo, "drop": tt.drop} {
+			*unknownEsc = mode
+			var got strings.Builder
+			for _, p := range (vcs{available: true}).piecesOf(tt.format) {
+				if !p.color {
+					got.WriteString(p.s)
+				}
+			}
+			if got.String() != want {
+				t.Errorf("%q with -unknown-escape=%s: %q, want %q", tt.format, mode, got.String(), want)
+			}
+		}
+	}
+}
+
+func TestLintUnterminatedEscape(t *testing.T) {
+	for format, want := range map[string]string{
+		"abc%-5": "unterminated escape %-5 at offset 3",
+		"abc%.3": "unterminated escape %.3 at offset 3",
+		"%05.":   "unterminated escape %05. at offset 0",
+	} {
+		if problems := lintFormat(format).problems; len(problems) != 1 || problems[0] != want {
+			t.Errorf("%q: %q, want %q", format, problems, want)
+		}
+	}
+	if problems := lintFormat("abc%").problems; len(problems) > 0 {
+		t.Errorf(`"abc%%": %q`, problems)
+	}
+}
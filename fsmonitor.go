@@ -0,0 +1,25 @@
+package main
+
+import "strings"
+
+// With core.fsmonitor, the dirty check is left to git diff, which asks the
+// monitor itself: the daemon of git, core.fsmonitor = true, or a hook, such as
+// the fsmonitor-watchman hook of Watchman. Hooks come from the config of the
+// repository, which git only trusts in repositories owned by the user or
+// allowed by safe.directory, so vcprompt never runs them itself.
+
+// fsmonitorConfig returns the fsmonitor hook of the git config cfg, or whether
+// it uses the daemon of git instead.
+func fsmonitorConfig(cfg map[string]string) (hook string, daemon bool) {
+	v, ok := cfg["core.fsmonitor"]
+	if !ok {
+		return "", false
+	}
+	switch strings.ToLower(v) {
+	case "", "false", "no", "off", "0":
+		return "", false
+	case "true", "yes", "on", "1":
+		return "", true
+	}
+	return v, false
+}
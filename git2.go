@@ -0,0 +1,148 @@
+//go:build git2
+
+package main
+
+// The git2 backend collects the state of git repositories with libgit2, which
+// is faster than running git on very large repositories. It needs libgit2 and
+// cgo, is built with
+//
+//	go get github.com/libgit2/git2go/v34
+//	go build -tags git2
+//
+// and selected with -backends=git2.
+
+import (
+	"path/filepath"
+	"strings"
+
+	git2 "github.com/libgit2/git2go/v34"
+)
+
+func init() {
+	backendFuncs["git2"] = git2Info
+}
+
+// git2Operations are the operations in progress reported by vcprompt, for the
+// states of libgit2.
+var git2Operations = map[git2.RepositoryState]string{
+	git2.RepositoryStateMerge:                "merge",
+	git2.RepositoryStateRevert:               "revert",
+	git2.RepositoryStateCherrypick:           "cherry-pick",
+	git2.RepositoryStateBisect:               "bisect",
+	git2.RepositoryStateRebase:               "rebase",
+	git2.RepositoryStateRebaseInteractive:    "rebase",
+	git2.RepositoryStateRebaseMerge:          "rebase",
+	git2.RepositoryStateApplyMailbox:         "rebase",
+	git2.RepositoryStateApplyMailboxOrRebase: "rebase",
+}
+
+// git2Info is gitInfo with libgit2.
+func git2Info(dir string, o collectOptions) vcs {
+	v := vcs{name: "git", available: true}
+
+	repo, err := git2.OpenRepositoryExtended(dir, 0, "")
+	if err != nil || repo.IsBare() {
+		debugf("git2: no repository above %s: %v", dir, err)
+		v.available = false
+		return v
+	}
+	defer repo.Free()
+	debugf("git2: repository at %s", repo.Workdir())
+	v.root = filepath.Clean(repo.Workdir())
+
+	head, err := repo.Head()
+	switch {
+	case git2.IsErrorCode(err, git2.ErrorCodeUnbornBranch):
+		// no commit yet: HEAD names the unborn branch.
+		if ref, err := repo.References.Lookup("HEAD"); err == nil {
+			v.branch = strings.TrimPrefix(ref.SymbolicTarget(), "refs/heads/")
+			ref.Free()
+		}
+	case err != nil:
+		collectError(err)
+		return v
+	case head.IsBranch():
+		v.branch = head.Shorthand()
+	default:
+		v.revision = head.Target().String()
+	}
+	if head != nil {
+		defer head.Free()
+	}
+
+	// the status has the dirty, untracked and conflict checks at once.
+	dirty, untracked, conflict := o.needed("dirty"), o.needed("untracked"), o.needed("conflict")
+	if dirty || untracked || conflict {
+		opts := &git2.StatusOptions{
+			Show:  git2.StatusShowIndexAndWorkdir,
+			Flags: git2.StatusOptExcludeSubmodules,
+		}
+		if untracked {
+			opts.Flags |= git2.StatusOptIncludeUntracked
+		}
+		done := timed("git2: status")
+		entries, err := git2Status(repo, opts)
+		done()
+		if err != nil {
+			collectError(err)
+		} else if !v.expired("dirty") {
+			for _, st := range entries {
+				switch {
+				case st&git2.StatusConflicted != 0:
+					v.conflict = conflict
+				case st&git2.StatusWtNew != 0:
+					v.untracked = untracked
+				case st&(git2.StatusWtModified|git2.StatusWtDeleted|git2.StatusWtTypeChange|git2.StatusWtRenamed) != 0:
+					v.isModified = dirty
+				}
+			}
+		}
+	}
+
+	if o.needed("upstream") && head != nil && head.IsBranch() {
+		if up, err := head.Branch().Upstream(); err != nil {
+			debugf("git2: no upstream: %v", err)
+		} else {
+			ahead, behind, err := repo.AheadBehind(head.Target(), up.Target())
+			up.Free()
+			if err != nil {
+				collectError(err)
+			} else if !v.expired("upstream") {
+				v.ahead, v.behind = ahead, behind
+			}
+		}
+	}
+
+	if o.needed("stash") {
+		repo.Stashes.Foreach(func(int, string, *git2.Oid) error {
+			v.stash++
+			return nil
+		})
+	}
+	v.operation = git2Operations[repo.State()]
+	return v
+}
+
+// git2Status returns the status flags of the files of repo which are not
+// current.
+func git2Status(repo *git2.Repository, opts *git2.StatusOptions) ([]git2.Status, error) {
+	list, err := repo.StatusList(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer list.Free()
+
+	n, err := list.EntryCount()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]git2.Status, 0, n)
+	for i := 0; i < n; i++ {
+		e, err := list.ByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e.Status)
+	}
+	return entries, nil
+}
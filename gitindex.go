@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dirty check compares the index with the work tree itself, as git diff
+// does, without running git: files whose size, modification time or mode
+// differ from the index are hashed and compared with the blob in the index.
+// The index is mapped into memory rather than read. Repositories which need
+// more of git, such as attributes which change the content of files, are left
+// to git diff. Sparse indexes are not expanded: the entries of the directories
+// outside of the sparse checkout stand for all of their files, which are not
+// in the work tree.
+
+// errNotNative is returned for repositories which the native checks do not
+// support.
+var errNotNative = errors.New("not supported natively")
+
+// index entry modes, without the permission bits.
+const (
+	modeType    = 0170000
+	modeTree    = 0040000 // directories of sparse indexes
+	modeFile    = 0100000
+	modeSymlink = 0120000
+	modeGitlink = 0160000
+)
+
+// index entry flags.
+const (
+	flagAssumeValid  = 0x8000
+	flagExtended     = 0x4000
+	flagSkipWorktree = 0x4000 // in the extended flags
+	flagIntentToAdd  = 0x2000 // in the extended flags
+)
+
+// indexEntry is an entry of the git index.
+type indexEntry struct {
+	name  string
+	mtime time.Time
+	mode  uint32
+	size  uint32 // truncated to 32 bits, as in the index
+	hash  []byte
+	stage int
+	flags uint16 // flags and extended flags which matter to the checks
+}
+
+// gitIndex is the content of .git/index.
+type gitIndex struct {
+	mtime   time.Time // the entries modified since are racy
+	entries []indexEntry
+
+	// split indexes name the shared index which holds most of their
+	// entries, and which of its entries they delete or replace.
+	shared   []byte
+	deleted  []byte // EWAH bitmaps of the entries of the shared index
+	replaced []byte
+
+	unmaps []func() error // of the mapped files which entries point into
+}
+
+// readEWAH returns the first n bits of the EWAH compressed bitmap data, as
+// written by git.
+func readEWAH(data []byte, n int) ([]bool, error) {
+	bad := errors.New("truncated bitmap")
+	if len(data) < 8 {
+		return nil, bad
+	}
+	count := int(binary.BigEndian.Uint32(data[4:]))
+	data = data[8:]
+	if len(data) < 8*count {
+		return nil, bad
+	}
+	word := func(i int) uint64 { return binary.BigEndian.Uint64(data[8*i:]) }
+
+	// the words are runs of identical words, each followed by literal
+	// words: the run bit is the lowest bit of the run word, followed by 32
+	// bits of run length and 31 bits of literal word count.
+	bits := make([]bool, n)
+	pos := 0
+	for i := 0; i < count && pos < n; {
+		rlw := word(i)
+		run := int(rlw >> 1 & 0xffffffff)
+		literals := int(rlw >> 33)
+		for k := pos; rlw&1 != 0 && k < n && k < pos+64*run; k++ {
+			bits[k] = true
+		}
+		pos += 64 * run
+		i++
+		if i+literals > count {
+			return nil, bad
+		}
+		for ; literals > 0; literals-- {
+			w := word(i)
+			for b := 0; b < 64 && pos+b < n; b++ {
+				bits[pos+b] = w&(1<<uint(b)) != 0
+			}
+			pos += 64
+			i++
+		}
+	}
+	return bits, nil
+}
+
+// ewahSize returns the size of the EWAH compressed bitmap at the start of
+// data, or -1 if it is truncated.
+func ewahSize(data []byte) int {
+	if len(data) < 8 {
+		return -1
+	}
+	n := 8 + 8*int(binary.BigEndian.Uint32(data[4:])) + 4
+	if n > len(data) {
+		return -1
+	}
+	return n
+}
+
+// readIndex reads the index at path, whose object names are hashSize bytes,
+// and the shared index of split indexes. The index is mapped into memory
+// until it is closed.
+func readIndex(path string, hashSize int) (*gitIndex, error) {
+	idx, err := mapIndex(path, hashSize)
+	if err != nil {
+		return nil, err
+	}
+	if idx.shared != nil {
+		sharedPath := filepath.Join(filepath.Dir(path), "sharedindex."+hex.EncodeToString(idx.shared))
+		base, err := mapIndex(sharedPath, hashSize)
+		if err == nil && base.shared != nil {
+			err = fmt.Errorf("%s: shared index is split: %w", sharedPath, errNotNative)
+		}
+		if err == nil {
+			idx.unmaps = append(idx.unmaps, base.unmaps...)
+			err = idx.merge(base)
+		}
+		if err != nil {
+			idx.close()
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// mapIndex maps the index file at path into memory and parses it.
+func mapIndex(path string, hashSize int) (*gitIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, unmap, err := mapFile(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	idx, err := parseIndex(data, fi.ModTime(), hashSize)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	idx.unmaps = append(idx.unmaps, unmap)
+	return idx, nil
+}
+
+// close unmaps the files of idx. Its entries must not be used after.
+func (idx *gitIndex) close() {
+	for _, unmap := range idx.unmaps {
+		if err := unmap(); err != nil {
+			debugf("git: %v", err)
+		}
+	}
+	idx.unmaps = nil
+}
+
+// merge merges the entries of the split index idx with those of the shared
+// index base, as git does: the first entries of idx replace the entries of
+// base in the replaced bitmap, those in the deleted one are left out, and the
+// other entries of idx are added.
+func (idx *gitIndex) merge(base *gitIndex) error {
+	n := len(base.entries)
+	deleted, err := readEWAHs(idx.deleted, n)
+	if err != nil {
+		return fmt.Errorf("split index: %v", err)
+	}
+	replaced, err := readEWAHs(idx.replaced, n)
+	if err != nil {
+		return fmt.Errorf("split index: %v", err)
+	}
+
+	var entries []indexEntry
+	next := 0
+	for i, e := range base.entries {
+		if replaced[i] {
+			if next >= len(idx.entries) {
+				return errors.New("split index: missing replacement")
+			}
+			r := idx.entries[next]
+			r.name = e.name
+			e = r
+			next++
+		}
+		if !deleted[i] {
+			entries = append(entries, e)
+		}
+	}
+
+	// the added entries are sorted, as those of base, and take the place
+	// of entries with the same name and stage.
+	added := idx.entries[next:]
+	merged := make([]indexEntry, 0, len(entries)+len(added))
+	for len(entries) > 0 || len(added) > 0 {
+		switch {
+		case len(added) == 0:
+			merged, entries = append(merged, entries...), nil
+		case len(entries) == 0:
+			merged, added = append(merged, added...), nil
+		case entryLess(entries[0], added[0]):
+			merged, entries = append(merged, entries[0]), entries[1:]
+		case entryLess(added[0], entries[0]):
+			merged, added = append(merged, added[0]), added[1:]
+		default:
+			merged, entries, added = append(merged, added[0]), entries[1:], added[1:]
+		}
+	}
+	idx.entries = merged
+	return nil
+}
+
+// entryLess reports whether a comes before b in the index.
+func entryLess(a, b indexEntry) bool {
+	if a.name != b.name {
+		return a.name < b.name
+	}
+	return a.stage < b.stage
+}
+
+// readEWAHs returns the first n bits of the EWAH compressed bitmap data, which
+// may be empty.
+func readEWAHs(data []byte, n int) ([]bool, error) {
+	if len(data) == 0 {
+		return make([]bool, n), nil
+	}
+	return readEWAH(data, n)
+}
+
+// parseIndex parses data, an index modified at mtime.
+func parseIndex(data []byte, mtime time.Time, hashSize int) (*gitIndex, error) {
+	bad := func(what string) error { return fmt.Errorf("bad index: %s", what) }
+
+	if len(data) < 12+hashSize || string(data[:4]) != "DIRC" {
+		return nil, bad("no header")
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("index version %d: %w", version, errNotNative)
+	}
+	n := int(binary.BigEndian.Uint32(data[8:12]))
+	end := len(data) - hashSize
+	// the index ends with the hash of the rest, as git checks, which tells
+	// truncated indexes from those without some extensions. It is all zeros
+	// with index.skipHash.
+	if sum := data[end:]; bytes.Count(sum, []byte{0}) != hashSize && !bytes.Equal(indexHash(data[:end], hashSize), sum) {
+		return nil, bad("checksum mismatch")
+	}
+	// entries take more than 40+hashSize+2 bytes, which bounds the count,
+	// so that a corrupt index cannot ask for more memory than it has.
+	if n > (end-12)/(40+hashSize+2) {
+		return nil, bad("too many entries")
+	}
+
+	idx := &gitIndex{mtime: mtime, entries: make([]indexEntry, 0, n)}
+	off := 12
+	var prev string
+	for i := 0; i < n; i++ {
+		start := off
+		if off+40+hashSize+2 > end {
+			return nil, bad("truncated entry")
+		}
+		field := func(k int) uint32 { return binary.BigEndian.Uint32(data[off+4*k:]) }
+		e := indexEntry{
+			mtime: time.Unix(int64(field(2)), int64(field(3))),
+			mode:  field(6),
+			size:  field(9),
+		}
+		off += 40
+		e.hash = data[off : off+hashSize]
+		off += hashSize
+		flags := binary.BigEndian.Uint16(data[off:])
+		off += 2
+		e.stage = int(flags>>12) & 3
+		e.flags = flags & flagAssumeValid
+		if version >= 3 && flags&flagExtended != 0 {
+			if off+2 > end {
+				return nil, bad("truncated entry")
+			}
+			e.flags |= binary.BigEndian.Uint16(data[off:]) & (flagSkipWorktree | flagIntentToAdd)
+			off += 2
+		}
+
+		if version == 4 {
+			// the name is the previous one without its last strip bytes,
+			// followed by a NUL terminated suffix.
+			strip, k := binary.Uvarint(data[off:end])
+			if k <= 0 || int(strip) > len(prev) {
+				return nil, bad("bad name prefix")
+			}
+			off += k
+			nul := bytes.IndexByte(data[off:end], 0)
+			if nul < 0 {
+				return nil, bad("unterminated name")
+			}
+			e.name = prev[:len(prev)-int(strip)] + string(data[off:off+nul])
+			off += nul + 1
+		} else {
+			nul := bytes.IndexByte(data[off:end], 0)
+			if nul < 0 {
+				return nil, bad("unterminated name")
+			}
+			e.name = string(data[off : off+nul])
+			// entries are padded with NULs to a multiple of 8 bytes.
+			off = start + (off+nul-start+8)&^7
+		}
+		prev = e.name
+		idx.entries = append(idx.entries, e)
+	}
+
+	for off+8 <= end {
+		sig, size := string(data[off:off+4]), int(binary.BigEndian.Uint32(data[off+4:]))
+		if off+8+size > end {
+			return nil, bad("truncated extension")
+		}
+		switch sig {
+		case "link":
+			if err := idx.readLink(data[off+8:off+8+size], hashSize); err != nil {
+				return nil, bad(err.Error())
+			}
+		case "FSMN", "UNTR":
+			// the file system monitor and the untracked cache, which
+			// the native checks do without.
+		case "sdir":
+			// the index is sparse, which its directory entries tell.
+		}
+		off += 8 + size
+	}
+	// the extensions end at the checksum, unless the index is truncated.
+	if off != end {
+		return nil, bad("truncated extension")
+	}
+	return idx, nil
+}
+
+// indexHash returns the hash of data with the hash function whose hashes are
+// hashSize bytes.
+func indexHash(data []byte, hashSize int) []byte {
+	h := sha1.New()
+	if hashSize == sha256.Size {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// readLink reads the link index extension data of split indexes into idx.
+func (idx *gitIndex) readLink(data []byte, hashSize int) error {
+	if len(data) < hashSize {
+		return errors.New("truncated link extension")
+	}
+	if bytes.Count(data[:hashSize], []byte{0}) == hashSize {
+		// the index is not split.
+		return nil
+	}
+	idx.shared, data = data[:hashSize], data[hashSize:]
+	if len(data) == 0 {
+		return nil
+	}
+	n := ewahSize(data)
+	if n < 0 || ewahSize(data[n:]) != len(data)-n {
+		return errors.New("bad link extension bitmaps")
+	}
+	idx.deleted, idx.replaced = data[:n], data[n:]
+	return nil
+}
+
+// readGitConfig reads the git config file at path, as a map from lowercase
+// "section.key" or "section.subsection.key" names to values. Keys without a
+// value are "true". Includes are not followed.
+func readGitConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGitConfig(f)
+}
+
+// parseGitConfig parses the git config file read from r, as readGitConfig.
+func parseGitConfig(r io.Reader) (map[string]string, error) {
+	cfg := map[string]string{}
+	var section string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			line = strings.Trim(line, "[]")
+			name := line
+			sub := ""
+			if i := strings.IndexByte(line, ' '); i >= 0 {
+				name, sub = line[:i], strings.Trim(strings.TrimSpace(line[i:]), `"`)
+			}
+			section = strings.ToLower(name)
+			if sub != "" {
+				section += "." + sub
+			}
+			continue
+		}
+
+		key, value := line, "true"
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+			if i := strings.IndexAny(value, "#;"); i >= 0 && !strings.HasPrefix(value, `"`) {
+				value = strings.TrimSpace(value[:i])
+			}
+			value = strings.Trim(value, `"`)
+		}
+		cfg[section+"."+strings.ToLower(key)] = value
+	}
+	return cfg, scanner.Err()
+}
+
+// readGitConfigs reads the system and global git config files, the config
+// file of the repository at root and the settings of $GIT_CONFIG_COUNT, each
+// taking precedence over the ones before, as git does. Includes are not
+// followed: see readNativeConfig.
+func readGitConfigs(root string) (map[string]string, error) {
+	cfg := map[string]string{}
+	for _, path := range gitConfigPaths() {
+		c, err := readGitConfig(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range c {
+			cfg[k] = v
+		}
+	}
+	c, err := readRepoConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c {
+		cfg[k] = v
+	}
+
+	// the settings of "git -c", which set $GIT_CONFIG_PARAMETERS for hooks
+	// and aliases, are left to readNativeConfig.
+	if count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT")); count > 0 {
+		for i := 0; i < count; i++ {
+			n := strconv.Itoa(i)
+			if key := os.Getenv("GIT_CONFIG_KEY_" + n); key != "" {
+				cfg[gitConfigKey(key)] = os.Getenv("GIT_CONFIG_VALUE_" + n)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// gitConfigKey returns key, as given on the command line, with its section
+// and its name in lowercase, as parseGitConfig names keys.
+func gitConfigKey(key string) string {
+	first, last := strings.IndexByte(key, '.'), strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+// gitConfigPaths returns the paths of the system and global git config files,
+// in the order git reads them: $GIT_CONFIG_SYSTEM, or the system file unless
+// $GIT_CONFIG_NOSYSTEM is set, then $GIT_CONFIG_GLOBAL, or the XDG file and
+// ~/.gitconfig.
+func gitConfigPaths() []string {
+	var paths []string
+	if !gitBool(os.Getenv("GIT_CONFIG_NOSYSTEM")) {
+		if path, ok := os.LookupEnv("GIT_CONFIG_SYSTEM"); ok {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		} else {
+			paths = append(paths, systemGitConfigs()...)
+		}
+	}
+
+	if path, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+		if path != "" {
+			paths = append(paths, path)
+		}
+		return paths
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "git", "config"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if os.Getenv("XDG_CONFIG_HOME") == "" {
+			paths = append(paths, filepath.Join(home, ".config", "git", "config"))
+		}
+		paths = append(paths, filepath.Join(home, ".gitconfig"))
+	}
+	return paths
+}
+
+// systemConfigs caches systemGitConfigs.
+var systemConfigs struct {
+	once  sync.Once
+	paths []string
+}
+
+// systemGitConfigs returns the paths where the system git config may be,
+// which depend on where git is installed: /etc/gitconfig for the git of
+// /usr, and etc/gitconfig under the prefix of git otherwise, such as
+// /opt/homebrew, or C:\Program Files\Git for Git for Windows, whose git is
+// in cmd, bin or mingw64\bin, and which reads %PROGRAMDATA%\Git\config first.
+func systemGitConfigs() []string {
+	systemConfigs.once.Do(func() {
+		var paths []string
+		if runtime.GOOS == "windows" {
+			if dir := os.Getenv("PROGRAMDATA"); dir != "" {
+				paths = append(paths, filepath.Join(dir, "Git", "config"))
+			}
+		} else {
+			paths = append(paths, "/etc/gitconfig")
+		}
+		if bin, err := exec.LookPath("git"); err == nil {
+			prefix := filepath.Dir(filepath.Dir(bin))
+			if strings.EqualFold(filepath.Base(prefix), "mingw64") {
+				prefix = filepath.Dir(prefix)
+			}
+			if prefix != "/usr" && prefix != "/" {
+				paths = append(paths, filepath.Join(prefix, "etc", "gitconfig"))
+			}
+		}
+		systemConfigs.paths = paths
+	})
+	return systemConfigs.paths
+}
+
+// readNativeConfig is readGitConfigs for the native checks, which return
+// errNotNative for configs they cannot read as git does: those which include
+// other files, with include.path or includeIf, and the settings of "git -c".
+func readNativeConfig(root string) (map[string]string, error) {
+	if os.Getenv("GIT_CONFIG_PARAMETERS") != "" {
+		return nil, fmt.Errorf("git -c settings: %w", errNotNative)
+	}
+	cfg, err := readGitConfigs(root)
+	if err != nil {
+		return nil, err
+	}
+	for key := range cfg {
+		if key == "include.path" || strings.HasPrefix(key, "includeif.") && strings.HasSuffix(key, ".path") {
+			return nil, fmt.Errorf("config includes: %w", errNotNative)
+		}
+	}
+	return cfg, nil
+}
+
+// gitBool reports whether the git config value s is true.
+func gitBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
+// nativeRepo is what the native checks need to know about a repository.
+type nativeRepo struct {
+	root     string
+	fileMode bool // core.fileMode: whether the executable bit matters
+	newHash  func() hash.Hash
+	hashSize int
+}
+
+// openNative returns the repository at root for the native checks, or
+// errNotNative if it needs git.
+func openNative(root string) (*nativeRepo, error) {
+	cfg, err := readNativeConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	if v := cfg["core.autocrlf"]; v != "" && v != "false" {
+		return nil, fmt.Errorf("core.autocrlf: %w", errNotNative)
+	}
+	if _, ok := cfg["core.attributesfile"]; ok {
+		return nil, fmt.Errorf("core.attributesFile: %w", errNotNative)
+	}
+	for _, path := range []string{filepath.Join(root, ".gitattributes"), filepath.Join(root, ".git", "info", "attributes")} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s: %w", path, errNotNative)
+		}
+	}
+
+	r := &nativeRepo{root: root, fileMode: true, newHash: sha1.New, hashSize: sha1.Size}
+	if v, ok := cfg["core.filemode"]; ok {
+		r.fileMode = gitBool(v)
+	}
+	if hook, daemon := fsmonitorConfig(cfg); hook != "" || daemon {
+		// git diff asks the monitor, and runs hooks only where it trusts
+		// the config of the repository.
+		return nil, fmt.Errorf("fsmonitor: %w", errNotNative)
+	}
+	switch cfg["extensions.objectformat"] {
+	case "", "sha1":
+	case "sha256":
+		r.newHash, r.hashSize = sha256.New, sha256.Size
+	default:
+		return nil, fmt.Errorf("object format %s: %w", cfg["extensions.objectformat"], errNotNative)
+	}
+	return r, nil
+}
+
+// nativeModified reports whether files of the work tree at root differ from
+// the index, like "git diff --quiet". It returns errNotNative if git diff has
+// to be run instead.
+func nativeModified(root string) (bool, error) {
+	r, err := openNative(root)
+	if err != nil {
+		return false, err
+	}
+	idx, err := readIndex(filepath.Join(root, ".git", "index"), r.hashSize)
+	if os.IsNotExist(err) {
+		// nothing is tracked yet.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer idx.close()
+
+	for i := range idx.entries {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		e := &idx.entries[i]
+		changed, err := r.changed(e, idx.mtime)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			debugf("git: %s is modified", e.name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nativeConflicts reports whether the index of the repository at root has
+// unmerged entries, like "git ls-files --unmerged", for where git cannot run.
+func nativeConflicts(root string) (bool, error) {
+	hashSize := sha1.Size
+	if cfg, err := readRepoConfig(root); err == nil && cfg["extensions.objectformat"] == "sha256" {
+		hashSize = sha256.Size
+	}
+	idx, err := readIndex(filepath.Join(root, ".git", "index"), hashSize)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer idx.close()
+	for _, e := range idx.entries {
+		if e.stage != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// changed reports whether the work tree file of e differs from it, in an index
+// written at indexTime.
+func (r *nativeRepo) changed(e *indexEntry, indexTime time.Time) (bool, error) {
+	switch {
+	case e.flags&(flagAssumeValid|flagSkipWorktree) != 0, e.mode&modeType == modeGitlink, e.mode&modeType == modeTree:
+		return false, nil
+	case e.stage != 0, e.flags&flagIntentToAdd != 0:
+		// unmerged and intent-to-add entries are always shown by git diff.
+		return true, nil
+	}
+
+	path := filepath.Join(r.root, filepath.FromSlash(e.name))
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return true, nil
+	}
+
+	var mode uint32
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		mode = modeSymlink
+	case fi.Mode().IsRegular():
+		mode = modeFile
+	default:
+		return true, nil
+	}
+	if mode != e.mode&modeType {
+		return true, nil
+	}
+	if mode == modeFile && r.fileMode && (fi.Mode()&0100 != 0) != (e.mode&0100 != 0) {
+		return true, nil
+	}
+	if uint32(fi.Size()) != e.size {
+		return true, nil
+	}
+
+	// a file written in the same second as the index may have changed
+	// without changing its modification time, so it is hashed too.
+	mtime := fi.ModTime()
+	if e.mtime.Nanosecond() == 0 {
+		mtime = mtime.Truncate(time.Second)
+	}
+	if mtime.Equal(e.mtime) && e.mtime.Before(indexTime.Truncate(time.Second)) {
+		return false, nil
+	}
+
+	sum, err := r.hashFile(path, mode, fi.Size())
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(sum, e.hash), nil
+}
+
+// hashFile returns the object name of the blob of the file or symlink at path.
+func (r *nativeRepo) hashFile(path string, mode uint32, size int64) ([]byte, error) {
+	h := r.newHash()
+	if mode == modeSymlink {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "blob %d\x00%s", len(target), target)
+		return h.Sum(nil), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h.Write([]byte("blob " + strconv.FormatInt(size, 10) + "\x00"))
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRepo returns a new git repository, with git isolated from the configs
+// of the user and the system.
+func testRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil || !canExec {
+		t.Skip("no git")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, name := range []string{"GIT_CONFIG_SYSTEM", "GIT_CONFIG_GLOBAL", "GIT_CONFIG_COUNT", "GIT_CONFIG_PARAMETERS", "GIT_DIR", "GIT_INDEX_FILE"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "main")
+	runGit(t, dir, "config", "user.name", "test")
+	runGit(t, dir, "config", "user.email", "test@example.com")
+	return dir
+}
+
+// runGit runs git in dir, and returns its output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// writeFiles writes the files, by path relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseGitConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"key", "[core]\n\tautocrlf = true\n", map[string]string{"core.autocrlf": "true"}},
+		{"case", "[Core]\n\tFileMode = false\n", map[string]string{"core.filemode": "false"}},
+		{"no value", "[core]\n\tbare\n", map[string]string{"core.bare": "true"}},
+		{"comments", "# a\n; b\n[core]\n\tautocrlf = input # c\n\teol = lf ; d\n", map[string]string{"core.autocrlf": "input", "core.eol": "lf"}},
+		{"quoted", "[core]\n\texcludesFile = \"~/my ignore\"\n", map[string]string{"core.excludesfile": "~/my ignore"}},
+		{"subsection", "[remote \"Origin\"]\n\turl = git@example.com:a/b\n\tfetch = +refs/heads/*:refs/remotes/Origin/*\n", map[string]string{
+			"remote.Origin.url":   "git@example.com:a/b",
+			"remote.Origin.fetch": "+refs/heads/*:refs/remotes/Origin/*",
+		}},
+		{"branch", "[branch \"feature/x\"]\n\tremote = origin\n\tmerge = refs/heads/feature/x\n", map[string]string{
+			"branch.feature/x.remote": "origin",
+			"branch.feature/x.merge":  "refs/heads/feature/x",
+		}},
+		{"include", "[include]\n\tpath = ~/.gitconfig.local\n", map[string]string{"include.path": "~/.gitconfig.local"}},
+		{"includeIf", "[includeIf \"gitdir:~/work/\"]\n\tpath = ~/.gitconfig.work\n", map[string]string{"includeif.gitdir:~/work/.path": "~/.gitconfig.work"}},
+		{"last wins", "[core]\n\tautocrlf = true\n[core]\n\tautocrlf = false\n", map[string]string{"core.autocrlf": "false"}},
+	}
+	for _, tt := range tests {
+		got, err := parseGitConfig(strings.NewReader(tt.config))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadNativeConfig(t *testing.T) {
+	dir := testRepo(t)
+	files := t.TempDir()
+	system := filepath.Join(files, "system")
+	global := filepath.Join(files, "global")
+	writeFiles(t, files, map[string]string{
+		"system":  "[core]\n\tautocrlf = true\n\tfileMode = false\n",
+		"global":  "[core]\n\tautocrlf = false\n",
+		"include": "[includeIf \"gitdir:/\"]\n\tpath = other\n",
+	})
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		autocrlf  string
+		notNative bool
+	}{
+		{"none", nil, "", false},
+		{"system", map[string]string{"GIT_CONFIG_NOSYSTEM": "", "GIT_CONFIG_SYSTEM": system}, "true", false},
+		{"nosystem", map[string]string{"GIT_CONFIG_NOSYSTEM": "1", "GIT_CONFIG_SYSTEM": system}, "", false},
+		{"global", map[string]string{"GIT_CONFIG_GLOBAL": system}, "true", false},
+		{"global over system", map[string]string{"GIT_CONFIG_NOSYSTEM": "", "GIT_CONFIG_SYSTEM": system, "GIT_CONFIG_GLOBAL": global}, "false", false},
+		{"count", map[string]string{"GIT_CONFIG_COUNT": "1", "GIT_CONFIG_KEY_0": "Core.AutoCRLF", "GIT_CONFIG_VALUE_0": "input"}, "input", false},
+		{"includeIf", map[string]string{"GIT_CONFIG_GLOBAL": filepath.Join(files, "include")}, "", true},
+		{"parameters", map[string]string{"GIT_CONFIG_PARAMETERS": "'core.autocrlf'='true'"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := readNativeConfig(dir)
+			if tt.notNative {
+				if !errors.Is(err, errNotNative) {
+					t.Errorf("err = %v, want errNotNative", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg["core.autocrlf"] != tt.autocrlf {
+				t.Errorf("core.autocrlf = %q, want %q", cfg["core.autocrlf"], tt.autocrlf)
+			}
+		})
+	}
+
+	// the dirty check leaves system-wide core.autocrlf to git.
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "")
+	t.Setenv("GIT_CONFIG_SYSTEM", system)
+	if _, err := openNative(dir); !errors.Is(err, errNotNative) {
+		t.Errorf("openNative with system core.autocrlf: %v, want errNotNative", err)
+	}
+}
+
+// lsFiles returns the entries of the index of the repository at dir, as git
+// ls-files --stage prints them.
+func lsFiles(t *testing.T, dir string) string {
+	return runGit(t, dir, "-c", "core.quotePath=false", "ls-files", "--stage")
+}
+
+// indexString returns the entries of idx as git ls-files --stage prints them.
+func indexString(idx *gitIndex) string {
+	var b strings.Builder
+	for _, e := range idx.entries {
+		fmt.Fprintf(&b, "%06o %s %d\t%s\n", e.mode, hex.EncodeToString(e.hash), e.stage, e.name)
+	}
+	return b.String()
+}
+
+func TestParseIndex(t *testing.T) {
+	files := map[string]string{
+		"a":                     "a\n",
+		"b/c":                   "c\n",
+		"b/d/e":                 "e\n",
+		"b/d/longer-file-name":  "f\n",
+		"日本語/ファイル":              "g\n",
+		"z/with space/and.dots": "h\n",
+	}
+	for _, version := range []string{"2", "3", "4"} {
+		t.Run("v"+version, func(t *testing.T) {
+			dir := testRepo(t)
+			writeFiles(t, dir, files)
+			runGit(t, dir, "add", ".")
+			runGit(t, dir, "update-index", "--index-version", version)
+			if version == "3" {
+				// the extended flags of intent-to-add entries.
+				writeFiles(t, dir, map[string]string{"new": "new\n"})
+				runGit(t, dir, "add", "-N", "new")
+			}
+
+			path := filepath.Join(dir, ".git", "index")
+			idx, err := readIndex(path, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idx.close()
+			if got, want := indexString(idx), lsFiles(t, dir); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+			for _, e := range idx.entries {
+				if (e.name == "new") != (e.flags&flagIntentToAdd != 0) {
+					t.Errorf("entry %s has flags %#x", e.name, e.flags)
+				}
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCorrupt(t, data)
+		})
+	}
+}
+
+// rehash returns data with its checksum updated, so that changes to it get
+// past the check of the checksum.
+func rehash(data []byte) []byte {
+	end := len(data) - 20
+	return append(data[:end:end], indexHash(data[:end], 20)...)
+}
+
+// checkCorrupt checks that parseIndex fails on each truncation of the index
+// data, and returns without panicking after each byte of it is changed.
+func checkCorrupt(t *testing.T, data []byte) {
+	t.Helper()
+	for n := 0; n < len(data); n++ {
+		if _, err := parseIndex(data[:n], time.Time{}, 20); err == nil {
+			t.Errorf("no error for the index truncated to %d of %d bytes", n, len(data))
+		}
+		// with a checksum, as if git wrote it so.
+		if n >= 20 {
+			parseIndex(rehash(append([]byte(nil), data[:n]...)), time.Time{}, 20)
+		}
+	}
+	corrupt := make([]byte, len(data))
+	for i := 0; i < len(data)-20; i++ {
+		for _, b := range []byte{0, 0xff, data[i] ^ 0x80} {
+			copy(corrupt, data)
+			corrupt[i] = b
+			if _, err := parseIndex(corrupt, time.Time{}, 20); err == nil && b != data[i] {
+				t.Errorf("no error for the checksum of byte %d changed to %#x", i, b)
+			}
+			parseIndex(rehash(corrupt), time.Time{}, 20)
+		}
+	}
+
+	if _, err := parseIndex(rehash(append([]byte("DIRX"), data[4:]...)), time.Time{}, 20); err == nil {
+		t.Error("no error for a bad signature")
+	}
+	future := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(future[4:], 5)
+	if _, err := parseIndex(rehash(future), time.Time{}, 20); !errors.Is(err, errNotNative) {
+		t.Errorf("index version 5: %v, want errNotNative", err)
+	}
+	huge := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(huge[8:], 0xffffffff)
+	if _, err := parseIndex(rehash(huge), time.Time{}, 20); err == nil {
+		t.Error("no error for 2³²-1 entries")
+	}
+	skip := append([]byte(nil), data...)
+	copy(skip[len(skip)-20:], make([]byte, 20))
+	if _, err := parseIndex(skip, time.Time{}, 20); err != nil {
+		t.Errorf("index.skipHash: %v", err)
+	}
+}
+
+func TestParseSplitIndex(t *testing.T) {
+	dir := testRepo(t)
+	runGit(t, dir, "config", "splitIndex.maxPercentChange", "100")
+	writeFiles(t, dir, map[string]string{"a": "a\n", "b": "b\n", "c": "c\n", "e": "e\n"})
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "update-index", "--split-index")
+	// b is replaced, c deleted and d added in the split index.
+	writeFiles(t, dir, map[string]string{"b": "b2\n", "d": "d\n"})
+	os.Remove(filepath.Join(dir, "c"))
+	runGit(t, dir, "add", "-A")
+
+	path := filepath.Join(dir, ".git", "index")
+	idx, err := mapIndex(path, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.close()
+	if idx.shared == nil || idx.deleted == nil || idx.replaced == nil {
+		t.Fatalf("the index is not split: shared %x", idx.shared)
+	}
+
+	idx, err = readIndex(path, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+	if got, want := indexString(idx), lsFiles(t, dir); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCorrupt(t, data)
+}
+
+// ewah returns an EWAH bitmap of size bits with the given words, as git writes
+// it.
+func ewah(size int, words ...uint64) []byte {
+	data := make([]byte, 8+8*len(words)+4)
+	binary.BigEndian.PutUint32(data, uint32(size))
+	binary.BigEndian.PutUint32(data[4:], uint32(len(words)))
+	for i, w := range words {
+		binary.BigEndian.PutUint64(data[8+8*i:], w)
+	}
+	return data
+}
+
+// rlw returns a run length word of run words of the run bit, followed by
+// literals literal words.
+func rlw(bit bool, run, literals uint64) uint64 {
+	w := run<<1 | literals<<33
+	if bit {
+		w |= 1
+	}
+	return w
+}
+
+func TestReadEWAH(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		n    int
+		want []int // the bits which are set
+	}{
+		{"empty", ewah(0), 10, nil},
+		{"literal", ewah(64, rlw(false, 0, 1), 1<<1|1<<3), 64, []int{1, 3}},
+		{"two literals", ewah(128, rlw(false, 0, 2), 1, 1<<6), 128, []int{0, 70}},
+		{"run of ones", ewah(128, rlw(true, 1, 0)), 70, seq(0, 64)},
+		{"run of zeros", ewah(128, rlw(false, 1, 1), 1<<63), 128, []int{127}},
+		{"run and literal", ewah(192, rlw(true, 1, 1), 1<<2, rlw(false, 0, 1), 1), 192, append(seq(0, 64), 66, 128)},
+		{"cut at n", ewah(128, rlw(true, 2, 0)), 3, []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		bits, err := readEWAH(tt.data, tt.n)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(bits) != tt.n {
+			t.Errorf("%s: got %d bits, want %d", tt.name, len(bits), tt.n)
+		}
+		var got []int
+		for i, b := range bits {
+			if b {
+				got = append(got, i)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got bits %v, want %v", tt.name, got, tt.want)
+		}
+		if size := ewahSize(tt.data); size != len(tt.data) {
+			t.Errorf("%s: ewahSize = %d, want %d", tt.name, size, len(tt.data))
+		}
+	}
+
+	bad := map[string][]byte{
+		"short":            {0, 0, 0, 1},
+		"missing words":    ewah(64, rlw(false, 0, 1), 1)[:12],
+		"missing literals": ewah(64, rlw(false, 0, 3), 1),
+		"huge count":       append(ewah(64)[:4], 0xff, 0xff, 0xff, 0xff),
+	}
+	for name, data := range bad {
+		if _, err := readEWAH(data, 64); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if size := ewahSize(ewah(64, 1, 2)[:20]); size != -1 {
+		t.Errorf("ewahSize of a truncated bitmap = %d, want -1", size)
+	}
+}
+
+// seq returns the integers from start to end, excluding end.
+func seq(start, end int) []int {
+	var s []int
+	for i := start; i < end; i++ {
+		s = append(s, i)
+	}
+	return s
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// "vcprompt gitstatusd" speaks the protocol of gitstatusd, the daemon of
+// romkatv/gitstatus, on stdin and stdout, so that powerlevel10k and the other
+// zsh themes built on it can use vcprompt instead, and the vcprompt daemon
+// with -daemon. Run as gitstatusd, e.g. through a symlink, vcprompt speaks it
+// too, and ignores the flags of gitstatusd.
+//
+// Requests and responses are records ending with gitstatusdRecord, made of
+// fields separated by gitstatusdField. A request holds an id, the directory,
+// and "1" if the index is not to be read. The response holds the id, "1" if
+// the directory is in a repository, and the state of the repository. vcprompt
+// does not count files: the staged count is always 0, and the others are 1
+// when there are some, or -1 when they are unknown.
+
+const (
+	gitstatusdField  = "\x1f"
+	gitstatusdRecord = '\x1e'
+)
+
+// gitstatusdFormat is a format which needs all of the checks.
+const gitstatusdFormat = "%b%r%m%u%c%p%P%s"
+
+// isGitstatusd reports whether vcprompt runs as gitstatusd.
+func isGitstatusd() bool {
+	return strings.HasPrefix(filepath.Base(os.Args[0]), "gitstatusd")
+}
+
+// runGitstatusd runs "vcprompt gitstatusd". The flags of gitstatusd, which
+// its clients pass, are ignored.
+func runGitstatusd(args []string) int {
+	if err := configure(""); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	// all of the checks are needed.
+	*format = gitstatusdFormat
+	noDirty0, noUntrack0 := *noDirty, *noUntrack
+
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	for {
+		req, err := in.ReadString(gitstatusdRecord)
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			return 1
+		}
+		fields := strings.Split(strings.TrimSuffix(req, string(gitstatusdRecord)), gitstatusdField)
+		for len(fields) < 3 {
+			fields = append(fields, "")
+		}
+		*noDirty, *noUntrack = noDirty0, noUntrack0
+		if fields[2] == "1" {
+			*noDirty, *noUntrack = true, true
+		}
+
+		out.WriteString(gitstatusdResponse(fields[0], fields[1]))
+		out.WriteByte(gitstatusdRecord)
+		if err := out.Flush(); err != nil {
+			debugf("gitstatusd: %v", err)
+			return 1
+		}
+	}
+}
+
+// gitstatusdResponse returns the response to the request id about dir. A dir
+// starting with ":" is a git directory.
+func gitstatusdResponse(id, dir string) string {
+	none := gitstatusdClean(id) + gitstatusdField + "0"
+	if strings.HasPrefix(dir, ":") {
+		dir = filepath.Dir(dir[1:])
+	}
+	if dir == "" || !filepath.IsAbs(dir) {
+		return none
+	}
+	if excluded, err := isExcluded(dir); err != nil || excluded {
+		return none
+	}
+	v := collect(dir)
+	if !v.available {
+		return none
+	}
+
+	root, _ := probeWithin(dir)
+	if root == "" {
+		root = dir
+	}
+	commit := v.revision
+	var upstream, remote, url string
+	if v.name == "git" {
+		commit, upstream, remote, url = gitstatusdRefs(root, v)
+	}
+
+	// has returns the count of the files of the check name, as far as
+	// vcprompt knows it.
+	has := func(name string, set bool) string {
+		off := checkFlags[name]
+		switch {
+		case v.timedOut[name] || v.skipped[name] || v.pending[name] || off != nil && *off:
+			return "-1"
+		case set:
+			return "1"
+		}
+		return "0"
+	}
+	num := strconv.Itoa
+	fields := []string{
+		gitstatusdClean(id),
+		"1",
+		gitstatusdClean(root),
+		commit,
+		gitstatusdClean(v.branch),
+		gitstatusdClean(upstream),
+		gitstatusdClean(remote),
+		gitstatusdClean(url),
+		v.operation,
+		"0",                        // files in the index
+		"0",                        // staged changes
+		has("dirty", v.isModified), // unstaged changes
+		has("conflict", v.conflict),
+		has("untracked", v.untracked),
+		num(v.ahead),
+		num(v.behind),
+		num(v.stash),
+		"",  // tag
+		"0", // unstaged deletions
+		"0", // staged new files
+		"0", // staged deletions
+		gitstatusdClean(remote),
+		gitstatusdClean(url),
+		"0", // commits behind the push remote
+		"0", // commits ahead of the push remote
+		"0", // files with skip-worktree
+		"0", // files with assume-unchanged
+		"",  // encoding of the commit message
+		"",  // summary of the commit message
+	}
+	return strings.Join(fields, gitstatusdField)
+}
+
+// gitstatusdRefs returns the commit of HEAD in the repository at root, in
+// hexadecimal, and the upstream branch of the branch of v, its remote and the
+// URL of the remote.
+func gitstatusdRefs(root string, v vcs) (commit, upstream, remote, url string) {
+	cfg, err := readGitConfigs(root)
+	if err != nil {
+		debugf("gitstatusd: %v", err)
+		return v.revision, "", "", ""
+	}
+	hashSize := sha1.Size
+	if cfg["extensions.objectformat"] == "sha256" {
+		hashSize = sha256.Size
+	}
+	if oid, err := resolveRef(filepath.Join(root, ".git"), "HEAD", hashSize); err == nil {
+		commit = hex.EncodeToString([]byte(oid))
+	}
+	if v.branch == "" {
+		return commit, "", "", ""
+	}
+	remote = cfg["branch."+v.branch+".remote"]
+	upstream = strings.TrimPrefix(cfg["branch."+v.branch+".merge"], "refs/heads/")
+	return commit, upstream, remote, cfg["remote."+remote+".url"]
+}
+
+// gitstatusdClean makes s printable, which also replaces the separators of
+// the protocol.
+func gitstatusdClean(s string) string {
+	return printable(s)
+}
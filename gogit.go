@@ -0,0 +1,190 @@
+//go:build gogit
+
+package main
+
+// The gogit backend collects the state of git repositories with go-git, so
+// that vcprompt works without the git binary. It is built with
+//
+//	go get github.com/go-git/go-git/v5
+//	go build -tags gogit
+//
+// and selected with -backends=gogit.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func init() {
+	backendFuncs["gogit"] = gogitInfo
+}
+
+// gogitInfo is gitInfo with go-git.
+func gogitInfo(dir string, o collectOptions) vcs {
+	v := vcs{name: "git", available: true}
+
+	repo, err := gogit.PlainOpenWithOptions(dir, &gogit.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		debugf("gogit: %v", err)
+		v.available = false
+		return v
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		debugf("gogit: %v", err)
+		v.available = false
+		return v
+	}
+	root := wt.Filesystem.Root()
+	debugf("gogit: repository at %s", root)
+	v.root = root
+
+	head, err := repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// no commit yet: HEAD names the unborn branch.
+		if ref, err := repo.Storer.Reference(plumbing.HEAD); err == nil {
+			v.branch = ref.Target().Short()
+		}
+	} else if err != nil {
+		collectError(err)
+		return v
+	} else if head.Name().IsBranch() {
+		v.branch = head.Name().Short()
+	} else {
+		v.revision = head.Hash().String()
+	}
+
+	// the status has the dirty and untracked checks at once.
+	dirty, untracked := o.needed("dirty"), o.needed("untracked")
+	if dirty || untracked {
+		done := timed("gogit: status")
+		status, err := wt.Status()
+		done()
+		dirty = dirty && !v.expired("dirty")
+		untracked = untracked && !v.expired("untracked")
+		if err != nil {
+			collectError(err)
+		}
+		for _, fs := range status {
+			switch {
+			case fs.Worktree == gogit.Untracked:
+				v.untracked = v.untracked || untracked
+			case fs.Worktree != gogit.Unmodified:
+				v.isModified = v.isModified || dirty
+			}
+		}
+	}
+
+	// go-git does not report unmerged files in the status.
+	if !o.needed("conflict") {
+	} else if idx, err := repo.Storer.Index(); err != nil {
+		collectError(err)
+	} else {
+		for _, e := range idx.Entries {
+			if e.Stage != index.Merged {
+				v.conflict = true
+				break
+			}
+		}
+	}
+
+	if o.needed("upstream") && head != nil && head.Name().IsBranch() {
+		if ahead, behind, err := gogitAheadBehind(repo, head); err != nil {
+			debugf("gogit: no upstream: %v", err)
+		} else if !v.expired("upstream") {
+			v.ahead, v.behind = ahead, behind
+		}
+	}
+
+	// go-git does not know about stashes and operations in progress, which
+	// only need files of the git directory.
+	if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+		if o.needed("stash") {
+			v.stash = stashCount(root)
+		}
+		v.operation = gitOperation(root)
+	}
+	return v
+}
+
+// gogitAheadBehind counts the commits of the branch head and of its upstream
+// which the other does not have.
+func gogitAheadBehind(repo *gogit.Repository, head *plumbing.Reference) (int, int, error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return 0, 0, err
+	}
+	branch, ok := cfg.Branches[head.Name().Short()]
+	if !ok || branch.Remote == "" || branch.Merge == "" {
+		return 0, 0, errors.New("no upstream")
+	}
+	upName := plumbing.NewRemoteReferenceName(branch.Remote, branch.Merge.Short())
+	if branch.Remote == "." {
+		upName = branch.Merge
+	}
+	up, err := repo.Reference(upName, true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return 0, 0, err
+	}
+	upstream, err := repo.CommitObject(up.Hash())
+	if err != nil {
+		return 0, 0, err
+	}
+	bases, err := local.MergeBase(upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ahead, err := countUntil(local, bases)
+	if err != nil {
+		return 0, 0, err
+	}
+	behind, err := countUntil(upstream, bases)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ahead, behind, nil
+}
+
+// countUntil counts the commits reachable from c without going through the
+// commits bases.
+func countUntil(c *object.Commit, bases []*object.Commit) (int, error) {
+	seen := map[plumbing.Hash]bool{}
+	for _, b := range bases {
+		seen[b.Hash] = true
+	}
+
+	n := 0
+	queue := []*object.Commit{c}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		n++
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		err := c.Parents().ForEach(func(p *object.Commit) error {
+			queue = append(queue, p)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
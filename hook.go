@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// "vcprompt hook install" adds a block to the git hooks which run after the
+// state of a repository changes, which refreshes the cache in the background,
+// so that the first prompt after a commit or checkout finds it warm.
+
+// gitHooks are the hooks the block is added to.
+var gitHooks = []string{"post-commit", "post-checkout", "post-merge"}
+
+// hookStart and hookEnd delimit the block in hooks.
+const (
+	hookStart = "# vcprompt: refresh the prompt cache, added by vcprompt hook install"
+	hookEnd   = "# vcprompt end"
+)
+
+// hookBlock is the block added to hooks. It runs vcprompt in the background,
+// so that git does not wait for it, without the variables git sets for hooks,
+// which would change what the commands vcprompt runs see.
+const hookBlock = hookStart + `
+if command -v vcprompt >/dev/null 2>&1; then
+	(unset GIT_DIR GIT_INDEX_FILE GIT_WORK_TREE; vcprompt -cache -o porcelain >/dev/null 2>&1 &)
+fi
+` + hookEnd + "\n"
+
+// shellShebang matches the first line of hooks which are shell scripts.
+var shellShebang = regexp.MustCompile(`^#!.*\b(ba|da|k|z)?sh\b`)
+
+// runHook runs "vcprompt hook <install|uninstall> [-print] [path]".
+func runHook(args []string) int {
+	fs := flag.NewFlagSet("hook", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dryRun := fs.Bool("print", false, "print the hooks instead of writing them")
+
+	var action string
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || action != "install" && action != "uninstall" {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt hook <install|uninstall> [-print] [path]")
+		return 2
+	}
+
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	root := probeParent(dir)
+	if root == "" {
+		fmt.Fprintf(os.Stderr, "vcprompt: no git repository at %s\n", dir)
+		return 1
+	}
+	hooksDir, err := gitHooksDir(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	for _, name := range gitHooks {
+		path := filepath.Join(hooksDir, name)
+		var msg string
+		var err error
+		if action == "install" {
+			msg, err = installHook(path, *dryRun)
+		} else {
+			msg, err = uninstallHook(path, *dryRun)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: %s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		if msg != "" && !*dryRun {
+			fmt.Printf("%s %s\n", msg, path)
+		}
+	}
+	return status
+}
+
+// gitHooksDir returns the hooks directory of the repository at root, which
+// git finds from core.hooksPath, worktrees and .git files.
+func gitHooksDir(root string) (string, error) {
+	out, err := git(root, "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %v", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return dir, nil
+}
+
+// installHook adds the block to the hook at path, after its first line so
+// that it runs even if the hook exits early. It returns what it did.
+func installHook(path string, dryRun bool) (string, error) {
+	data, err := readConfig(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte(hookStart)) {
+		return "already in", nil
+	}
+
+	mode := os.FileMode(0755)
+	var hook []byte
+	if len(bytes.TrimSpace(data)) == 0 {
+		hook = []byte("#!/bin/sh\n" + hookBlock)
+	} else {
+		first := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			first = data[:i+1]
+		}
+		if !shellShebang.Match(first) {
+			return "", fmt.Errorf("not a shell script, add the vcprompt block by hand:\n%s", hookBlock)
+		}
+		if !bytes.HasSuffix(first, []byte("\n")) {
+			first = append(first, '\n')
+		}
+		hook = append(append(append([]byte(nil), first...), hookBlock...), data[len(first):]...)
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm() | 0111
+		}
+	}
+	return "added to", writeHook(path, hook, mode, dryRun)
+}
+
+// uninstallHook removes the block from the hook at path, and the hook if
+// nothing else is left. It returns what it did.
+func uninstallHook(path string, dryRun bool) (string, error) {
+	data, err := readConfig(path)
+	if err != nil {
+		return "", err
+	}
+	start := bytes.Index(data, []byte(hookStart))
+	if start < 0 {
+		return "", nil
+	}
+	end := bytes.Index(data[start:], []byte(hookEnd+"\n"))
+	if end < 0 {
+		return "", fmt.Errorf("unterminated vcprompt block, remove it by hand")
+	}
+	hook := append(append([]byte(nil), data[:start]...), data[start+end+len(hookEnd)+1:]...)
+
+	if strings.TrimSpace(string(hook)) == "#!/bin/sh" {
+		if dryRun {
+			fmt.Printf("# rm %s\n", path)
+			return "removed", nil
+		}
+		return "removed", os.Remove(path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return "removed from", writeHook(path, hook, fi.Mode().Perm(), dryRun)
+}
+
+// writeHook writes the hook at path, executable. With dryRun, it prints it
+// instead.
+func writeHook(path string, data []byte, mode os.FileMode, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("# %s\n%s", path, data)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of existing files.
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// initScripts holds the snippets printed by "vcprompt init <shell>", which
+// wire vcprompt into the prompt of the given shell. The format comes from the
+// config file or $VCPROMPT_FORMAT.
+var initScripts = map[string]string{
+	"bash": `__vcprompt_ps1=${__vcprompt_ps1-$PS1}
+__vcprompt_update() {
+    local status=$? vcs
+    vcs=$(vcprompt -shell=bash)
+    PS1="${vcs:+$vcs }$__vcprompt_ps1"
+    return $status
+}
+case ";$PROMPT_COMMAND;" in
+*";__vcprompt_update;"*) ;;
+*) PROMPT_COMMAND="__vcprompt_update${PROMPT_COMMAND:+;$PROMPT_COMMAND}" ;;
+esac
+`,
+	"zsh": `setopt prompt_subst
+__vcprompt_prompt=${__vcprompt_prompt-$PROMPT}
+__vcprompt_precmd() {
+    __vcprompt_vcs=$(vcprompt -shell=zsh)
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __vcprompt_precmd
+PROMPT='${__vcprompt_vcs:+$__vcprompt_vcs }'$__vcprompt_prompt
+`,
+	"fish": `function fish_prompt
+    set_color blue
+    echo -n (prompt_pwd)
+    set_color normal
+    echo -n ' > '
+end
+
+function fish_right_prompt
+    vcprompt -shell=fish -rprompt
+end
+`,
+	"powershell": `if (-not $global:__vcprompt_prompt) {
+    $global:__vcprompt_prompt = $function:prompt
+}
+function global:prompt {
+    $status = $global:LASTEXITCODE
+    $encoding = [Console]::OutputEncoding
+    try {
+        [Console]::OutputEncoding = [Text.Encoding]::UTF8
+        $vcs = (vcprompt -shell=powershell) -join ""
+    } finally {
+        [Console]::OutputEncoding = $encoding
+        $global:LASTEXITCODE = $status
+    }
+    $prompt = & $global:__vcprompt_prompt
+    if ($vcs) { "$vcs $prompt" } else { $prompt }
+}
+`,
+}
+
+// asyncScripts are the variants of initScripts printed with -async. The prompt
+// shows the result of the previous run in the same directory while vcprompt
+// runs in the background, so slow repositories never block the prompt. The
+// state is kept in a file per shell, in a private directory made with mktemp
+// and removed when the shell exits, but for zsh, which reads the output of
+// vcprompt from a pipe with zle -F, and redraws the prompt in place when it
+// changed. There, vcprompt asks the daemon, which collects the state once for
+// the prompts which ask for it at the same time.
+var asyncScripts = map[string]string{
+	"bash": `__vcprompt_ps1=${__vcprompt_ps1-$PS1}
+if [ -z "$__vcprompt_tmp" ] || [ ! -d "$__vcprompt_tmp" ]; then
+    __vcprompt_tmp=$(mktemp -d "${XDG_RUNTIME_DIR:-${TMPDIR:-/tmp}}/vcprompt.XXXXXXXXXX" 2>/dev/null)
+    __vcprompt_exit=$(trap -p EXIT)
+    __vcprompt_exit=${__vcprompt_exit#trap -- }
+    eval "__vcprompt_exit=${__vcprompt_exit% EXIT}"
+    trap 'rm -rf -- "$__vcprompt_tmp"'"${__vcprompt_exit:+; $__vcprompt_exit}" EXIT
+fi
+__vcprompt_update() {
+    local status=$? dir= vcs= state=$__vcprompt_tmp/state tmp=$__vcprompt_tmp/state.$RANDOM
+    if [ -z "$__vcprompt_tmp" ]; then
+        vcs=$(vcprompt -shell=bash)
+        PS1="${vcs:+$vcs }$__vcprompt_ps1"
+        return $status
+    fi
+    if [ -r "$state" ]; then
+        { IFS= read -r dir; IFS= read -r vcs; } < "$state"
+    fi
+    [ "$dir" = "$PWD" ] || vcs=
+    PS1="${vcs:+$vcs }$__vcprompt_ps1"
+    ( { printf '%s\n' "$PWD"; vcprompt -shell=bash; } > "$tmp" && mv -f "$tmp" "$state" & ) 2>/dev/null
+    return $status
+}
+case ";$PROMPT_COMMAND;" in
+*";__vcprompt_update;"*) ;;
+*) PROMPT_COMMAND="__vcprompt_update${PROMPT_COMMAND:+;$PROMPT_COMMAND}" ;;
+esac
+`,
+	"zsh": `setopt prompt_subst
+__vcprompt_prompt=${__vcprompt_prompt-$PROMPT}
+typeset -g __vcprompt_vcs= __vcprompt_dir= __vcprompt_fd=
+__vcprompt_precmd() {
+    [[ $__vcprompt_dir == $PWD ]] || __vcprompt_vcs=
+    __vcprompt_dir=$PWD
+    if [[ -n $__vcprompt_fd ]]; then
+        zle -F $__vcprompt_fd 2>/dev/null
+        exec {__vcprompt_fd}<&-
+    fi
+    exec {__vcprompt_fd}< <(vcprompt -shell=zsh -daemon 2>/dev/null)
+    zle -F $__vcprompt_fd __vcprompt_ready
+}
+__vcprompt_ready() {
+    local fd=$1 vcs
+    IFS= read -r -d '' -u $fd vcs
+    zle -F $fd
+    exec {fd}<&-
+    [[ $fd == $__vcprompt_fd ]] || return
+    __vcprompt_fd=
+    if [[ $vcs != $__vcprompt_vcs ]]; then
+        __vcprompt_vcs=$vcs
+        zle reset-prompt
+    fi
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __vcprompt_precmd
+PROMPT='${__vcprompt_vcs:+$__vcprompt_vcs }'$__vcprompt_prompt
+`,
+	"fish": `if not test -n "$__vcprompt_tmp" -a -d "$__vcprompt_tmp"
+    set -l base /tmp
+    set -q TMPDIR; and set base $TMPDIR
+    set -q XDG_RUNTIME_DIR; and set base $XDG_RUNTIME_DIR
+    set -g __vcprompt_tmp (mktemp -d $base/vcprompt.XXXXXXXXXX 2>/dev/null)
+end
+set -g __vcprompt_state $__vcprompt_tmp/state
+
+function fish_prompt
+    set_color blue
+    echo -n (prompt_pwd)
+    set_color normal
+    echo -n ' > '
+end
+
+function fish_right_prompt
+    if test -z "$__vcprompt_tmp"
+        vcprompt -shell=fish -rprompt
+    else if test -r $__vcprompt_state
+        set -l state (cat $__vcprompt_state)
+        if test "$state[1]" = "$PWD"
+            echo -n $state[2]
+        end
+    end
+end
+
+function __vcprompt_refresh --on-event fish_prompt
+    test -n "$__vcprompt_tmp"; or return
+    set -l tmp $__vcprompt_state.(random)
+    fish -c 'begin; echo $PWD; vcprompt -shell=fish -rprompt; end > $argv[1]; and mv -f $argv[1] $argv[2]' $tmp $__vcprompt_state &
+    disown
+end
+
+function __vcprompt_cleanup --on-event fish_exit
+    test -n "$__vcprompt_tmp"; and rm -rf -- $__vcprompt_tmp
+end
+`,
+}
+
+// runInit prints the init snippet of the shell given in args.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	async := fs.Bool("async", false, "run vcprompt in the background")
+
+	// the shell may come before or after the flags.
+	var name string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || name != "" && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt init [-async] <shell>")
+		return 2
+	}
+	if name == "" {
+		name = fs.Arg(0)
+	}
+
+	scripts := initScripts
+	if *async {
+		scripts = asyncScripts
+	}
+
+	script, ok := scripts[name]
+	if !ok {
+		if _, known := initScripts[name]; known {
+			fmt.Fprintf(os.Stderr, "vcprompt: -async is not supported for %s\n", name)
+		} else {
+			fmt.Fprintf(os.Stderr, "vcprompt: unknown shell %q\n", name)
+		}
+		return 2
+	}
+
+	fmt.Print(script)
+	return 0
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// installers set up vcprompt in the configuration of prompt frameworks, for
+// "vcprompt install <framework>". They return what to tell the user.
+var installers = map[string]func(dryRun bool) (string, error){
+	"oh-my-zsh":  installOhMyZsh,
+	"oh-my-posh": installOhMyPosh,
+	"starship":   installStarship,
+}
+
+// errInstalled is returned by installers if vcprompt is set up already.
+var errInstalled = errors.New("vcprompt is set up already")
+
+// runInstall runs the installer of the framework given in args.
+func runInstall(args []string) int {
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dryRun := fs.Bool("print", false, "print the changes instead of writing them")
+
+	// the framework may come before or after the flags.
+	var name string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || name != "" && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt install [-print] <oh-my-zsh|oh-my-posh|starship>")
+		return 2
+	}
+	if name == "" {
+		name = fs.Arg(0)
+	}
+
+	install, ok := installers[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "vcprompt: unknown prompt framework %q\n", name)
+		return 2
+	}
+
+	msg, err := install(*dryRun)
+	if err == errInstalled {
+		fmt.Println(err)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	if !*dryRun {
+		fmt.Print(msg)
+	}
+	return 0
+}
+
+// writeConfig writes data to the file at path, keeping the previous version
+// in path.bak. With dryRun, it prints what it would write instead.
+func writeConfig(path string, data []byte, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("# %s\n%s", path, data)
+		return nil
+	}
+
+	if old, err := ioutil.ReadFile(path); err == nil {
+		if err := ioutil.WriteFile(path+".bak", old, 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// readConfig reads the file at path. A missing file is empty.
+func readConfig(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// homePath returns the value of the environment variable env, or name in the
+// home directory if it is not set.
+func homePath(env, name string) (string, error) {
+	if p := os.Getenv(env); p != "" {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, name), nil
+}
+
+// ohMyZshPlugin is the vcprompt plugin of oh-my-zsh. Themes set PROMPT after
+// the plugins are loaded, so the plugin adds the state in front of it before
+// each prompt, unless the theme shows it with $(vcprompt_info) already.
+const ohMyZshPlugin = `# written by vcprompt install oh-my-zsh
+setopt prompt_subst
+typeset -g __vcprompt_vcs=
+__vcprompt_precmd() {
+    __vcprompt_vcs=$(vcprompt -shell=zsh)
+    if [[ $PROMPT$RPROMPT != *vcprompt* ]]; then
+        PROMPT='${__vcprompt_vcs:+$__vcprompt_vcs }'$PROMPT
+    fi
+}
+vcprompt_info() {
+    print -rn -- $__vcprompt_vcs
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __vcprompt_precmd
+`
+
+// pluginsLine matches the plugins array of .zshrc, if it is on a single line.
+var pluginsLine = regexp.MustCompile(`(?m)^plugins=\(([^)\n]*)\)`)
+
+// installOhMyZsh writes a vcprompt plugin to $ZSH_CUSTOM, and adds it to the
+// plugins of .zshrc.
+func installOhMyZsh(dryRun bool) (string, error) {
+	custom := os.Getenv("ZSH_CUSTOM")
+	if custom == "" {
+		zsh, err := homePath("ZSH", ".oh-my-zsh")
+		if err != nil {
+			return "", err
+		}
+		custom = filepath.Join(zsh, "custom")
+	}
+
+	plugin := filepath.Join(custom, "plugins", "vcprompt", "vcprompt.plugin.zsh")
+	if err := writeConfig(plugin, []byte(ohMyZshPlugin), dryRun); err != nil {
+		return "", err
+	}
+
+	zdotdir, err := homePath("ZDOTDIR", "")
+	if err != nil {
+		return "", err
+	}
+	zshrc := filepath.Join(zdotdir, ".zshrc")
+
+	data, err := readConfig(zshrc)
+	if err != nil {
+		return "", err
+	}
+	m := pluginsLine.FindSubmatchIndex(data)
+	if m == nil {
+		return fmt.Sprintf("wrote %s\nadd vcprompt to the plugins in %s: plugins=(... vcprompt)\n", plugin, zshrc), nil
+	}
+	for _, p := range strings.Fields(string(data[m[2]:m[3]])) {
+		if p == "vcprompt" {
+			return fmt.Sprintf("wrote %s\n", plugin), nil
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:m[3]])
+	if strings.TrimSpace(string(data[m[2]:m[3]])) != "" {
+		buf.WriteString(" ")
+	}
+	buf.WriteString("vcprompt")
+	buf.Write(data[m[3]:])
+	if err := writeConfig(zshrc, buf.Bytes(), dryRun); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("wrote %s\nadded vcprompt to the plugins in %s\n", plugin, zshrc), nil
+}
+
+// starshipModule is the custom module added to starship.toml. starship hides
+// it when the output is empty.
+const starshipModule = `
+# added by vcprompt install starship
+[custom.vcprompt]
+command = "vcprompt -o starship"
+when = true
+format = "[$output]($style) "
+style = "bold purple"
+`
+
+// installStarship adds a custom module to the starship config file.
+func installStarship(dryRun bool) (string, error) {
+	path, err := homePath("STARSHIP_CONFIG", filepath.Join(".config", "starship.toml"))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := readConfig(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte("[custom.vcprompt]")) {
+		return "", errInstalled
+	}
+
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	if err := writeConfig(path, append(data, starshipModule...), dryRun); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("added the custom.vcprompt module to %s\n", path), nil
+}
+
+// poshSegment is the segment added to oh-my-posh themes, with its keys in the
+// order of the oh-my-posh docs.
+var poshSegment = struct {
+	Type       string            `json:"type"`
+	Style      string            `json:"style"`
+	Foreground string            `json:"foreground"`
+	Template   string            `json:"template"`
+	Properties map[string]string `json:"properties"`
+}{
+	Type:       "command",
+	Style:      "plain",
+	Foreground: "magenta",
+	Template:   " {{ .Output }} ",
+	Properties: map[string]string{
+		"shell":   "sh",
+		"command": "vcprompt",
+	},
+}
+
+// installOhMyPosh adds a command segment to the first block of the oh-my-posh
+// theme in $POSH_THEME. Only JSON themes can be changed. The segment is
+// inserted in the text of the theme, which keeps the order of its keys and
+// its formatting.
+func installOhMyPosh(dryRun bool) (string, error) {
+	path := os.Getenv("POSH_THEME")
+	if filepath.Ext(path) != ".json" {
+		seg, _ := json.MarshalIndent(poshSegment, "", "  ")
+		return "", fmt.Errorf("$POSH_THEME is not a JSON theme; add this segment to your theme:\n%s", seg)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte(`"vcprompt`)) {
+		return "", errInstalled
+	}
+	out, err := addPoshSegment(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if err := writeConfig(path, out, dryRun); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("added a vcprompt segment to %s\n", path), nil
+}
+
+// addPoshSegment returns the JSON theme data with poshSegment at the end of
+// the segments of its first block.
+func addPoshSegment(data []byte) ([]byte, error) {
+	if err := json.Unmarshal(data, new(interface{})); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if !findKey(dec, "blocks") {
+		return nil, errors.New("no blocks in the theme")
+	}
+	if tok, _ := dec.Token(); tok != json.Delim('[') || !dec.More() {
+		return nil, errors.New("no blocks in the theme")
+	}
+	if !findKey(dec, "segments") {
+		return nil, errors.New("no segments in the first block of the theme")
+	}
+	if tok, _ := dec.Token(); tok != json.Delim('[') {
+		return nil, errors.New("bad segments in the theme")
+	}
+
+	// the segment goes after the last one, indented as it is.
+	open := int(dec.InputOffset())
+	last, after := -1, open
+	for dec.More() {
+		last = int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if err := skipValue(dec, tok); err != nil {
+			return nil, err
+		}
+		after = int(dec.InputOffset())
+	}
+	dec.Token()
+	end := int(dec.InputOffset()) - 1
+	unit := "  "
+	indent := lineIndent(data, open) + unit
+	if last >= 0 {
+		// the offset of a value is where the whitespace before it starts.
+		for strings.IndexByte(" \t\r\n,", data[last]) >= 0 {
+			last++
+		}
+		indent = lineIndent(data, last)
+		if u := strings.TrimPrefix(indent, lineIndent(data, open)); u != "" {
+			unit = u
+		}
+	}
+	seg, err := json.MarshalIndent(poshSegment, indent, unit)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if last >= 0 {
+		buf.Write(data[:after])
+		buf.WriteString(",\n" + indent)
+		buf.Write(seg)
+		buf.Write(data[after:])
+	} else {
+		buf.Write(data[:open])
+		buf.WriteString("\n" + indent)
+		buf.Write(seg)
+		buf.WriteString("\n" + lineIndent(data, open))
+		buf.Write(data[end:])
+	}
+	return buf.Bytes(), nil
+}
+
+// findKey reads the object which comes next from dec up to the value of key,
+// and reports whether it has one.
+func findKey(dec *json.Decoder, key string) bool {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return false
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if tok == key {
+			return true
+		}
+		if tok, err = dec.Token(); err != nil || skipValue(dec, tok) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// skipValue reads the rest of the value which starts with tok from dec.
+func skipValue(dec *json.Decoder, tok json.Token) error {
+	depth := 0
+	for {
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+// lineIndent returns the spaces and tabs which start the line of data at
+// offset off.
+func lineIndent(data []byte, off int) string {
+	start := bytes.LastIndexByte(data[:off], '\n') + 1
+	end := start
+	for end < len(data) && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[start:end])
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddPoshSegment(t *testing.T) {
+	seg, _ := json.MarshalIndent(poshSegment, "", "  ")
+	tests := []struct {
+		name, theme, want string
+	}{
+		{
+			"spaces",
+			`{
+  "version": 2,
+  "blocks": [
+    {
+      "type": "prompt",
+      "segments": [
+        {"type": "path", "style": "plain"}
+      ]
+    },
+    {"segments": []}
+  ],
+  "final_space": true
+}
+`,
+			`{
+  "version": 2,
+  "blocks": [
+    {
+      "type": "prompt",
+      "segments": [
+        {"type": "path", "style": "plain"},
+        ` + strings.Replace(string(seg), "\n", "\n        ", -1) + `
+      ]
+    },
+    {"segments": []}
+  ],
+  "final_space": true
+}
+`,
+		},
+		{
+			"tabs",
+			"{\n\t\"blocks\": [{\n\t\t\"segments\": [\n\t\t\t{\"type\": \"path\"}\n\t\t]\n\t}]\n}\n",
+			"{\n\t\"blocks\": [{\n\t\t\"segments\": [\n\t\t\t{\"type\": \"path\"},\n\t\t\t" + strings.Replace(strings.Replace(string(seg), "  ", "\t", -1), "\n", "\n\t\t\t", -1) + "\n\t\t]\n\t}]\n}\n",
+		},
+		{
+			"empty",
+			`{"blocks": [{"segments": [ ]}]}`,
+			"{\"blocks\": [{\"segments\": [\n  " + strings.Replace(string(seg), "\n", "\n  ", -1) + "\n]}]}",
+		},
+	}
+	for _, tt := range tests {
+		got, err := addPoshSegment([]byte(tt.theme))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %v\n%s\nwant\n%s", tt.name, err, got, tt.want)
+			continue
+		}
+
+		// the theme is the same, with one more segment.
+		var before, after map[string]interface{}
+		json.Unmarshal([]byte(tt.theme), &before)
+		if err := json.Unmarshal(got, &after); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		block := before["blocks"].([]interface{})[0].(map[string]interface{})
+		var s interface{}
+		json.Unmarshal(seg, &s)
+		block["segments"] = append(block["segments"].([]interface{}), s)
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("%s: the theme changed to %v", tt.name, after)
+		}
+	}
+
+	for _, theme := range []string{
+		`{"blocks": []}`,
+		`{"version": 2}`,
+		`{"blocks": [{"type": "prompt"}]}`,
+		`{"blocks": [{"segments": {}}]}`,
+		`{"blocks": [{"segments": [}`,
+		`[]`,
+	} {
+		if got, err := addPoshSegment([]byte(theme)); err == nil {
+			t.Errorf("%s: no error, got %s", theme, got)
+		}
+	}
+}
+
+func TestInstallOhMyPosh(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "theme.omp.json")
+	theme := "{\n  \"blocks\": [\n    {\n      \"segments\": []\n    }\n  ]\n}\n"
+	writeFiles(t, dir, map[string]string{"theme.omp.json": theme})
+	t.Setenv("POSH_THEME", path)
+
+	if _, err := installOhMyPosh(false); err != nil {
+		t.Fatal(err)
+	}
+	if bak, err := ioutil.ReadFile(path + ".bak"); err != nil || string(bak) != theme {
+		t.Errorf("backup: %q, %v", bak, err)
+	}
+	if _, err := installOhMyPosh(false); err != errInstalled {
+		t.Errorf("second install: %v, want errInstalled", err)
+	}
+}
+
+func TestInstallOhMyZsh(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ZSH_CUSTOM", filepath.Join(dir, "custom"))
+	t.Setenv("ZDOTDIR", dir)
+	zshrc := "ZSH_THEME=robbyrussell\nplugins=(git)\nsource $ZSH/oh-my-zsh.sh\n"
+	writeFiles(t, dir, map[string]string{".zshrc": zshrc})
+
+	if _, err := installOhMyZsh(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".zshrc"))
+	if want := strings.Replace(zshrc, "(git)", "(git vcprompt)", 1); err != nil || string(data) != want {
+		t.Errorf(".zshrc = %q, %v; want %q", data, err, want)
+	}
+	plugin, err := ioutil.ReadFile(filepath.Join(dir, "custom", "plugins", "vcprompt", "vcprompt.plugin.zsh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the theme sets PROMPT after the plugin is loaded.
+	for _, line := range strings.Split(string(plugin), "\n") {
+		if strings.HasPrefix(line, "PROMPT=") {
+			t.Errorf("the plugin sets PROMPT when it is loaded: %s", line)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".zshrc.bak")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log levels, set with -d and -dd.
+const (
+	logOff = iota
+	logDebug
+	logTrace // also logs each command run
+)
+
+var (
+	logLevel = logOff
+	logger   = log.New(os.Stderr, "vcprompt: ", log.Ltime|log.Lmicroseconds)
+)
+
+// setupLog sets the log level from the flags, and sends the log to the file
+// named by $VCPROMPT_LOG, if any. Logging to a file turns on -d.
+func setupLog() error {
+	switch {
+	case *trace:
+		logLevel = logTrace
+	case *debug:
+		logLevel = logDebug
+	}
+
+	if name := os.Getenv("VCPROMPT_LOG"); name != "" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		logger.SetOutput(f)
+		logger.SetPrefix("vcprompt[" + strconv.Itoa(os.Getpid()) + "]: ")
+		if logLevel == logOff {
+			logLevel = logDebug
+		}
+	}
+	return nil
+}
+
+// debugf logs a message with -d.
+func debugf(format string, a ...interface{}) {
+	if logLevel >= logDebug {
+		logger.Printf(format, a...)
+	}
+}
+
+// tracef logs a message with -dd.
+func tracef(format string, a ...interface{}) {
+	if logLevel >= logTrace {
+		logger.Printf(format, a...)
+	}
+}
+
+// timed logs how long the phase name took with -d, when the returned function
+// is called:
+//
+//	defer timed("collect")()
+func timed(name string) func() {
+	if logLevel < logDebug {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		logger.Printf("%s took %s", name, time.Since(start))
+	}
+}
+
+// logCommand logs the command args run in dir with -dd.
+func logCommand(dir string, args []string) {
+	tracef("running %s in %s", strings.Join(args, " "), dir)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// With -memo, the processes which collect states again and again, the daemon
+// and -w, keep each state for the given time, as long as the files of the git
+// directory it comes from do not change. Editors which ask on every keystroke
+// then get the same state without the checks running again. The work tree is
+// not looked at, so its changes show up after -memo at the latest, or as soon
+// as the repository is watched to change.
+
+// memoKey identifies a memoized state: the directory it is for, the options
+// it was collected with, and the fingerprint of its repository.
+type memoKey struct {
+	dir         string
+	options     collectOptions
+	root        string
+	fingerprint string
+}
+
+// memoEntry is a memoized state.
+type memoEntry struct {
+	v    vcs
+	time time.Time
+}
+
+// memos are the memoized states.
+var memos = struct {
+	sync.Mutex
+	m map[memoKey]memoEntry
+}{m: map[memoKey]memoEntry{}}
+
+// memoFor returns the key of the state of dir, and reports false for ok if it
+// may not be memoized.
+func memoFor(dir string, o collectOptions) (key memoKey, ok bool) {
+	if *memoTTL <= 0 || !inDaemon && watchMode.interval <= 0 {
+		return memoKey{}, false
+	}
+	root, err := probeWithin(dir)
+	if err != nil || root == "" {
+		return memoKey{}, false
+	}
+	return memoKey{dir, o, root, fingerprint(root)}, true
+}
+
+// memoized returns the state of key, if it was kept for less than -memo.
+func memoized(key memoKey) (vcs, bool) {
+	memos.Lock()
+	defer memos.Unlock()
+	e, ok := memos.m[key]
+	if !ok || time.Since(e.time) >= *memoTTL {
+		return vcs{}, false
+	}
+	debugf("memo: kept state for %s", key.dir)
+	return e.v, true
+}
+
+// memoize keeps v as the state of key, unless it is incomplete. The states
+// which expired are forgotten.
+func memoize(key memoKey, v vcs) {
+	if !v.available || len(v.timedOut) > 0 || len(v.pending) > 0 {
+		return
+	}
+	memos.Lock()
+	defer memos.Unlock()
+	for k, e := range memos.m {
+		if k.dir == key.dir && k.options == key.options || time.Since(e.time) >= *memoTTL {
+			delete(memos.m, k)
+		}
+	}
+	memos.m[key] = memoEntry{v: v, time: time.Now()}
+}
+
+// forgetMemos forgets the states of the repository at root, which changed.
+func forgetMemos(root string) {
+	memos.Lock()
+	defer memos.Unlock()
+	for k := range memos.m {
+		if k.root == root {
+			delete(memos.m, k)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads f, as there is no mmap here.
+func mapFile(f *os.File, size int64) (data []byte, unmap func() error, err error) {
+	data, err = ioutil.ReadAll(f)
+	return data, func() error { return nil }, err
+}
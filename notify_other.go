@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// notifySignal is not supported on this platform, where any -notify-signal
+// is accepted and -notify-pid fails.
+func notifySignal() (syscall.Signal, error) {
+	return 0, nil
+}
+
+// notify is not supported on this platform.
+func notify(pid int, sig syscall.Signal) error {
+	return errors.New("-notify-pid is not supported on this platform")
+}
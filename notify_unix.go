@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// notifySignals are the signals -notify-signal can send, by name.
+var notifySignals = map[string]syscall.Signal{
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// notifySignal returns the signal of -notify-signal.
+func notifySignal() (syscall.Signal, error) {
+	sig, ok := notifySignals[*notifySig]
+	if !ok {
+		return 0, fmt.Errorf("bad -notify-signal %q, want USR1, USR2 or WINCH", *notifySig)
+	}
+	return sig, nil
+}
+
+// notify tells the process pid that the output is ready, with sig.
+func notify(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
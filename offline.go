@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// vcprompt never uses the network, so that prompts do not hang on flaky VPNs:
+// it runs no git command which talks to remotes, and runs the others with
+// protocol.allow=never, so that git fails rather than fetch what is missing,
+// such as the objects of partial clones. Only "vcprompt self-update" downloads.
+// -assert-offline checks it: vcprompt exits with statusOnline instead of
+// running anything which would use the network.
+
+// statusOnline is the exit status of -assert-offline.
+const statusOnline = 4
+
+// offlineGitArgs are passed to git before the arguments of each command.
+var offlineGitArgs = []string{"-c", "protocol.allow=never"}
+
+// networkCommands are the git commands which talk to remotes.
+var networkCommands = map[string]bool{
+	"archive":    true, // with --remote
+	"clone":      true,
+	"fetch":      true,
+	"fetch-pack": true,
+	"ls-remote":  true,
+	"pull":       true,
+	"push":       true,
+	"remote":     true,
+	"send-pack":  true,
+	"submodule":  true,
+}
+
+// gitCommand returns the git command with args, which cannot use the
+// network, run with ctx.
+func gitCommand(ctx context.Context, args ...string) *exec.Cmd {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c" || args[i] == "-C" {
+			i++
+		} else if !strings.HasPrefix(args[i], "-") {
+			assertOffline("git "+args[i], networkCommands[args[i]])
+			break
+		}
+	}
+	return exec.CommandContext(ctx, "git", append(append([]string(nil), offlineGitArgs...), args...)...)
+}
+
+// assertOffline exits with -assert-offline if what is about to use the network,
+// as online tells.
+func assertOffline(what string, online bool) {
+	if !*assertOff || !online {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "vcprompt: -assert-offline: %s would use the network\n", what)
+	exit(statusOnline)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stdout is where the output goes: standard output, -output-fd, or a buffer
+// for -output-file and -state-file.
+var stdout io.Writer = os.Stdout
+
+// openOutput directs the output to -output-fd or -output-file.
+func openOutput() error {
+	if _, err := notifySignal(); err != nil {
+		return err
+	}
+	switch {
+	case *outputFD >= 0 && *outputFile != "", *outputFD >= 0 && *stateFile != "", *outputFile != "" && *stateFile != "":
+		return fmt.Errorf("only one of -output-fd, -output-file and -state-file can be used")
+	case *outputFD >= 0:
+		f := os.NewFile(uintptr(*outputFD), "output")
+		if _, err := f.Stat(); err != nil {
+			return fmt.Errorf("bad -output-fd %d: %v", *outputFD, err)
+		}
+		stdout = f
+	case *outputFile != "", *stateFile != "":
+		stdout = new(bytes.Buffer)
+	}
+	return nil
+}
+
+// flushOutput writes the output to -output-file or -state-file, if given, and
+// notifies -notify-pid that it is ready. The file is replaced at once, so
+// readers never see a partial output.
+func flushOutput() error {
+	if buf, ok := stdout.(*bytes.Buffer); ok {
+		if *stateFile != "" {
+			written, err := writeState(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			buf.Reset()
+			if !written {
+				return nil
+			}
+		} else {
+			if err := writeAtomic(*outputFile, buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+	}
+
+	if *notifyPID > 0 {
+		sig, _ := notifySignal()
+		if err := notify(*notifyPID, sig); err != nil {
+			return fmt.Errorf("-notify-pid %d: %v", *notifyPID, err)
+		}
+	}
+	return nil
+}
+
+// flushed is flushOutput for the exit status status. It returns 2 if the
+// output cannot be written.
+func flushed(status int) int {
+	if err := flushOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	return status
+}
+
+// outputIsTerminal reports whether the output goes to a terminal.
+func outputIsTerminal() bool {
+	f, ok := stdout.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// writeAtomic writes data to a temporary file next to path, and renames it to
+// path.
+func writeAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// outputs are the output modes selected with -o. The default one expands the
+// format string.
+var outputs = map[string]func(v vcs) string{
+	"":                prompt(vcs.pieces),
+	"powerline":       prompt(powerline),
+	"powerline-json":  powerlineJSON,
+	"env":             env,
+	"porcelain":       porcelain,
+	"starship":        starship,
+	"oh-my-posh":      ohMyPosh,
+	"statusline":      statusline,
+	"statusline-json": statuslineJSON,
+	"iterm2":          iterm2(false),
+	"iterm2-badge":    iterm2(true),
+}
+
+// prompt returns an output mode which quotes the prompt rendered by render for
+// the shell. -prefix, -suffix and -newline are only added to prompts with
+// visible text.
+func prompt(render func(v vcs) pieces) func(v vcs) string {
+	return func(v vcs) string {
+		p := render(v)
+		if *rprompt {
+			p = p.trimRight()
+		}
+
+		empty := p.width() == 0
+		if !empty && *prefix != "" {
+			p = append(p, piece{})
+			copy(p[1:], p)
+			p[0] = piece{s: *prefix}
+		}
+		if !empty && *suffix != "" {
+			p.text(*suffix)
+		}
+
+		out := p.quote(shellModes[*shell])
+		width := p.width()
+		putPieces(p)
+		if *ascii {
+			out = toASCII(out)
+		}
+		if *printWidth {
+			out = strconv.Itoa(width) + "\t" + out
+		}
+		if *newline && !empty {
+			out += "\n"
+		}
+		return out
+	}
+}
+
+// titled returns out after the escape sequence which sets the title of the
+// terminal to -title-format, with -set-title. Outside of repositories, the
+// title is left alone.
+func titled(v vcs, out string) string {
+	if !*setTitle || !v.available {
+		return out
+	}
+	var p pieces
+	v.render(&p, compileFormat(*titleFmt))
+	var b strings.Builder
+	for _, pc := range p {
+		if pc.color {
+			continue
+		}
+		// control characters would end the sequence.
+		for _, r := range pc.s {
+			if r >= 0x20 && r != 0x7f && (r < 0x80 || r > 0x9f) {
+				b.WriteRune(r)
+			}
+		}
+	}
+	title := b.String()
+	if *ascii {
+		title = toASCII(title)
+	}
+	if title == "" {
+		return out
+	}
+	mode := shellModes[*shell]
+	return mode.invisible("\x1b]2;"+mode.escape(title)+"\a") + out
+}
+
+// plainPrompt renders the format without colors.
+func plainPrompt(v vcs) string {
+	var p pieces
+	for _, pc := range v.pieces() {
+		if !pc.color {
+			p = append(p, pc)
+		}
+	}
+
+	out := p.quote(shellModes[""])
+	if *ascii {
+		out = toASCII(out)
+	}
+	return out
+}
+
+// starship renders the format for starship's custom modules, which style the
+// output themselves, so colors are left out.
+func starship(v vcs) string {
+	return strings.TrimSpace(plainPrompt(v))
+}
+
+// statusline renders the format for the statuslines of vim and neovim, which
+// color it themselves: without colors, on a single line with the runs of
+// spaces squeezed, and with % doubled, as statuslines expand % items.
+func statusline(v vcs) string {
+	return statuslineOf(plainPrompt(v))
+}
+
+// statuslineOf returns the prompt text as a vim statusline.
+func statuslineOf(text string) string {
+	return statuslineEscape(strings.Join(strings.Fields(text), " "))
+}
+
+// statuslineEscape quotes s for vim statuslines.
+var statuslineEscape = strings.NewReplacer("%", "%%").Replace
+
+// statuslineState is the state as printed for editor plugins. It is never
+// null and holds no null, which Lua would decode to a true value, and its
+// keys are valid Lua and Vim script identifiers.
+type statuslineState struct {
+	Available  bool     `json:"available"`
+	Vcs        string   `json:"vcs"`
+	Branch     string   `json:"branch"`
+	Revision   string   `json:"revision"`
+	Dirty      bool     `json:"dirty"`
+	Untracked  bool     `json:"untracked"`
+	Conflict   bool     `json:"conflict"`
+	Ahead      int      `json:"ahead"`
+	Behind     int      `json:"behind"`
+	Stash      int      `json:"stash"`
+	Operation  string   `json:"operation"`
+	Unknown    []string `json:"unknown"`    // checks which timed out, were skipped or are pending
+	Text       string   `json:"text"`       // the format, without colors
+	Statusline string   `json:"statusline"` // the same, as -o statusline prints it
+}
+
+// statuslineJSON renders v as a JSON object for the statusline plugins of vim
+// and neovim, to be read with json_decode() or vim.json.decode().
+func statuslineJSON(v vcs) string {
+	s := statuslineState{
+		Available: v.available,
+		Vcs:       v.name,
+		Branch:    v.branch,
+		Revision:  v.revision,
+		Dirty:     v.isModified,
+		Untracked: v.untracked,
+		Conflict:  v.conflict,
+		Ahead:     v.ahead,
+		Behind:    v.behind,
+		Stash:     v.stash,
+		Operation: v.operation,
+		Unknown:   []string{},
+	}
+	for _, check := range checkOrder {
+		if v.timedOut[check] || v.skipped[check] || v.pending[check] {
+			s.Unknown = append(s.Unknown, check)
+		}
+	}
+	if v.available {
+		s.Text = plainPrompt(v)
+		s.Statusline = statuslineOf(s.Text)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		debugf("statusline-json: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// segment is a part of the powerline output. Its JSON form follows the
+// segments returned by powerline's segment functions.
+type segment struct {
+	Contents string   `json:"contents"`
+	Groups   []string `json:"highlight_groups"`
+	FG       string   `json:"fg"`
+	BG       string   `json:"bg"`
+}
+
+// segments splits v into powerline segments.
+func (v vcs) segments() []segment {
+	if !v.available {
+		return nil
+	}
+
+	var segs []segment
+
+	head := v.branch
+	if head == "" {
+		head = truncate(v.revision, 7, "")
+	}
+	if symbolSet.branch != "" {
+		head = symbolSet.branch + " " + head
+	}
+	segs = append(segs, segment{Contents: head, Groups: []string{"branch"}, FG: "black", BG: "blue"})
+
+	if v.isModified || v.untracked || v.conflict {
+		var contents string
+		if v.conflict {
+			contents += symbolSet.conflict
+		}
+		if v.isModified {
+			contents += symbolSet.modified
+		}
+		if v.untracked {
+			contents += symbolSet.untracked
+		}
+		segs = append(segs, segment{Contents: contents, Groups: []string{"branch_dirty"}, FG: "black", BG: "yellow"})
+	}
+
+	if v.stash > 0 {
+		segs = append(segs, segment{Contents: count(symbolSet.stash, v.stash), Groups: []string{"stash"}, FG: "black", BG: "magenta"})
+	}
+
+	if v.ahead > 0 || v.behind > 0 {
+		contents := count(symbolSet.ahead, v.ahead) + count(symbolSet.behind, v.behind)
+		segs = append(segs, segment{Contents: contents, Groups: []string{"ahead_behind"}, FG: "white", BG: "brblack"})
+	}
+
+	return segs
+}
+
+// powerline renders v as powerline segments with ANSI colors.
+func powerline(v vcs) pieces {
+	segs := v.segments()
+
+	separator := "\ue0b0"
+	if *ascii {
+		separator = ">"
+	}
+
+	var p pieces
+	for i, s := range segs {
+		p.color(s.FG)
+		p.color("bg:" + s.BG)
+		p.text(" " + s.Contents + " ")
+
+		// the separator is drawn in the color of this segment, on the
+		// background of the next one.
+		p.color("reset")
+		if i+1 < len(segs) {
+			p.color("bg:" + segs[i+1].BG)
+		}
+		p.color(s.BG)
+		p.text(separator)
+	}
+	if len(segs) > 0 {
+		p.color("reset")
+	}
+	return p
+}
+
+// powerlineJSON renders v as a JSON array of powerline segments.
+func powerlineJSON(v vcs) string {
+	segs := v.segments()
+	if segs == nil {
+		segs = []segment{}
+	}
+
+	b, err := json.Marshal(segs)
+	if err != nil {
+		debugf("powerline-json: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// poshState is the state as printed for oh-my-posh. Its fields are named
+// after those of the git segment of oh-my-posh, so that templates can be
+// shared, and it holds the prompt of the format, without colors.
+type poshState struct {
+	Vcs        string   `json:"Vcs"`
+	HEAD       string   `json:"HEAD"` // the branch, or the short commit
+	Ref        string   `json:"Ref"`
+	Detached   bool     `json:"Detached"`
+	Changed    bool     `json:"Changed"`
+	Untracked  bool     `json:"Untracked"`
+	Conflict   bool     `json:"Conflict"`
+	Ahead      int      `json:"Ahead"`
+	Behind     int      `json:"Behind"`
+	StashCount int      `json:"StashCount"`
+	Operation  string   `json:"Operation"`
+	Unknown    []string `json:"Unknown"` // checks which timed out, were skipped or are pending
+	Prompt     string   `json:"Prompt"`
+}
+
+// ohMyPosh renders v as a JSON object for oh-my-posh command segments, so that
+// their templates do not parse the prompt. It prints null outside of
+// repositories.
+func ohMyPosh(v vcs) string {
+	if !v.available {
+		return "null"
+	}
+	s := poshState{
+		Vcs:        v.name,
+		HEAD:       v.branch,
+		Ref:        v.branch,
+		Detached:   v.branch == "",
+		Changed:    v.isModified,
+		Untracked:  v.untracked,
+		Conflict:   v.conflict,
+		Ahead:      v.ahead,
+		Behind:     v.behind,
+		StashCount: v.stash,
+		Operation:  v.operation,
+		Unknown:    []string{},
+	}
+	if s.Detached {
+		s.HEAD = truncate(v.revision, 7, "")
+	}
+	for _, check := range checkOrder {
+		if v.timedOut[check] || v.skipped[check] || v.pending[check] {
+			s.Unknown = append(s.Unknown, check)
+		}
+	}
+	s.Prompt = plainPrompt(v)
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		debugf("oh-my-posh: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// iterm2 returns an output mode which sets the user variables of iTerm2, for
+// badges, the status bar and the title to show: vcs, vcsBranch (the short
+// commit if HEAD is detached), vcsDirty ("1" if the work tree has changes) and
+// vcsPrompt, the format without colors. They are cleared outside of
+// repositories. With badge, the prompt is set as the badge too. With -ascii,
+// the values are ASCII, like the other outputs. The escape
+// sequences take no room, so they may be printed in the prompt.
+func iterm2(badge bool) func(v vcs) string {
+	return func(v vcs) string {
+		var branch, dirty, text string
+		if v.available {
+			branch = v.branch
+			if branch == "" {
+				branch = truncate(v.revision, 7, "")
+			}
+			if v.isModified {
+				dirty = "1"
+			}
+			text = plainPrompt(v)
+		}
+
+		var b strings.Builder
+		for _, kv := range []keyValue{{"vcs", v.name}, {"vcsBranch", branch}, {"vcsDirty", dirty}, {"vcsPrompt", text}} {
+			if *ascii {
+				kv.value = toASCII(kv.value)
+			}
+			b.WriteString(iterm2Seq("SetUserVar=" + kv.key + "=" + base64.StdEncoding.EncodeToString([]byte(kv.value))))
+		}
+		if badge {
+			// badges interpolate \(...), so backslashes are escaped.
+			text = strings.Replace(text, `\`, `\\`, -1)
+			b.WriteString(iterm2Seq("SetBadgeFormat=" + base64.StdEncoding.EncodeToString([]byte(text))))
+		}
+		return shellModes[*shell].invisible(b.String())
+	}
+}
+
+// iterm2Seq returns the proprietary escape sequence of iTerm2 with the
+// command cmd. In tmux, it is passed through to the terminal, which needs
+// allow-passthrough since tmux 3.3.
+func iterm2Seq(cmd string) string {
+	seq := "\x1b]1337;" + cmd + "\a"
+	if os.Getenv("TMUX") != "" {
+		seq = "\x1bPtmux;" + strings.Replace(seq, "\x1b", "\x1b\x1b", -1) + "\x1b\\"
+	}
+	return seq
+}
+
+// porcelainVersion is printed in the header of the porcelain output, and is
+// incremented on incompatible changes.
+const porcelainVersion = 1
+
+// keyValue is a named field of the machine readable outputs.
+type keyValue struct {
+	key, value string
+}
+
+// fields returns the fields of the machine readable outputs in a fixed order.
+// All of them are empty if there is no repository, and those which are not
+// known within -t are empty too.
+func (v vcs) fields() []keyValue {
+	if !v.available {
+		return []keyValue{
+			{"vcs", ""},
+			{"branch", ""},
+			{"revision", ""},
+			{"dirty", ""},
+			{"ahead", ""},
+			{"behind", ""},
+			{"untracked", ""},
+			{"conflict", ""},
+			{"stash", ""},
+		}
+	}
+
+	flag := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+
+	fields := []keyValue{
+		{"vcs", v.name},
+		{"branch", v.branch},
+		{"revision", v.revision},
+		{"dirty", flag(v.isModified)},
+		{"ahead", strconv.Itoa(v.ahead)},
+		{"behind", strconv.Itoa(v.behind)},
+		{"untracked", flag(v.untracked)},
+		{"conflict", flag(v.conflict)},
+		{"stash", strconv.Itoa(v.stash)},
+	}
+
+	// fields the checks of which timed out, were skipped or are pending are
+	// unknown, and left empty.
+	for i, kv := range fields {
+		check := kv.key
+		if check == "ahead" || check == "behind" {
+			check = "upstream"
+		}
+		if v.timedOut[check] || v.skipped[check] || v.pending[check] {
+			fields[i].value = ""
+		}
+	}
+	return fields
+}
+
+// env renders v as shell variable assignments, to be used with eval. All
+// variables are printed even if there is no repository, so that values from
+// a previous eval are cleared. With -shell powershell, they are assignments
+// of environment variables, for Invoke-Expression, and with -shell cmd, set
+// commands, for "for /f".
+func env(v vcs) string {
+	var buf bytes.Buffer
+	for _, kv := range v.fields() {
+		name := "VCP_" + strings.ToUpper(kv.key)
+		switch *shell {
+		case "powershell":
+			fmt.Fprintf(&buf, "$env:%s = %s\n", name, powershellQuote(kv.value))
+		case "cmd":
+			// cmd takes the value up to the last quote, but quotes in
+			// the value would let the rest of it run as commands, and
+			// cannot be escaped.
+			fmt.Fprintf(&buf, "set \"%s=%s\"\n", name, strings.Replace(kv.value, `"`, "", -1))
+		default:
+			fmt.Fprintf(&buf, "%s=%s;\n", name, shellQuote(kv.value))
+		}
+	}
+	return buf.String()
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// powershellQuote quotes s for PowerShell, which ends single-quoted strings
+// with typographic single quotes too.
+func powershellQuote(s string) string {
+	return "'" + powershellEscape.Replace(s) + "'"
+}
+
+var powershellEscape = strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019", "\u201a", "\u201a\u201a", "\u201b", "\u201b\u201b")
+
+// porcelain renders v as "key<TAB>value" records after a version header. The
+// records end with a newline, and tabs, newlines and backslashes in values
+// are escaped. With -z, they end with NUL and nothing is escaped.
+func porcelain(v vcs) string {
+	end := "\n"
+	escape := strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`).Replace
+	if *nul {
+		end = "\x00"
+		escape = noescape
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "vcprompt-porcelain\t%d%s", porcelainVersion, end)
+	for _, kv := range v.fields() {
+		fmt.Fprintf(&buf, "%s\t%s%s", kv.key, escape(kv.value), end)
+	}
+	return buf.String()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"testing"
+)
+
+func TestITerm2ASCII(t *testing.T) {
+	t.Setenv("TMUX", "")
+	defer func(saved bool) { *ascii = saved }(*ascii)
+	*ascii = true
+
+	v := vcs{available: true, name: "git", branch: "fëature/日本語", isModified: true}
+	seqs := regexp.MustCompile("\x1b]1337;(SetUserVar=[^=]+=|SetBadgeFormat=)([^\a]*)\a").FindAllStringSubmatch(iterm2(true)(v), -1)
+	if len(seqs) != 5 {
+		t.Fatalf("got %d sequences, want 5", len(seqs))
+	}
+	for _, seq := range seqs {
+		value, err := base64.StdEncoding.DecodeString(seq[2])
+		if err != nil {
+			t.Fatalf("%s: %v", seq[1], err)
+		}
+		if s := string(value); s != toASCII(s) {
+			t.Errorf("%s%q is not ASCII", seq[1], s)
+		}
+		if seq[1] == "SetUserVar=vcsBranch=" && string(value) != "f?ature/???" {
+			t.Errorf("vcsBranch = %q", value)
+		}
+	}
+}
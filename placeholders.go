@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// placeholderInfo is the JSON form of a placeholder, printed by "vcprompt
+// placeholders".
+type placeholderInfo struct {
+	Placeholder string          `json:"placeholder"`
+	Description string          `json:"description"`
+	Backends    map[string]bool `json:"backends"` // support by each compiled-in backend
+}
+
+// runPlaceholders prints the placeholders as a JSON array, with the backends
+// which support each of them.
+func runPlaceholders(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt placeholders")
+		return 2
+	}
+
+	infos := make([]placeholderInfo, 0, len(placeholders))
+	for _, p := range placeholders {
+		info := placeholderInfo{
+			Placeholder: "%" + string(p.verb),
+			Description: p.desc,
+			Backends:    map[string]bool{},
+		}
+		for _, name := range keys(backendFuncs) {
+			info.Backends[name] = contains(p.backends, name)
+		}
+		infos = append(infos, info)
+	}
+
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
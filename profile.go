@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	rtrace "runtime/trace"
+	"sync"
+	"syscall"
+)
+
+// -cpuprofile, -memprofile and -trace write profiles of a run, for go tool
+// pprof and go tool trace, so that slow runs in the repositories of users can
+// be looked into with their data.
+
+// profiles are the files profiles are written to, and stopProfiles finishes
+// them once.
+var (
+	profiles     []*os.File
+	profilesOnce sync.Once
+)
+
+// startProfiles starts the profiles of -cpuprofile and -trace. The background
+// runs of -stale, which collect the state, write theirs next to the ones of
+// the foreground run, with a .refresh suffix.
+func startProfiles() error {
+	if *cpuProfile != "" {
+		f, err := createProfile(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("-cpuprofile: %v", err)
+		}
+	}
+	if *traceFile != "" {
+		f, err := createProfile(*traceFile)
+		if err != nil {
+			return err
+		}
+		if err := rtrace.Start(f); err != nil {
+			return fmt.Errorf("-trace: %v", err)
+		}
+	}
+	return nil
+}
+
+// createProfile creates the profile file at path.
+func createProfile(path string) (*os.File, error) {
+	if os.Getenv(staleEnv) != "" {
+		path += ".refresh"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles = append(profiles, f)
+	return f, nil
+}
+
+// stopProfiles stops the profiles of -cpuprofile and -trace, and writes the
+// memory profile of -memprofile.
+func stopProfiles() {
+	profilesOnce.Do(func() {
+		if *cpuProfile != "" {
+			pprof.StopCPUProfile()
+		}
+		if *traceFile != "" {
+			rtrace.Stop()
+		}
+		if *memProfile != "" {
+			if f, err := createProfile(*memProfile); err != nil {
+				fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			} else {
+				// the profile counts the allocations up to the last GC.
+				runtime.GC()
+				if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+					fmt.Fprintf(os.Stderr, "vcprompt: -memprofile: %v\n", err)
+				}
+			}
+		}
+		for _, f := range profiles {
+			if err := f.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+			}
+		}
+	})
+}
+
+// exit stops the profiles and exits with status.
+func exit(status int) {
+	stopProfiles()
+	os.Exit(status)
+}
+
+// stopProfilesOnInterrupt stops the profiles when vcprompt is interrupted, for
+// -w, which runs until then.
+func stopProfilesOnInterrupt() {
+	if *cpuProfile == "" && *memProfile == "" && *traceFile == "" {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		exit(130)
+	}()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The daemon protocol is made of frames: the length of a message as a uvarint,
+// followed by the message. Messages are sequences of uvarints, and of strings
+// prefixed with their length; booleans are packed in the bits of a uvarint. A
+// request starts with protoVersion, and the daemon closes the connection on
+// requests it does not understand, so that vcprompt collects the state itself.
+// A request holds the settings and the directories to collect the state of,
+// so that status bars ask for all of their panes at once; the daemon replies
+// with a frame for each directory, in order.
+
+// protoVersion is the version of the protocol, sent first in requests.
+const protoVersion = 3
+
+// maxFrame bounds the length of the frames which are read.
+const maxFrame = 1 << 20
+
+var errBadFrame = errors.New("bad frame")
+
+// message is a message being encoded.
+type message struct {
+	bytes.Buffer
+}
+
+func (m *message) putUint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	m.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (m *message) putString(s string) {
+	m.putUint(uint64(len(s)))
+	m.WriteString(s)
+}
+
+// putBits puts bs as the bits of a uvarint, the first one lowest.
+func (m *message) putBits(bs ...bool) {
+	var n uint64
+	for i, b := range bs {
+		if b {
+			n |= 1 << uint(i)
+		}
+	}
+	m.putUint(n)
+}
+
+// frameBufs holds the buffers of the frames which were sent, so that the
+// daemon writes its replies from the same memory every time.
+var frameBufs = sync.Pool{New: func() interface{} { return new(message) }}
+
+// send writes m to w as a frame.
+func (m *message) send(w io.Writer) error {
+	frame := frameBufs.Get().(*message)
+	defer func() {
+		frame.Reset()
+		frameBufs.Put(frame)
+	}()
+	frame.putUint(uint64(m.Len()))
+	frame.Write(m.Bytes())
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+// frame is a message being decoded. Its methods return zero values once an
+// error is met, which err holds.
+type frame struct {
+	data []byte
+	err  error
+}
+
+// readFrame reads a frame from r. It returns io.EOF if r ends before it.
+func readFrame(r *bufio.Reader) (*frame, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &frame{data: data}, nil
+}
+
+func (f *frame) uint() uint64 {
+	if f.err != nil {
+		return 0
+	}
+	n, k := binary.Uvarint(f.data)
+	if k <= 0 {
+		f.err = errBadFrame
+		return 0
+	}
+	f.data = f.data[k:]
+	return n
+}
+
+func (f *frame) string() string {
+	n := f.uint()
+	if f.err != nil {
+		return ""
+	}
+	if n > uint64(len(f.data)) {
+		f.err = errBadFrame
+		return ""
+	}
+	s := string(f.data[:n])
+	f.data = f.data[n:]
+	return s
+}
+
+// bits sets bs to the bits of a uvarint, the first one lowest.
+func (f *frame) bits(bs ...*bool) {
+	n := f.uint()
+	for i, b := range bs {
+		*b = n&(1<<uint(i)) != 0
+	}
+}
+
+// done returns the error met while decoding f, if any, or if it is not fully
+// decoded.
+func (f *frame) done() error {
+	if f.err == nil && len(f.data) > 0 {
+		return errBadFrame
+	}
+	return f.err
+}
+
+// encodeRequests encodes rs, which differ only in their directories, as a
+// single request.
+func encodeRequests(rs []daemonRequest) *message {
+	var m message
+	m.putUint(protoVersion)
+	r := rs[0]
+	m.putBits(r.NoDirty, r.NoUntracked, r.NoAheadBehind, r.Render, r.Adaptive)
+	m.putUint(uint64(r.Timeout))
+	m.putUint(uint64(r.SkipSlow))
+	m.putUint(uint64(len(rs)))
+	for _, r := range rs {
+		m.putString(r.Dir)
+	}
+	m.putString(r.Format)
+	m.putString(r.Backends)
+	return &m
+}
+
+func decodeRequests(f *frame) ([]daemonRequest, error) {
+	var r daemonRequest
+	if v := f.uint(); f.err == nil && v != protoVersion {
+		return nil, fmt.Errorf("protocol version %d, want %d", v, protoVersion)
+	}
+	f.bits(&r.NoDirty, &r.NoUntracked, &r.NoAheadBehind, &r.Render, &r.Adaptive)
+	r.Timeout = time.Duration(f.uint())
+	r.SkipSlow = time.Duration(f.uint())
+	var dirs []string
+	for n := f.uint(); n > 0 && f.err == nil; n-- {
+		dirs = append(dirs, f.string())
+	}
+	r.Format = f.string()
+	r.Backends = f.string()
+	if err := f.done(); err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("request without directories")
+	}
+	rs := make([]daemonRequest, len(dirs))
+	for i, dir := range dirs {
+		rs[i] = r
+		rs[i].Dir = dir
+	}
+	return rs, nil
+}
+
+func (w wireState) encode() *message {
+	var m message
+	m.putBits(w.Available, w.Modified, w.Untracked, w.Conflict)
+	m.putString(w.Name)
+	m.putString(w.Branch)
+	m.putString(w.Revision)
+	m.putUint(uint64(w.Ahead))
+	m.putUint(uint64(w.Behind))
+	m.putUint(uint64(w.Stash))
+	m.putString(w.Operation)
+	m.putUint(uint64(len(w.TimedOut)))
+	for _, name := range w.TimedOut {
+		m.putString(name)
+	}
+	m.putUint(uint64(len(w.Skipped)))
+	for _, name := range w.Skipped {
+		m.putString(name)
+	}
+	m.putString(w.Prompt)
+	return &m
+}
+
+func decodeState(f *frame) (wireState, error) {
+	var w wireState
+	f.bits(&w.Available, &w.Modified, &w.Untracked, &w.Conflict)
+	w.Name = f.string()
+	w.Branch = f.string()
+	w.Revision = f.string()
+	w.Ahead = int(f.uint())
+	w.Behind = int(f.uint())
+	w.Stash = int(f.uint())
+	w.Operation = f.string()
+	for n := f.uint(); n > 0 && f.err == nil; n-- {
+		w.TimedOut = append(w.TimedOut, f.string())
+	}
+	for n := f.uint(); n > 0 && f.err == nil; n-- {
+		w.Skipped = append(w.Skipped, f.string())
+	}
+	w.Prompt = f.string()
+	return w, f.done()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// frameOf returns the frame m is sent as.
+func frameOf(t *testing.T, m *message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.send(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readFrameOf reads the frame in data.
+func readFrameOf(data []byte) (*frame, error) {
+	return readFrame(bufio.NewReader(bytes.NewReader(data)))
+}
+
+func TestRequestsRoundTrip(t *testing.T) {
+	r := daemonRequest{
+		Format:        "%b%m%u %{name}",
+		Backends:      "git,gogit",
+		NoDirty:       true,
+		NoAheadBehind: true,
+		Render:        true,
+		Timeout:       150 * time.Millisecond,
+		SkipSlow:      time.Second,
+	}
+	var rs []daemonRequest
+	for _, dir := range []string{"/a", "/b c", "/ü/\x00"} {
+		r.Dir = dir
+		rs = append(rs, r)
+	}
+	f, err := readFrameOf(frameOf(t, encodeRequests(rs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeRequests(f)
+	if err != nil || !reflect.DeepEqual(got, rs) {
+		t.Errorf("got %+v, %v; want %+v", got, err, rs)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	for _, w := range []wireState{
+		{},
+		{Available: true, Name: "git", Branch: "main", Revision: "abc123", Modified: true, Conflict: true, Ahead: 3, Behind: 1 << 40, Stash: 2, Operation: "rebase", TimedOut: []string{"dirty"}, Skipped: []string{"untracked", "upstream"}, Prompt: "main+"},
+	} {
+		f, err := readFrameOf(frameOf(t, w.encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeState(f)
+		if err != nil || !reflect.DeepEqual(got, w) {
+			t.Errorf("got %+v, %v; want %+v", got, err, w)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	var big [binary.MaxVarintLen64]byte
+	tests := []struct {
+		name string
+		data []byte
+		err  bool
+	}{
+		{"empty frame", []byte{0}, false},
+		{"largest frame", append(big[:binary.PutUvarint(big[:], maxFrame)], make([]byte, maxFrame)...), false},
+		{"oversized length", big[:binary.PutUvarint(big[:], maxFrame+1)], true},
+		{"huge length", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, true},
+		{"overflowing varint", bytes.Repeat([]byte{0xff}, 11), true},
+		{"truncated varint", []byte{0x80}, true},
+		{"truncated body", []byte{5, 'a', 'b'}, true},
+	}
+	for _, tt := range tests {
+		_, err := readFrameOf(tt.data)
+		if err == io.EOF || (err != nil) != tt.err {
+			t.Errorf("%s: %v, want an error: %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := readFrameOf(nil); err != io.EOF {
+		t.Errorf("no frame: %v, want io.EOF", err)
+	}
+}
+
+func TestDecodeRequestsMalformed(t *testing.T) {
+	rs := []daemonRequest{{Dir: "/repo", Format: "%b", Backends: "git"}}
+	good := encodeRequests(rs).Bytes()
+
+	encoded := func(fn func(m *message)) []byte {
+		var m message
+		fn(&m)
+		return m.Bytes()
+	}
+	tests := map[string][]byte{
+		"empty":          nil,
+		"wrong version":  append(encoded(func(m *message) { m.putUint(protoVersion + 1) }), good[1:]...),
+		"trailing bytes": append(append([]byte(nil), good...), 0),
+		"no directories": encoded(func(m *message) {
+			m.putUint(protoVersion)
+			m.putBits()
+			m.putUint(0)
+			m.putUint(0)
+			m.putUint(0)
+			m.putString("")
+			m.putString("")
+		}),
+		"string too long": encoded(func(m *message) {
+			m.putUint(protoVersion)
+			m.putBits()
+			m.putUint(0)
+			m.putUint(0)
+			m.putUint(1)
+			m.putUint(1000)
+			m.WriteString("/x")
+		}),
+		"huge count": encoded(func(m *message) {
+			m.putUint(protoVersion)
+			m.putBits()
+			m.putUint(0)
+			m.putUint(0)
+			m.putUint(1 << 62)
+		}),
+		"truncated varint": encoded(func(m *message) {
+			m.putUint(protoVersion)
+			m.WriteByte(0x80)
+		}),
+	}
+	for n := 0; n < len(good); n++ {
+		tests[fmt.Sprintf("truncated to %d bytes", n)] = good[:n]
+	}
+	for name, data := range tests {
+		if rs, err := decodeRequests(&frame{data: data}); err == nil {
+			t.Errorf("%s: no error, got %+v", name, rs)
+		}
+	}
+}
+
+func TestDecodeStateMalformed(t *testing.T) {
+	good := wireState{Available: true, Name: "git", Branch: "main", TimedOut: []string{"dirty"}, Prompt: "main"}.encode().Bytes()
+	for n := 0; n < len(good); n++ {
+		if w, err := decodeState(&frame{data: good[:n]}); err == nil {
+			t.Errorf("truncated to %d bytes: no error, got %+v", n, w)
+		}
+	}
+	if _, err := decodeState(&frame{data: append(append([]byte(nil), good...), 1)}); err == nil {
+		t.Error("trailing bytes: no error")
+	}
+}
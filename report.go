@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// report prints the output for each of the directories in args, one line each.
+// Repository config files are not read, but excluded paths are skipped. It
+// returns the exit status.
+func report(args []string) int {
+	if err := configure(""); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	// the daemon is asked for the states of all the paths at once.
+	state := collect
+	if askDaemon() && len(args) > 1 {
+		state = queryDaemonPaths(args)
+	}
+
+	status := 0
+	for _, arg := range args {
+		if st := reportPath(arg, state); st > status {
+			status = st
+		}
+	}
+	return status
+}
+
+// reportStdin is like report, for the paths read from r, which are separated
+// by newlines or NUL. Output is printed as soon as each path is read.
+func reportStdin(r io.Reader) int {
+	if err := configure(""); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanPaths)
+
+	status := 0
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		if st := reportPath(scanner.Text(), collect); st > status {
+			status = st
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	return status
+}
+
+// scanPaths is a bufio.SplitFunc for paths separated by newlines or NUL.
+func scanPaths(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\n\x00"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// queryDaemonPaths asks the daemon for the states of the directories args at
+// once, and returns the function which reportPath gets them with: from the
+// answer of the daemon, or collected without it if it did not answer.
+func queryDaemonPaths(args []string) func(dir string) vcs {
+	var dirs []string
+	for _, arg := range args {
+		if dir, err := targetDir(arg); err == nil {
+			if excluded, err := isExcluded(dir); err == nil && !excluded {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return collect
+	}
+	vs, ok := queryDaemon(dirs...)
+	if !ok {
+		return collectLocal
+	}
+	states := map[string]vcs{}
+	for i, dir := range dirs {
+		states[dir] = vs[i]
+	}
+	return func(dir string) vcs {
+		if v, ok := states[dir]; ok {
+			return v
+		}
+		return collectLocal(dir)
+	}
+}
+
+// reportPath prints the output for the directory arg, with its state from
+// state, and returns the exit status.
+func reportPath(arg string, state func(dir string) vcs) int {
+	dir, err := targetDir(arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	excluded, err := isExcluded(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+
+	var v vcs
+	if !excluded {
+		v = state(dir)
+	}
+	if strictFailed() {
+		return 2
+	}
+
+	out := outputs[*output](v)
+	if !strings.HasSuffix(out, recordEnd()) {
+		out += "\n"
+	}
+	if *withPath {
+		out = prefixLines(out, arg)
+	}
+	fmt.Fprint(stdout, out)
+	return 0
+}
+
+// recordEnd returns the string which ends lines of the output.
+func recordEnd() string {
+	if *nul && *output == "porcelain" {
+		return "\x00"
+	}
+	return "\n"
+}
+
+// prefixLines puts path and a tab before each line of out.
+func prefixLines(out, path string) string {
+	end := recordEnd()
+	trailing := strings.HasSuffix(out, end)
+
+	lines := strings.Split(strings.TrimSuffix(out, end), end)
+	for i := range lines {
+		lines[i] = path + "\t" + lines[i]
+	}
+
+	out = strings.Join(lines, end)
+	if trailing {
+		out += end
+	}
+	return out
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// "vcprompt rpc" serves JSON-RPC 2.0 on stdin and stdout, for the statusline
+// plugins of editors: messages are framed with a Content-Length header, as in
+// the language server protocol, so that the clients of vim, neovim and VS
+// Code can talk to it. The methods are:
+//
+//	vcs/status {"path", "format"}: the status of the repository containing path
+//	vcs/subscribe {"path", "format"}: the same, and a vcs/didChange
+//		notification with the new status each time it changes
+//	vcs/unsubscribe {"path", "format"}: no more notifications
+//
+// along with initialize, shutdown and exit for LSP clients. The status is the
+// state, as in the wire format of the daemon, and the prompt of format,
+// without colors.
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+// rpcRequest is a request or a notification, which has no ID.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcError is the error of a response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcParams are the params of the vcs/ methods.
+type rpcParams struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+}
+
+// rpcStatus is the status of a repository, as sent to clients.
+type rpcStatus struct {
+	Path string `json:"path"`
+	wireState
+	Prompt string `json:"prompt"`
+}
+
+// rpcServer answers the requests read from in on out.
+type rpcServer struct {
+	format string // -f, for requests without a format
+
+	collectMu sync.Mutex // the flags are shared by all collections
+
+	outMu sync.Mutex
+	out   io.Writer
+
+	subsMu sync.Mutex
+	subs   map[rpcParams]chan struct{} // closed to unsubscribe
+}
+
+// runRPC runs "vcprompt rpc".
+func runRPC(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt rpc")
+		return 2
+	}
+	if err := configure(""); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 2
+	}
+	// editors color the statusline themselves.
+	*colorMode = "never"
+
+	s := &rpcServer{format: *format, out: os.Stdout, subs: map[rpcParams]chan struct{}{}}
+	defer s.unsubscribeAll()
+	in := bufio.NewReader(os.Stdin)
+	for {
+		body, err := readRPC(in)
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: rpc: %v\n", err)
+			return 1
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(nil, nil, &rpcError{rpcParseError, err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			return 0
+		}
+		if req.Method == "" {
+			s.reply(req.ID, nil, &rpcError{rpcInvalidRequest, "no method"})
+			continue
+		}
+		result, rerr := s.handle(req)
+		if req.ID != nil {
+			s.reply(req.ID, result, rerr)
+		}
+	}
+}
+
+// readRPC reads the body of the next message from r.
+func readRPC(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err == io.EOF {
+		// the input ends within the header of a message.
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 || n > maxFrame {
+		return nil, fmt.Errorf("bad Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// send writes the message v to the client.
+func (s *rpcServer) send(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		debugf("rpc: %v", err)
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(body))
+	buf.Write(body)
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if _, err := s.out.Write(buf.Bytes()); err != nil {
+		debugf("rpc: %v", err)
+	}
+}
+
+// reply sends the response to the request id: its result, or err.
+func (s *rpcServer) reply(id json.RawMessage, result interface{}, err *rpcError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		resp["error"] = err
+	} else {
+		resp["result"] = result
+	}
+	s.send(resp)
+}
+
+// handle runs the request req, and returns its result.
+func (s *rpcServer) handle(req rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{},
+			"serverInfo":   map[string]string{"name": "vcprompt", "version": buildVersion()},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		s.unsubscribeAll()
+		return nil, nil
+	case "vcs/status", "vcs/subscribe", "vcs/unsubscribe":
+	default:
+		return nil, &rpcError{rpcMethodNotFound, "unknown method " + req.Method}
+	}
+
+	var p rpcParams
+	if err := json.Unmarshal(req.Params, &p); err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	if !filepath.IsAbs(p.Path) {
+		return nil, &rpcError{rpcInvalidParams, "path is not absolute"}
+	}
+	p.Path = filepath.Clean(p.Path)
+	if p.Format == "" {
+		p.Format = s.format
+	}
+	switch req.Method {
+	case "vcs/subscribe":
+		return s.subscribe(p), nil
+	case "vcs/unsubscribe":
+		s.unsubscribe(p)
+		return nil, nil
+	}
+	return s.status(p), nil
+}
+
+// status returns the status of the repository containing p.Path.
+func (s *rpcServer) status(p rpcParams) rpcStatus {
+	s.collectMu.Lock()
+	defer s.collectMu.Unlock()
+	*format = p.Format
+	var v vcs
+	if excluded, err := isExcluded(p.Path); err == nil && !excluded {
+		v = collect(p.Path)
+	}
+	// the errors were logged, and are not kept for as long as the server runs.
+	collectErrorsMu.Lock()
+	collectErrors = nil
+	collectErrorsMu.Unlock()
+	return rpcStatus{Path: p.Path, wireState: v.wire(), Prompt: v.String()}
+}
+
+// subscribe returns the status of p, and sends a vcs/didChange notification
+// with it each time it changes: as soon as the files of its repository change
+// where they can be watched, and every defaultWatchInterval. The repository is
+// watched before the status is collected, so that no change is missed.
+func (s *rpcServer) subscribe(p rpcParams) rpcStatus {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if _, ok := s.subs[p]; ok {
+		return s.status(p)
+	}
+
+	var w *fsWatcher
+	var changed chan struct{}
+	if root, _ := probeWithin(p.Path); root != "" {
+		var err error
+		if w, err = watchRepo(root); err != nil {
+			debugf("rpc: %v", err)
+		} else {
+			changed = w.changed
+		}
+	}
+	st := s.status(p)
+	stop := make(chan struct{})
+	s.subs[p] = stop
+
+	go func() {
+		if w != nil {
+			defer w.Close()
+		}
+		last, _ := json.Marshal(st)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-changed:
+			case <-time.After(defaultWatchInterval):
+			}
+			st := s.status(p)
+			data, _ := json.Marshal(st)
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.send(map[string]interface{}{"jsonrpc": "2.0", "method": "vcs/didChange", "params": st})
+		}
+	}()
+	return st
+}
+
+// unsubscribe stops the notifications of p.
+func (s *rpcServer) unsubscribe(p rpcParams) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if stop, ok := s.subs[p]; ok {
+		close(stop)
+		delete(s.subs, p)
+	}
+}
+
+// unsubscribeAll stops all of the notifications.
+func (s *rpcServer) unsubscribeAll() {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	for p, stop := range s.subs {
+		close(stop)
+		delete(s.subs, p)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadRPC(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		body  string
+		err   bool
+	}{
+		{"message", "Content-Length: 2\r\n\r\n{}", "{}", false},
+		{"lower case", "content-length: 2\r\n\r\n{}", "{}", false},
+		{"other headers", "Content-Type: application/vscode-jsonrpc; charset=utf-8\r\nContent-Length: 4\r\n\r\nnull", "null", false},
+		{"spaces", "Content-Length:   2  \r\n\r\n[]", "[]", false},
+		{"bare newlines", "Content-Length: 2\n\n{}", "{}", false},
+		{"empty body", "Content-Length: 0\r\n\r\n", "", false},
+		{"no length", "Content-Type: x\r\n\r\n{}", "", true},
+		{"negative length", "Content-Length: -1\r\n\r\n", "", true},
+		{"bad length", "Content-Length: 2x\r\n\r\n{}", "", true},
+		{"huge length", "Content-Length: 99999999999999999999\r\n\r\n", "", true},
+		{"oversized length", "Content-Length: 1048577\r\n\r\n", "", true},
+		{"truncated body", "Content-Length: 10\r\n\r\n{}", "", true},
+		{"truncated header", "Content-Length: 2", "", true},
+		{"bad header", "Content-Length 2\r\n\r\n{}", "", true},
+	}
+	for _, tt := range tests {
+		body, err := readRPC(bufio.NewReader(strings.NewReader(tt.input)))
+		if err == io.EOF || (err != nil) != tt.err || string(body) != tt.body {
+			t.Errorf("%s: %q, %v; want %q, an error: %v", tt.name, body, err, tt.body, tt.err)
+		}
+	}
+
+	// messages follow each other, up to the end of the input.
+	r := bufio.NewReader(strings.NewReader("Content-Length: 1\r\n\r\n1Content-Length: 1\r\n\r\n2"))
+	for _, want := range []string{"1", "2"} {
+		if body, err := readRPC(r); err != nil || string(body) != want {
+			t.Errorf("got %q, %v; want %q", body, err, want)
+		}
+	}
+	if _, err := readRPC(r); err != io.EOF {
+		t.Errorf("at the end: %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The branch names and the other values vcprompt prints come from the
+// repository, which may be hostile: git refuses control characters in the
+// names of refs, but .git/HEAD is read as it is, so that a clone could set the
+// branch to escape sequences which take over the terminal. Such values are
+// made printable as soon as they are collected, or read from the daemon and
+// the cache, before any output sees them.
+
+// printable returns s with its control characters, including newlines and the
+// C1 controls, its bidirectional embeddings, overrides and isolates, and its
+// invalid UTF-8 each replaced with U+FFFD.
+func printable(s string) string {
+	if utf8.ValidString(s) && strings.IndexFunc(s, unprintable) < 0 {
+		return s
+	}
+	// Map turns invalid UTF-8 into RuneError too.
+	return strings.Map(func(r rune) rune {
+		if unprintable(r) {
+			return utf8.RuneError
+		}
+		return r
+	}, s)
+}
+
+// unprintable reports whether r is left out of printable strings.
+func unprintable(r rune) bool {
+	return unicode.IsControl(r) || r >= '\u202a' && r <= '\u202e' || r >= '\u2066' && r <= '\u2069'
+}
+
+// sanitized returns v with the values from the repository, or from the
+// daemon, made printable.
+func (v vcs) sanitized() vcs {
+	v.name = printable(v.name)
+	v.branch = printable(v.branch)
+	v.revision = printable(v.revision)
+	v.operation = printable(v.operation)
+	v.prompt = printable(v.prompt)
+	return v
+}
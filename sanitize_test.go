@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// hostile are values a repository could hold: escape sequences, newlines and
+// bidirectional overrides.
+var hostile = map[string]string{
+	"esc":     "a\x1b]2;owned\ab",
+	"csi":     "a\u009b2Jb",
+	"newline": "a\nb",
+	"bidi":    "a\u202eb",
+	"isolate": "a\u2067b",
+	"invalid": "a\xffb",
+}
+
+// checkPrintable fails t if what holds anything printable leaves out.
+func checkPrintable(t *testing.T, what, s string) {
+	t.Helper()
+	if !utf8.ValidString(s) || strings.IndexFunc(s, unprintable) >= 0 {
+		t.Errorf("%s: %q is not printable", what, s)
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	want := map[string]string{
+		"esc":     "a�]2;owned�b",
+		"csi":     "a�2Jb",
+		"newline": "a�b",
+		"bidi":    "a�b",
+		"isolate": "a�b",
+		"invalid": "a�b",
+	}
+	for name, s := range hostile {
+		if got := printable(s); got != want[name] {
+			t.Errorf("%s: printable(%q) = %q, want %q", name, s, got, want[name])
+		}
+	}
+	for _, s := range []string{"main", "feature/日本語", "café", "🚀 launch"} {
+		if got := printable(s); got != s {
+			t.Errorf("printable(%q) = %q", s, got)
+		}
+	}
+}
+
+func TestSanitized(t *testing.T) {
+	for name, s := range hostile {
+		v := vcs{available: true, name: s, branch: s, revision: s, operation: s, prompt: s}.sanitized()
+		for field, value := range map[string]string{"name": v.name, "branch": v.branch, "revision": v.revision, "operation": v.operation, "prompt": v.prompt} {
+			checkPrintable(t, name+" "+field, value)
+		}
+	}
+}
+
+func TestWireSanitized(t *testing.T) {
+	for name, s := range hostile {
+		v := wireState{Available: true, Name: s, Branch: s, Revision: s, Operation: s, Prompt: s}.vcs()
+		for field, value := range map[string]string{"name": v.name, "branch": v.branch, "revision": v.revision, "operation": v.operation, "prompt": v.prompt} {
+			checkPrintable(t, name+" daemon "+field, value)
+		}
+	}
+}
+
+func TestRepositoryNameSanitized(t *testing.T) {
+	for name, s := range hostile {
+		value, _ := vcs{available: true, root: "/src/" + s}.field('R')
+		checkPrintable(t, name+" %R", value)
+	}
+}
+
+func TestGitstatusdSanitized(t *testing.T) {
+	// the remote URL and the upstream come from the git config, and the
+	// summary of commit messages is not sent.
+	for name, s := range hostile {
+		checkPrintable(t, name+" remote URL", gitstatusdClean("https://example.com/"+s))
+	}
+	if got := gitstatusdClean("a" + gitstatusdField + "b" + string(gitstatusdRecord)); strings.ContainsAny(got, gitstatusdField+string(gitstatusdRecord)) {
+		t.Errorf("gitstatusdClean kept the separators: %q", got)
+	}
+}
+
+func TestRepoConfigSanitized(t *testing.T) {
+	for name, s := range hostile {
+		for _, key := range []string{"format", "prefix", "suffix", "ellipsis", "title-format", "symbols.dirty"} {
+			if err := checkRepoConfig(config{key: s}, ".vcprompt"); err == nil {
+				t.Errorf("%s: repository config accepts %s = %q", name, key, s)
+			}
+		}
+		if err := checkRepoConfig(config{"narrow": []interface{}{"80:" + s}}, ".vcprompt"); err == nil {
+			t.Errorf("%s: repository config accepts narrow = %q", name, s)
+		}
+	}
+	for _, key := range []string{"shell", "output"} {
+		if err := checkRepoConfig(config{key: ""}, ".vcprompt"); err == nil {
+			t.Errorf("repository config accepts %s", key)
+		}
+	}
+	if err := checkRepoConfig(config{"format": "%b%m", "symbols.dirty": "±"}, ".vcprompt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCommandSanitized(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil || !canExec {
+		t.Skip("no sh")
+	}
+	out := vcs{available: true, root: t.TempDir()}.command(`printf 'a\033[2Jb\n\342\200\256c\tb'`)
+	checkPrintable(t, "command output", out)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releasesURL is the GitHub API endpoint of the vcprompt releases. Each release
+// holds a binary per platform, named as by releaseAsset, and their SHA-256
+// checksums in checksumsAsset, in the format of sha256sum.
+const releasesURL = "https://api.github.com/repos/igungor/vcprompt/releases"
+
+const checksumsAsset = "checksums.txt"
+
+// releaseAsset returns the name of the binary for this platform in releases.
+func releaseAsset() string {
+	name := "vcprompt_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// release is a GitHub release, as returned by the API.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the asset name of r.
+func (r release) assetURL(name string) (string, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no %s", r.Tag, name)
+}
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// fetch returns the body of the response to a GET of url.
+func fetch(url string) ([]byte, error) {
+	assertOffline("downloading "+url, true)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "vcprompt/"+buildVersion())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchRelease returns the release tag, or the latest one if tag is empty.
+func fetchRelease(tag string) (release, error) {
+	url := releasesURL + "/latest"
+	if tag != "" {
+		url = releasesURL + "/tags/" + tag
+	}
+	var r release
+	data, err := fetch(url)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("%s: %v", url, err)
+	}
+	return r, nil
+}
+
+// checksum returns the checksum of the file name in the sha256sum output
+// data.
+func checksum(data []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// binary files are marked with a "*" before the name.
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in %s", name, checksumsAsset)
+}
+
+// replaceExecutable replaces the running binary with data. The new binary is
+// written next to it and renamed over it, so that a failure leaves the old one
+// in place. Windows does not let the file of a running program be replaced,
+// but lets it be renamed, so there the old binary is moved to exe.old first,
+// which the next update removes.
+func replaceExecutable(data []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".vcprompt-update-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" {
+		return exe, os.Rename(f.Name(), exe)
+	}
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return "", err
+	}
+	return exe, nil
+}
+
+// compareVersions compares the semantic versions a and b, with or without a
+// leading "v", and returns -1, 0 or +1 as a is older, the same or newer. It
+// reports false if either is not a version.
+func compareVersions(a, b string) (int, bool) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < 3; i++ {
+		if va.core[i] != vb.core[i] {
+			return compareInts(va.core[i], vb.core[i]), true
+		}
+	}
+
+	// releases come after their pre-releases, whose dot-separated fields
+	// compare as numbers, or as text after all numbers.
+	switch {
+	case va.pre == nil && vb.pre == nil:
+		return 0, true
+	case va.pre == nil:
+		return 1, true
+	case vb.pre == nil:
+		return -1, true
+	}
+	for i := 0; i < len(va.pre) && i < len(vb.pre); i++ {
+		x, y := va.pre[i], vb.pre[i]
+		if x == y {
+			continue
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil:
+			return compareInts(nx, ny), true
+		case errx == nil:
+			return -1, true
+		case erry == nil:
+			return 1, true
+		}
+		return strings.Compare(x, y), true
+	}
+	return compareInts(len(va.pre), len(vb.pre)), true
+}
+
+// semver is a parsed semantic version.
+type semver struct {
+	core [3]int
+	pre  []string
+}
+
+// parseVersion parses the semantic version v. The build metadata after "+" is
+// dropped, and missing minor and patch numbers are 0.
+func parseVersion(v string) (semver, bool) {
+	var sv semver
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		sv.pre = strings.Split(v[i+1:], ".")
+		v = v[:i]
+		for _, f := range sv.pre {
+			if f == "" {
+				return sv, false
+			}
+		}
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return sv, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return sv, false
+		}
+		sv.core[i] = n
+	}
+	return sv, true
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// runSelfUpdate replaces vcprompt with the latest release, or the one given
+// with -version, after checking its checksum, as in "vcprompt self-update".
+// The latest release only replaces older versions; downgrades and builds
+// without a version need -version.
+func runSelfUpdate(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	check := fs.Bool("check", false, "only tell whether a newer release is available")
+	tag := fs.String("version", "", "install the release `tag` instead of the latest one")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt self-update [-check] [-version tag]")
+		return 2
+	}
+
+	r, err := fetchRelease(*tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	current := buildVersion()
+	if r.Tag == current {
+		fmt.Printf("vcprompt %s is up to date\n", current)
+		return 0
+	}
+	if *tag == "" {
+		cmp, ok := compareVersions(r.Tag, current)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "vcprompt: cannot compare version %s with the latest release %s; install it with -version %s\n", current, r.Tag, r.Tag)
+			return 1
+		}
+		if cmp <= 0 {
+			fmt.Printf("vcprompt %s is up to date (the latest release is %s)\n", current, r.Tag)
+			return 0
+		}
+	}
+	if *check {
+		fmt.Printf("vcprompt %s is available (this is %s)\n", r.Tag, current)
+		return 0
+	}
+
+	if err := update(r); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	fmt.Printf("updated vcprompt from %s to %s\n", current, r.Tag)
+	return 0
+}
+
+// update downloads the binary of r for this platform, checks it against the
+// checksums of r, and replaces the running binary with it.
+func update(r release) error {
+	binURL, err := r.assetURL(releaseAsset())
+	if err != nil {
+		return err
+	}
+	sumsURL, err := r.assetURL(checksumsAsset)
+	if err != nil {
+		return err
+	}
+
+	sums, err := fetch(sumsURL)
+	if err != nil {
+		return err
+	}
+	want, err := checksum(sums, releaseAsset())
+	if err != nil {
+		return err
+	}
+
+	data, err := fetch(binURL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("%s: checksum mismatch: got %s, want %s", releaseAsset(), got, want)
+	}
+
+	exe, err := replaceExecutable(data)
+	if err != nil {
+		return err
+	}
+	debugf("self-update: replaced %s", exe)
+	return nil
+}
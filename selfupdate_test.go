@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"v1.2.3", "v1.2.3", 0, true},
+		{"1.2.3", "v1.2.3", 0, true},
+		{"v1.2.4", "v1.2.3", 1, true},
+		{"v1.10.0", "v1.9.0", 1, true},
+		{"v2.0.0", "v10.0.0", -1, true},
+		{"v1.2", "v1.2.0", 0, true},
+		{"v1.2.3+build.5", "v1.2.3", 0, true},
+		{"v1.2.3-rc.1", "v1.2.3", -1, true},
+		{"v1.2.3", "v1.2.3-rc.1", 1, true},
+		{"v1.2.3-rc.2", "v1.2.3-rc.10", -1, true},
+		{"v1.2.3-alpha", "v1.2.3-alpha.1", -1, true},
+		{"v1.2.3-1", "v1.2.3-alpha", -1, true},
+		{"v1.2.3-beta", "v1.2.3-alpha", 1, true},
+		{"v0.0.0-20240101000000-abcdef123456", "v0.1.0", -1, true},
+		{"dev", "v1.0.0", 0, false},
+		{"v1.0.0", "", 0, false},
+		{"v1.2.3.4", "v1.0.0", 0, false},
+		{"v1..3", "v1.0.0", 0, false},
+		{"v1.2.3-", "v1.0.0", 0, false},
+		{"v1.2.3-a..b", "v1.0.0", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := compareVersions(tt.a, tt.b); got != tt.want || ok != tt.ok {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
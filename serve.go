@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// "vcprompt serve" runs a daemon which collects the state of repositories for
+// the other vcprompt processes, and keeps it for a while, so that prompts in
+// huge repositories do not wait for git every time. vcprompt sends it a
+// daemonRequest, and it replies with a wireState, each encoded as a frame: see
+// message.
+
+// daemonDialTimeout bounds the time vcprompt waits for the daemon before it
+// collects the state itself, if -t is not set.
+const daemonDialTimeout = 100 * time.Millisecond
+
+// daemonIdle is the time after which a daemon started by -daemon exits if no
+// request came.
+const daemonIdle = 10 * time.Minute
+
+// inDaemon is set in the daemon, which collects the state itself.
+var inDaemon bool
+
+// socketPath returns the path of the socket of the daemon.
+func socketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "vcprompt-"+strconv.Itoa(os.Getuid()))
+	} else {
+		dir = filepath.Join(dir, "vcprompt")
+	}
+	return filepath.Join(dir, "serve.sock")
+}
+
+// checkSocketDir reports an error unless dir, the directory of the socket, is
+// a directory of the user with mode 0700, and not a symbolic link, so that
+// other users can neither listen in place of the daemon nor replace its
+// socket.
+func checkSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return checkPrivate(dir, fi)
+}
+
+// daemonRequest asks the daemon for the state of the repository containing Dir.
+// It carries the settings which change how the state is collected, and asks
+// for the prompt of Format too if Render is set.
+type daemonRequest struct {
+	Dir           string
+	Format        string
+	Backends      string
+	NoDirty       bool
+	NoUntracked   bool
+	NoAheadBehind bool
+	Render        bool
+	Adaptive      bool
+	Timeout       time.Duration
+	SkipSlow      time.Duration
+}
+
+// newDaemonRequest returns the request for dir with the current settings, and
+// without the checks which are not needed. The prompt is asked for if the
+// daemon renders it as vcprompt would.
+func newDaemonRequest(dir string) daemonRequest {
+	return daemonRequest{
+		Dir:           dir,
+		Format:        *format,
+		Backends:      *backends,
+		NoDirty:       !needed("dirty", noDirty),
+		NoUntracked:   !needed("untracked", noUntrack),
+		NoAheadBehind: !needed("upstream", noUpstream),
+		Render:        plainRender(),
+		Adaptive:      *adaptive,
+		Timeout:       *timeout,
+		SkipSlow:      *skipSlow,
+	}
+}
+
+// options returns the options the state is collected with for r.
+func (r daemonRequest) options() collectOptions {
+	return collectOptions{
+		backends:      r.Backends,
+		noDirty:       r.NoDirty,
+		noUntracked:   r.NoUntracked,
+		noAheadBehind: r.NoAheadBehind,
+		adaptive:      r.Adaptive,
+		timeout:       r.Timeout,
+		skipSlow:      r.SkipSlow,
+	}
+}
+
+// renderFlags are the flags which change the rendering of the format.
+var renderFlags = []string{"o", "shell", "ellipsis", "unknown-escape", "rprompt", "prefix", "suffix", "newline", "print-width", "ascii"}
+
+// plainRender reports whether the prompt is rendered with the default settings
+// but the format, without colors, as the daemon renders it.
+func plainRender() bool {
+	// commands run where their output is shown, and the prompts of the
+	// daemon are made printable, which formats with control characters are
+	// not.
+	if useColor() || symbolsSource != "default" || lintFormat(*format).commands || printable(*format) != *format {
+		return false
+	}
+	names := append([]string(nil), renderFlags...)
+	for _, name := range symbolNames {
+		names = append(names, "symbol-"+name)
+	}
+	for _, name := range names {
+		if f := flag.Lookup(name); f.Value.String() != f.DefValue {
+			return false
+		}
+	}
+	return true
+}
+
+// wireState is the state of a repository as sent by the daemon.
+type wireState struct {
+	Available bool     `json:"available"`
+	Name      string   `json:"name,omitempty"`
+	Branch    string   `json:"branch,omitempty"`
+	Revision  string   `json:"revision,omitempty"`
+	Modified  bool     `json:"modified,omitempty"`
+	Untracked bool     `json:"untracked,omitempty"`
+	Conflict  bool     `json:"conflict,omitempty"`
+	Ahead     int      `json:"ahead,omitempty"`
+	Behind    int      `json:"behind,omitempty"`
+	Stash     int      `json:"stash,omitempty"`
+	Operation string   `json:"operation,omitempty"`
+	TimedOut  []string `json:"timed_out,omitempty"`
+	Skipped   []string `json:"skipped,omitempty"`
+	Prompt    string   `json:"-"` // rendered by the daemon, if asked
+}
+
+func (v vcs) wire() wireState {
+	w := wireState{
+		Available: v.available,
+		Name:      v.name,
+		Branch:    v.branch,
+		Revision:  v.revision,
+		Modified:  v.isModified,
+		Untracked: v.untracked,
+		Conflict:  v.conflict,
+		Ahead:     v.ahead,
+		Behind:    v.behind,
+		Stash:     v.stash,
+		Operation: v.operation,
+		Prompt:    v.prompt,
+	}
+	for name := range v.timedOut {
+		w.TimedOut = append(w.TimedOut, name)
+	}
+	for name := range v.skipped {
+		w.Skipped = append(w.Skipped, name)
+	}
+	return w
+}
+
+// vcs returns the state w, made printable.
+func (w wireState) vcs() vcs {
+	v := vcs{
+		available:  w.Available,
+		name:       w.Name,
+		branch:     w.Branch,
+		revision:   w.Revision,
+		isModified: w.Modified,
+		untracked:  w.Untracked,
+		conflict:   w.Conflict,
+		ahead:      w.Ahead,
+		behind:     w.Behind,
+		stash:      w.Stash,
+		operation:  w.Operation,
+		prompt:     w.Prompt,
+	}
+	for _, name := range w.TimedOut {
+		if v.timedOut == nil {
+			v.timedOut = map[string]bool{}
+		}
+		v.timedOut[name] = true
+	}
+	for _, name := range w.Skipped {
+		if v.skipped == nil {
+			v.skipped = map[string]bool{}
+		}
+		v.skipped[name] = true
+	}
+	return v.sanitized()
+}
+
+// askDaemon reports whether the state is asked to the daemon.
+func askDaemon() bool {
+	// the errors met by the daemon are not sent back.
+	return !inDaemon && !*strict && *backends != ""
+}
+
+// queryDaemon asks the daemon for the states of the repositories containing
+// dirs, in a single request. It reports false if there is no daemon, or it
+// does not answer each state in time. With -daemon, it starts the daemon if
+// there is none, for the next prompts.
+func queryDaemon(dirs ...string) ([]vcs, bool) {
+	path := socketPath()
+	if err := checkSocketDir(filepath.Dir(path)); err != nil && !os.IsNotExist(err) {
+		debugf("daemon: %v", err)
+		return nil, false
+	}
+	if _, err := os.Stat(path); err != nil {
+		startDaemon()
+		return nil, false
+	}
+
+	wait := daemonDialTimeout
+	if *timeout > 0 {
+		wait = *timeout
+	}
+
+	conn, err := net.DialTimeout("unix", path, wait)
+	if err != nil {
+		debugf("daemon: %v", err)
+		startDaemon()
+		return nil, false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(wait))
+
+	rs := make([]daemonRequest, len(dirs))
+	for i, dir := range dirs {
+		rs[i] = newDaemonRequest(dir)
+	}
+	if err := encodeRequests(rs).send(conn); err != nil {
+		debugf("daemon: %v", err)
+		return nil, false
+	}
+	br := bufio.NewReader(conn)
+	vs := make([]vcs, len(dirs))
+	for i, dir := range dirs {
+		// the daemon collects the states in turn, each of them within
+		// the time one would take.
+		conn.SetDeadline(time.Now().Add(wait))
+		f, err := readFrame(br)
+		if err != nil {
+			debugf("daemon: %v", err)
+			return nil, false
+		}
+		w, err := decodeState(f)
+		if err != nil {
+			debugf("daemon: %v", err)
+			return nil, false
+		}
+		debugf("daemon: state of %s from %s", dir, path)
+		vs[i] = w.vcs()
+	}
+	return vs, true
+}
+
+// startDaemon starts a daemon in the background, which exits after daemonIdle
+// without requests, if -daemon is set.
+func startDaemon() {
+	if !*useDaemon {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		debugf("daemon: %v", err)
+		return
+	}
+	cmd := exec.Command(exe, "serve", "-idle", daemonIdle.String())
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		debugf("daemon: %v", err)
+		return
+	}
+	debugf("daemon: started %s serve, pid %d", exe, cmd.Process.Pid)
+	cmd.Process.Release()
+}
+
+// daemonEntry is a state kept by the daemon.
+type daemonEntry struct {
+	state wireState
+	time  time.Time
+	root  string // repository, if any
+}
+
+// daemonCall is a state being collected, which the requests for the same
+// state wait for.
+type daemonCall struct {
+	done  chan struct{}
+	state wireState
+}
+
+// daemon answers the requests of vcprompt processes. The state of each request
+// is collected with its own options, without holding mu, so that the requests
+// for the states which are kept are answered meanwhile. The commands run to
+// collect a state share the deadline of ctx, so collectMu lets one state be
+// collected at a time.
+type daemon struct {
+	maxAge time.Duration
+
+	mu         sync.Mutex
+	entries    map[daemonRequest]daemonEntry
+	collecting map[daemonRequest]*daemonCall
+	watchers   map[string]*fsWatcher // by repository, nil if it cannot be watched
+	changes    int                   // of the watched repositories
+
+	collectMu sync.Mutex
+}
+
+// fresh reports whether e may be used. The entries of repositories which are
+// watched are removed when their files change, and kept up to daemonIdle
+// otherwise.
+func (d *daemon) fresh(e daemonEntry) bool {
+	if d.watchers[e.root] != nil {
+		return time.Since(e.time) < daemonIdle
+	}
+	return time.Since(e.time) < d.maxAge
+}
+
+// state returns the state for r, from the entries if it is fresh enough, or
+// from the run which is collecting it already.
+func (d *daemon) state(r daemonRequest) wireState {
+	d.mu.Lock()
+	if e, ok := d.entries[r]; ok && d.fresh(e) {
+		d.mu.Unlock()
+		debugf("daemon: %s: kept state", r.Dir)
+		return e.state
+	}
+	for key, e := range d.entries {
+		if !d.fresh(e) {
+			delete(d.entries, key)
+		}
+	}
+	if c, ok := d.collecting[r]; ok {
+		d.mu.Unlock()
+		<-c.done
+		return c.state
+	}
+	c := &daemonCall{done: make(chan struct{})}
+	d.collecting[r] = c
+	changes := d.changes
+	d.mu.Unlock()
+
+	e := d.collect(r)
+
+	d.mu.Lock()
+	delete(d.collecting, r)
+	// a state collected while a repository changed may be out of date.
+	if d.changes == changes {
+		d.entries[r] = e
+	}
+	d.watch(e.root)
+	d.mu.Unlock()
+	c.state = e.state
+	close(c.done)
+	return e.state
+}
+
+// collect collects the state for r, with the options of r, and renders the
+// prompt with its format if it asks for it.
+func (d *daemon) collect(r daemonRequest) daemonEntry {
+	d.collectMu.Lock()
+	defer d.collectMu.Unlock()
+
+	v := collectWith(r.Dir, r.options())
+	if r.Render {
+		v.prompt = prompt(func(v vcs) pieces { return v.piecesOf(r.Format) })(v)
+	}
+	e := daemonEntry{state: v.wire(), time: time.Now()}
+	if v.available {
+		e.root, _ = probeWithin(r.Dir)
+	}
+	return e
+}
+
+// watch starts watching the repository at root, if it is not watched yet, so
+// that its entries are removed as soon as it changes.
+func (d *daemon) watch(root string) {
+	if _, ok := d.watchers[root]; ok || root == "" {
+		return
+	}
+	w, err := watchRepo(root)
+	d.watchers[root] = w
+	if err != nil {
+		debugf("daemon: %s: %v, keeping states for -max-age", root, err)
+		return
+	}
+	go func() {
+		for range w.changed {
+			debugf("daemon: %s changed", root)
+			forgetMemos(root)
+			d.mu.Lock()
+			for key, e := range d.entries {
+				if e.root == root {
+					delete(d.entries, key)
+				}
+			}
+			d.changes++
+			d.mu.Unlock()
+		}
+	}()
+}
+
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		f, err := readFrame(br)
+		if err != nil {
+			if err != io.EOF {
+				debugf("daemon: %v", err)
+			}
+			return
+		}
+		rs, err := decodeRequests(f)
+		if err != nil {
+			debugf("daemon: bad request: %v", err)
+			return
+		}
+		for _, r := range rs {
+			if !filepath.IsAbs(r.Dir) {
+				debugf("daemon: %s: not an absolute path", r.Dir)
+				return
+			}
+		}
+		for _, r := range rs {
+			if err := d.state(r).encode().send(conn); err != nil {
+				debugf("daemon: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// listenSocket listens on the socket at path, replacing it if no daemon
+// answers there.
+func listenSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("vcprompt serve is running already at " + path)
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// runServe runs the daemon, as in "vcprompt serve".
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	maxAge := fs.Duration("max-age", time.Second, "keep the state of a repository for `duration`")
+	idle := fs.Duration("idle", 0, "exit after `duration` without requests")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt serve [-max-age duration] [-idle duration]")
+		return 2
+	}
+
+	// the prompts asked for are rendered with the default settings, which
+	// plainRender checks for in vcprompt.
+	inDaemon = true
+	defer closeCatFiles()
+	*colorMode = "never"
+	// -budget is for the clients, which get states in full.
+	*budget = 0
+	path := socketPath()
+	l, err := listenSocket(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		return 1
+	}
+	debugf("daemon: listening at %s", path)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	var timer *time.Timer
+	if *idle > 0 {
+		timer = time.AfterFunc(*idle, func() {
+			debugf("daemon: idle for %s", *idle)
+			l.Close()
+		})
+	}
+
+	d := &daemon{
+		maxAge:     *maxAge,
+		entries:    map[daemonRequest]daemonEntry{},
+		collecting: map[daemonRequest]*daemonCall{},
+		watchers:   map[string]*fsWatcher{},
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// the listener is closed on signals and when idle, which
+			// removes the socket too.
+			debugf("daemon: %v", err)
+			return 0
+		}
+		if timer != nil {
+			timer.Reset(*idle)
+		}
+		go d.serve(conn)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDaemonState(t *testing.T) {
+	dir := testRepo(t)
+	writeFiles(t, dir, map[string]string{"f": "a\n"})
+	runGit(t, dir, "add", "f")
+	runGit(t, dir, "commit", "-qm", "a")
+	writeFiles(t, dir, map[string]string{"f": "b\n"})
+
+	inDaemon = true
+	defer func() { inDaemon = false }()
+	d := &daemon{
+		maxAge:     time.Minute,
+		entries:    map[daemonRequest]daemonEntry{},
+		collecting: map[daemonRequest]*daemonCall{},
+		// the repository is not watched.
+		watchers: map[string]*fsWatcher{probeParent(dir): nil},
+	}
+
+	// the requests get the states collected with their own settings, and
+	// leave the flags of the daemon alone.
+	requests := map[daemonRequest]string{
+		{Dir: dir, Backends: "git", Format: "%b%m", Render: true}:                 "main+",
+		{Dir: dir, Backends: "git", Format: "%b:%m", Render: true, NoDirty: true}: "main:",
+		{Dir: dir, Backends: "", Format: "%b", Render: true}:                      "",
+	}
+	var wg sync.WaitGroup
+	for r, want := range requests {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(r daemonRequest, want string) {
+				defer wg.Done()
+				if got := d.state(r).Prompt; got != want {
+					t.Errorf("%+v: prompt %q, want %q", r, got, want)
+				}
+			}(r, want)
+		}
+	}
+	wg.Wait()
+	if *format != defaultFormat || *noDirty || *backends != "git" {
+		t.Errorf("the flags changed: -f %q -no-dirty=%v -backends %q", *format, *noDirty, *backends)
+	}
+	if len(d.entries) != len(requests) || len(d.collecting) != 0 {
+		t.Errorf("%d entries and %d states being collected, want %d and 0", len(d.entries), len(d.collecting), len(requests))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// shellMode describes how the output of vcprompt is quoted so that it can be
+// embedded into a specific shell's prompt.
+type shellMode struct {
+	// escape quotes printable text, such as branch names.
+	escape func(s string) string
+
+	// invisible wraps a sequence that takes no room on the screen, such as
+	// a color code, so the shell can compute the prompt width correctly.
+	invisible func(s string) string
+
+	// color renders a color directive, as in "%{red}". If it is nil, colors
+	// are ANSI escape sequences wrapped with invisible.
+	color func(name string) string
+}
+
+var shellModes = map[string]shellMode{
+	"": {
+		escape:    noescape,
+		invisible: noescape,
+	},
+	// bash decodes backslash escapes in PS1, then expands parameters and
+	// commands in it with promptvars, the default, so that \, $ and `
+	// are escaped for both. It needs \[ and \] around non-printing
+	// characters.
+	"bash": {
+		escape:    strings.NewReplacer(`\`, `\\\\`, "$", `\\$`, "`", "\\\\`").Replace,
+		invisible: func(s string) string { return `\[` + s + `\]` },
+	},
+	// zsh expands % sequences in the prompt, and needs %{ and %} around
+	// non-printing characters.
+	"zsh": {
+		escape:    strings.NewReplacer("%", "%%").Replace,
+		invisible: func(s string) string { return "%{" + s + "%}" },
+	},
+	// tcsh expands % sequences and ! history references in the prompt, and
+	// needs %{ and %} around non-printing characters.
+	"tcsh": {
+		escape:    strings.NewReplacer("%", "%%", "!", `\!`).Replace,
+		invisible: func(s string) string { return "%{" + s + "%}" },
+	},
+	// fish measures escape sequences by itself, but splits command
+	// substitutions on newlines.
+	"fish": {
+		escape:    strings.NewReplacer("\n", " ").Replace,
+		invisible: noescape,
+	},
+	// PowerShell prints what the prompt function returns as is, and
+	// measures escape sequences by itself. Colors are left out where the
+	// console does not interpret them, as told by consoleANSI.
+	"powershell": {
+		escape:    noescape,
+		invisible: noescape,
+	},
+	// cmd expands $ codes in PROMPT, where $E stands for the escape
+	// character.
+	"cmd": {
+		escape:    strings.NewReplacer("$", "$$").Replace,
+		invisible: strings.NewReplacer("\x1b", "$E").Replace,
+	},
+	// tmux status lines use #[...] styles instead of escape sequences, and
+	// need # to be doubled.
+	"tmux": {
+		escape:    strings.NewReplacer("#", "##").Replace,
+		invisible: noescape,
+		color:     tmuxStyle,
+	},
+}
+
+func noescape(s string) string { return s }
+
+// tmuxStyle returns the tmux style of a color directive.
+func tmuxStyle(name string) string {
+	attr := "fg"
+	if strings.HasPrefix(name, "bg:") {
+		attr, name = "bg", name[len("bg:"):]
+	}
+
+	switch {
+	case name == "reset" || name == "normal":
+		return "#[default]"
+	case name == "bold":
+		return "#[bold]"
+	case strings.HasPrefix(name, "br"):
+		name = "bright" + name[len("br"):]
+	case name != "" && name[0] >= '0' && name[0] <= '9':
+		name = "colour" + name
+	}
+	return "#[" + attr + "=" + name + "]"
+}
+
+// piece is a part of a rendered prompt: either printable text, or the name of
+// a color directive.
+type piece struct {
+	s     string
+	color bool
+	verb  rune // placeholder which expanded to s, if any
+}
+
+// pieces is a rendered prompt, before it is quoted for a shell.
+type pieces []piece
+
+// piecesPool holds the pieces of prompts which were printed, so that the
+// daemon, -w and batches render into the same memory every time.
+var piecesPool = sync.Pool{New: func() interface{} { return make(pieces, 0, 32) }}
+
+// getPieces returns empty pieces from piecesPool.
+func getPieces() pieces {
+	return piecesPool.Get().(pieces)[:0]
+}
+
+// putPieces puts p back into piecesPool. p must not be used afterwards.
+func putPieces(p pieces) {
+	for i := range p {
+		p[i] = piece{}
+	}
+	piecesPool.Put(p[:0])
+}
+
+// text appends printable text to p.
+func (p *pieces) text(s string) {
+	*p = append(*p, piece{s: s})
+}
+
+// field appends the value s of the placeholder verb to p.
+func (p *pieces) field(verb rune, s string) {
+	*p = append(*p, piece{s: s, verb: verb})
+}
+
+// color appends a color directive to p, such as "red" or "bg:208".
+func (p *pieces) color(name string) {
+	*p = append(*p, piece{s: name, color: true})
+}
+
+// quote joins p, quoted for the given shell.
+func (p pieces) quote(mode shellMode) string {
+	colored := useColor()
+
+	// the output is written once: it is about as long as the text and the
+	// escape sequences, with their wrappers.
+	var b strings.Builder
+	n := 0
+	for _, pc := range p {
+		n += len(pc.s)
+		if pc.color {
+			n += 16
+		}
+	}
+	b.Grow(n)
+
+	var buf [64]byte
+	seqs := buf[:0] // consecutive escape sequences, wrapped together
+	for _, pc := range p {
+		switch {
+		case pc.color && !colored:
+		case !pc.color:
+			if len(seqs) > 0 {
+				b.WriteString(mode.invisible(string(seqs)))
+				seqs = seqs[:0]
+			}
+			b.WriteString(mode.escape(pc.s))
+		case mode.color != nil:
+			b.WriteString(mode.color(pc.s))
+		default:
+			seq, _ := colorSeq(pc.s)
+			seqs = append(seqs, seq...)
+		}
+	}
+	if len(seqs) > 0 {
+		b.WriteString(mode.invisible(string(seqs)))
+	}
+	return b.String()
+}
+
+// width returns the number of columns p takes on the screen.
+func (p pieces) width() int {
+	n := 0
+	for _, pc := range p {
+		if !pc.color {
+			n += stringWidth(pc.s)
+		}
+	}
+	return n
+}
+
+// trimRight removes the trailing whitespace of p, in place, looking through
+// colors such as a final reset.
+func (p pieces) trimRight() pieces {
+	out := p
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i].color {
+			continue
+		}
+		out[i].s = strings.TrimRight(out[i].s, " \t\n")
+		if out[i].s != "" {
+			break
+		}
+	}
+	return out
+}
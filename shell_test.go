@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestBashEscape(t *testing.T) {
+	branches := []string{
+		"$(echo${IFS}PWNED)",
+		"`echo PWNED`",
+		`\$(echo PWNED)`,
+		`\\`,
+		"${HOME}",
+		"main",
+	}
+	escape := shellModes["bash"].escape
+	if got, want := escape("$(x)`y`\\"), "\\\\$(x)\\\\`y\\\\`\\\\\\\\"; got != want {
+		t.Errorf("escape = %q, want %q", got, want)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	for _, branch := range branches {
+		// bash decodes and expands PS1 as ${PS1@P} does.
+		cmd := exec.Command(bash, "--norc", "--noprofile", "-c", `printf %s "${P@P}"`)
+		cmd.Env = append(os.Environ(), "P="+escape(branch))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", branch, err)
+		}
+		if string(out) != branch {
+			t.Errorf("bash shows %q as %q", branch, out)
+		}
+	}
+}
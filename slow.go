@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With -skip-slow, vcprompt records how long the dirty and untracked checks
+// take in each repository, in slow.json in the cache directory, and skips the
+// checks which took longer than -skip-slow slowRuns times in a row. They are
+// tried again after slowRetry, and skipped until then if they are still slow.
+
+// slowFile is the name of the timings file in the cache directory.
+const slowFile = "slow.json"
+
+// slowRuns is the number of slow runs in a row after which a check is skipped.
+const slowRuns = 3
+
+// slowRetry is the time after which a skipped check is tried again.
+const slowRetry = time.Hour
+
+// slowChecks are the checks which may be skipped.
+var slowChecks = []string{"dirty", "untracked"}
+
+// slowCheck is the record of a check in a repository.
+type slowCheck struct {
+	Runs int       `json:"runs"` // slow runs in a row
+	Last time.Time `json:"last"` // of the last run
+}
+
+// readSlow returns the records of the checks, by repository and check.
+func readSlow() map[string]map[string]slowCheck {
+	records := map[string]map[string]slowCheck{}
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir(), slowFile))
+	if err != nil {
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		debugf("slow: %s: %v", slowFile, err)
+	}
+	return records
+}
+
+// skippedChecks returns the checks of the repository at root which are skipped
+// because they were slower than skipSlow.
+func skippedChecks(root string, skipSlow time.Duration) map[string]bool {
+	if skipSlow <= 0 {
+		return nil
+	}
+	skipped := map[string]bool{}
+	for name, c := range readSlow()[root] {
+		if c.Runs >= slowRuns && time.Since(c.Last) < slowRetry {
+			debugf("%s check skipped, slower than %s %d times in a row", name, skipSlow, c.Runs)
+			skipped[name] = true
+		}
+	}
+	return skipped
+}
+
+// recordChecks records how long the checks of the repository at root took,
+// and whether they were cut by -t, which counts as slower than skipSlow.
+func recordChecks(root string, skipSlow time.Duration, took map[string]time.Duration, timedOut map[string]bool) {
+	if skipSlow <= 0 || len(took) == 0 {
+		return
+	}
+	records := readSlow()
+	checks := records[root]
+	if checks == nil {
+		checks = map[string]slowCheck{}
+		records[root] = checks
+	}
+
+	// the file is only written when a record changes, or the time of the
+	// last run of a skipped check matters.
+	changed := false
+	for name, d := range took {
+		c := checks[name]
+		runs := 0
+		if d > skipSlow || timedOut[name] {
+			runs = c.Runs + 1
+		}
+		if runs == c.Runs && runs < slowRuns {
+			continue
+		}
+		changed = true
+		if runs == 0 {
+			delete(checks, name)
+		} else {
+			checks[name] = slowCheck{Runs: runs, Last: time.Now()}
+		}
+	}
+	if !changed {
+		return
+	}
+	if len(checks) == 0 {
+		delete(records, root)
+	}
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = os.MkdirAll(cacheDir(), 0700)
+	}
+	if err == nil {
+		err = writeAtomic(filepath.Join(cacheDir(), slowFile), data)
+	}
+	if err != nil {
+		debugf("slow: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// With -stale, vcprompt prints the last state of the repository, kept in its
+// cache entry, at once, and runs itself again in the background to collect
+// the current one for the next prompt. The background run writes -output-file
+// and signals -notify-pid if the output changed, so that shells can redraw
+// the prompt. With -cached-max-age, the last state is printed without a
+// refresh while it is younger than that, and a single refresh runs at a time,
+// so that tmux status lines which poll every few seconds leave the repository
+// alone.
+
+// staleEnv is set in the environment of the background runs of -stale.
+const staleEnv = "VCPROMPT_STALE_REFRESH"
+
+// checkFlags are the flags which disable each check, if any.
+var checkFlags = map[string]*bool{
+	"dirty":     noDirty,
+	"untracked": noUntrack,
+	"conflict":  nil,
+	"upstream":  noUpstream,
+	"stash":     nil,
+}
+
+// checkOrder are the checks of checkFlags, in order.
+var checkOrder = []string{"dirty", "untracked", "conflict", "upstream", "stash"}
+
+// neededChecks returns the names of the checks the output needs.
+func neededChecks() []string {
+	var names []string
+	for _, name := range checkOrder {
+		if needed(name, checkFlags[name]) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// readLast returns the last state of the repository at root, if it was
+// collected with all of checks.
+func readLast(root string, checks []string) (lastState, bool) {
+	e, err := readCacheEntry(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debugf("stale: %v", err)
+		}
+		return lastState{}, false
+	}
+	if e.Last == nil || !containsAll(e.Last.Checks, checks) {
+		return lastState{}, false
+	}
+	return *e.Last, true
+}
+
+// writeLast records v as the last state of the repository at root, collected
+// with checks. States which are not complete are not recorded.
+func writeLast(root string, checks []string, v vcs) {
+	if root == "" || len(v.timedOut) > 0 || len(v.pending) > 0 || len(collectErrors) > 0 {
+		return
+	}
+	w := v.wire()
+	w.Prompt = ""
+	last := &lastState{Checks: checks, State: w, Time: time.Now()}
+	defer lockCache(root)()
+	if err := updateCacheEntry(root, func(e *cacheEntry) { e.Last = last }); err != nil {
+		debugf("stale: %v", err)
+	}
+}
+
+// staleMode reports whether the last state is printed, with -stale or
+// -cached-max-age.
+func staleMode() bool {
+	return *stale || *cachedAge > 0
+}
+
+// collectStale returns the last state of the repository containing dir, and
+// collects the current one in the background, unless the last state is
+// younger than -cached-max-age or being refreshed already. Without a last
+// state, it collects the state now.
+func collectStale(dir string) vcs {
+	root, err := probeWithin(dir)
+	if err != nil || root == "" {
+		return collect(dir)
+	}
+	checks := neededChecks()
+	if last, ok := readLast(root, checks); ok {
+		debugf("stale: state of %s from %s", root, last.Time.Format(time.RFC3339Nano))
+		if *cachedAge <= 0 {
+			refreshLater()
+		} else if time.Since(last.Time) >= *cachedAge && startRefresh(root) {
+			refreshLater()
+		}
+		v := last.State.vcs()
+		v.root = root
+		return v
+	}
+
+	v := collect(dir)
+	writeLast(root, checks, v)
+	return v
+}
+
+// startRefresh records that the last state of the repository at root is
+// being refreshed, and reports false if another run refreshed it, or started
+// to less than -cached-max-age ago.
+func startRefresh(root string) bool {
+	started := false
+	defer lockCache(root)()
+	err := updateCacheEntry(root, func(e *cacheEntry) {
+		if e.Last == nil || time.Since(e.Last.Time) < *cachedAge || time.Since(e.Last.Refresh) < *cachedAge {
+			return
+		}
+		e.Last.Refresh, started = time.Now(), true
+	})
+	if err != nil {
+		debugf("stale: %v", err)
+		return false
+	}
+	if !started {
+		debugf("stale: %s is being refreshed", root)
+	}
+	return started
+}
+
+// refreshLater runs vcprompt again in the background, with the same arguments,
+// to refresh the last state.
+func refreshLater() {
+	exe, err := os.Executable()
+	if err != nil {
+		debugf("stale: %v", err)
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), staleEnv+"=1")
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		debugf("stale: %v", err)
+		return
+	}
+	debugf("stale: refreshing in pid %d", cmd.Process.Pid)
+	cmd.Process.Release()
+}
+
+// refreshStale is the background run of -stale: it collects the state of the
+// repository containing dir, records it, and writes the output if it changed.
+func refreshStale(dir string) int {
+	root, err := probeWithin(dir)
+	if err != nil || root == "" {
+		return 0
+	}
+	checks := neededChecks()
+	last, ok := readLast(root, checks)
+
+	v := collect(dir)
+	writeLast(root, checks, v)
+	out := outputs[*output](v)
+	if ok && out == outputs[*output](last.State.vcs()) {
+		return 0
+	}
+
+	fmt.Fprint(stdout, out)
+	return flushed(0)
+}
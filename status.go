@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Checks which cannot be done without git are run together once the native
+// checks are done: with the command of the check if it is the only one, or
+// else with a single git status, which tells about all of them.
+
+// gitBatch collects the checks which need git.
+type gitBatch struct {
+	mu    sync.Mutex
+	needs map[string]bool
+}
+
+// need records that the check name needs git.
+func (b *gitBatch) need(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.needs == nil {
+		b.needs = map[string]bool{}
+	}
+	b.needs[name] = true
+}
+
+// names returns the names of the checks which need git, sorted.
+func (b *gitBatch) names() []string {
+	var names []string
+	for name := range b.needs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run runs git for the checks of the repository at root which need it, and
+// sets their results in r. It returns how long it took.
+func (b *gitBatch) run(root string, r *vcs) time.Duration {
+	if len(b.needs) == 0 {
+		return 0
+	}
+	start := time.Now()
+	defer timed("git: checks which need git")()
+
+	if len(b.needs) == 1 {
+		switch {
+		case b.needs["dirty"]:
+			r.isModified = diffModified(root)
+		case b.needs["untracked"]:
+			r.untracked = gitUntracked(root)
+		case b.needs["conflict"]:
+			r.conflict = lsFilesConflicts(root)
+		case b.needs["upstream"]:
+			r.ahead, r.behind = revListAheadBehind(root)
+		}
+		return time.Since(start)
+	}
+
+	debugf("git: running git status for the %v checks", b.names())
+
+	untracked := "no"
+	if b.needs["untracked"] {
+		untracked = "normal"
+	}
+	out, err := git(root, "--no-optional-locks", "status", "--porcelain=v2", "--branch", "-z", "--untracked-files="+untracked, "--no-renames").Output()
+	if err != nil {
+		collectError(fmt.Errorf("git status: %v", err))
+		return time.Since(start)
+	}
+	st, err := parseStatus(out)
+	if err != nil {
+		collectError(fmt.Errorf("git status: %v", err))
+		return time.Since(start)
+	}
+	if b.needs["dirty"] {
+		r.isModified = st.modified
+	}
+	if b.needs["untracked"] {
+		r.untracked = st.untracked
+	}
+	if b.needs["conflict"] {
+		r.conflict = st.conflict
+	}
+	if b.needs["upstream"] {
+		r.ahead, r.behind = st.ahead, st.behind
+	}
+	return time.Since(start)
+}
+
+// gitStatus is the state of a repository, as told by git status.
+type gitStatus struct {
+	modified  bool // the work tree differs from the index
+	untracked bool
+	conflict  bool
+	ahead     int
+	behind    int
+}
+
+// parseStatus parses the output of "git status --porcelain=v2 --branch -z".
+func parseStatus(out []byte) (gitStatus, error) {
+	var st gitStatus
+	entries := bytes.Split(out, []byte{0})
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) == 0 {
+			continue
+		}
+		switch e[0] {
+		case '#':
+			fields := bytes.Fields(e)
+			if len(fields) == 4 && string(fields[1]) == "branch.ab" {
+				ahead, err1 := strconv.Atoi(string(bytes.TrimPrefix(fields[2], []byte("+"))))
+				behind, err2 := strconv.Atoi(string(bytes.TrimPrefix(fields[3], []byte("-"))))
+				if err1 != nil || err2 != nil {
+					return st, fmt.Errorf("bad line %q", e)
+				}
+				st.ahead, st.behind = ahead, behind
+			}
+		case '1', '2':
+			// "1 XY ...", where Y is the state of the work tree.
+			if len(e) < 4 {
+				return st, fmt.Errorf("bad line %q", e)
+			}
+			if e[3] != '.' {
+				st.modified = true
+			}
+			if e[0] == '2' {
+				// the entries of renames are followed by the original path.
+				i++
+			}
+		case 'u':
+			st.conflict, st.modified = true, true
+		case '?':
+			st.untracked = true
+		}
+	}
+	return st, nil
+}
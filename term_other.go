@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+// ttyWidth is not supported on this platform, use $COLUMNS instead.
+func ttyWidth() int {
+	return 0
+}
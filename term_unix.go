@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ttyWidth asks the terminal for its width. Stdout is usually a pipe to the
+// shell, so stderr, stdin and /dev/tty are tried instead.
+func ttyWidth() int {
+	for _, fd := range []uintptr{2, 0} {
+		if n := winsize(fd); n > 0 {
+			return n
+		}
+	}
+
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	return winsize(f.Fd())
+}
+
+func winsize(fd uintptr) int {
+	var ws struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
+	}
+	return int(ws.cols)
+}
@@ -0,0 +1,150 @@
+package main
+
+// theme bundles a format string with the symbols it is designed for.
+type theme struct {
+	format  string
+	symbols symbols
+}
+
+// symbols are the strings shown for states which have no text of their own,
+// such as %m.
+type symbols struct {
+	vcs       map[string]string // icons by vcs name
+	branch    string
+	modified  string
+	untracked string
+	ahead     string
+	behind    string
+	stash     string
+	conflict  string
+	timeout   string // shown instead of the fields the checks of which timed out
+	skipped   string // shown instead of the fields of checks skipped by -skip-slow
+	pending   string // shown instead of the fields of checks not done within -budget
+}
+
+// symbolNames are the names of the symbols which can be overridden with the
+// -symbol-<name> flags and VCPROMPT_SYMBOL_<NAME> environment variables.
+var symbolNames = []string{"branch", "dirty", "untracked", "ahead", "behind", "stash", "conflict", "timeout", "skipped", "pending"}
+
+// lookup returns the symbol with the given name from symbolNames.
+func (s *symbols) lookup(name string) *string {
+	switch name {
+	case "branch":
+		return &s.branch
+	case "dirty":
+		return &s.modified
+	case "untracked":
+		return &s.untracked
+	case "ahead":
+		return &s.ahead
+	case "behind":
+		return &s.behind
+	case "stash":
+		return &s.stash
+	case "conflict":
+		return &s.conflict
+	case "timeout":
+		return &s.timeout
+	case "skipped":
+		return &s.skipped
+	case "pending":
+		return &s.pending
+	}
+	return nil
+}
+
+var defaultSymbols = symbols{
+	modified:  "+",
+	untracked: "?",
+	ahead:     "↑",
+	behind:    "↓",
+	stash:     "$",
+	conflict:  "!",
+	skipped:   "?",
+	pending:   "…",
+}
+
+// asciiSymbols are used with -ascii, regardless of the theme and icon set.
+var asciiSymbols = symbols{
+	modified:  "+",
+	untracked: "?",
+	ahead:     "^",
+	behind:    "v",
+	stash:     "$",
+	conflict:  "!",
+	skipped:   "?",
+	pending:   "..",
+}
+
+// symbolSet holds the symbols in use.
+var symbolSet = defaultSymbols
+
+// symbolsSource tells where symbolSet came from, for "vcprompt config".
+var symbolsSource = "default"
+
+var themes = map[string]theme{
+	"minimal": {
+		format: `%b%m%u`,
+		symbols: symbols{
+			modified:  "*",
+			untracked: "?",
+			ahead:     "↑",
+			behind:    "↓",
+			stash:     "$",
+			conflict:  "!",
+			skipped:   "?",
+			pending:   "…",
+		},
+	},
+	"informative": {
+		format:  `%{blue}%n%{reset}:%{magenta}%b%{reset}%(@%{yellow}%.7r%{reset})%( %{red}%c%m%u%{reset})%( %{cyan}%p%P%{reset})%( %{yellow}%s%{reset})`,
+		symbols: defaultSymbols,
+	},
+	"powerline": {
+		format: "%{bg:blue}%{black} \ue0a0 %b%( %c%m%u)%( %p%P) %{reset}%{blue}\ue0b0%{reset}",
+		symbols: symbols{
+			modified:  "±",
+			untracked: "?",
+			ahead:     "↑",
+			behind:    "↓",
+			stash:     "≡",
+			conflict:  "!",
+			skipped:   "?",
+			pending:   "…",
+		},
+	},
+	"emoji": {
+		format:  `%(%B %b)%( %c%m%u)%( %p%P)%( %s)`,
+		symbols: emojiSymbols,
+	},
+}
+
+// iconSets are symbol sets selected with -icons.
+var iconSets = map[string]symbols{
+	// nerd needs a patched font from https://www.nerdfonts.com.
+	"nerd": {
+		vcs:       map[string]string{"git": "\ue702"},
+		branch:    "\ue0a0",
+		modified:  "\uf044",
+		untracked: "\uf128",
+		ahead:     "\uf062",
+		behind:    "\uf063",
+		stash:     "\uf01c",
+		conflict:  "\uf071",
+		skipped:   "?",
+		pending:   "…",
+	},
+	"emoji": emojiSymbols,
+}
+
+var emojiSymbols = symbols{
+	branch:    "🌱",
+	modified:  "✏️",
+	untracked: "❓",
+	ahead:     "⬆️",
+	behind:    "⬇️",
+	stash:     "📦",
+	conflict:  "💥",
+	skipped:   "❔",
+	pending:   "⏳",
+}
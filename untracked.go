@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The untracked check walks the work tree itself, as git ls-files --others
+// does, without running git: it stops at the first file which is neither in
+// the index nor ignored, and gives up after -untracked-limit directories.
+// Ignored files are matched with the .gitignore files, .git/info/exclude and
+// core.excludesFile. Repositories which need more of git, such as
+// case-insensitive matches, are left to git ls-files.
+
+// errUntrackedLimit is returned when the walk reaches -untracked-limit.
+var errUntrackedLimit = errors.New("untracked limit reached")
+
+// ignorePattern is a line of a gitignore file.
+type ignorePattern struct {
+	base     string // directory of the file, relative to the root, with a slash
+	pattern  string
+	negate   bool // the pattern starts with "!", and re-includes files
+	dirOnly  bool // the pattern ends with "/", and only matches directories
+	anchored bool // the pattern has a slash, and matches paths from base
+}
+
+// readIgnoreFile returns the patterns of the gitignore file at path, which
+// apply below base. A missing file has no patterns.
+func readIgnoreFile(path, base string) ([]ignorePattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// trailing spaces are ignored, unless they are escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p := ignorePattern{base: base}
+		if line[0] == '!' {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.pattern = line
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// matches reports whether p matches the file or directory name, relative to
+// the root.
+func (p ignorePattern) matches(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !strings.HasPrefix(name, p.base) {
+		return false
+	}
+	if p.anchored {
+		return wildmatch(p.pattern, name[len(p.base):])
+	}
+	return wildmatch(p.pattern, path.Base(name))
+}
+
+// ignored reports whether patterns ignore name. The last pattern which matches
+// wins.
+func ignored(patterns []ignorePattern, name string, isDir bool) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if patterns[i].matches(name, isDir) {
+			return !patterns[i].negate
+		}
+	}
+	return false
+}
+
+// wildmatch reports whether name matches the gitignore pattern p: "*" and "?"
+// do not match slashes, "**" between slashes matches any number of
+// directories, other runs of "*" are a single one, and "[...]" matches a
+// character class. Patterns with unterminated classes match nothing, as in
+// git.
+func wildmatch(p, name string) bool {
+	// whether p is at the start of a component of the path.
+	start := true
+	for p != "" {
+		switch {
+		case start && p == "**":
+			return true
+		case start && strings.HasPrefix(p, "**/"):
+			for {
+				if wildmatch(p[3:], name) {
+					return true
+				}
+				i := strings.IndexByte(name, '/')
+				if i < 0 {
+					return false
+				}
+				name = name[i+1:]
+			}
+		case p[0] == '*':
+			p = strings.TrimLeft(p, "*")
+			for i := 0; i <= len(name); i++ {
+				if wildmatch(p, name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == '/' {
+					break
+				}
+			}
+			return false
+		case name == "":
+			return false
+		case p[0] == '?':
+			if name[0] == '/' {
+				return false
+			}
+			p, name, start = p[1:], name[1:], false
+		case p[0] == '[':
+			n, ok := matchClass(p, name[0])
+			if n == 0 || !ok {
+				return false
+			}
+			p, name, start = p[n:], name[1:], false
+		case p[0] == '\\' && len(p) > 1:
+			if name[0] != p[1] {
+				return false
+			}
+			p, name, start = p[2:], name[1:], false
+		default:
+			if name[0] != p[0] {
+				return false
+			}
+			p, name, start = p[1:], name[1:], p[0] == '/'
+		}
+	}
+	return name == ""
+}
+
+// charClasses are the named classes of bracket expressions, as in
+// "[[:digit:]]".
+var charClasses = map[string]func(c byte) bool{
+	"alnum":  func(c byte) bool { return isAlpha(c) || isDigit(c) },
+	"alpha":  isAlpha,
+	"blank":  func(c byte) bool { return c == ' ' || c == '\t' },
+	"cntrl":  func(c byte) bool { return c < 0x20 || c == 0x7f },
+	"digit":  isDigit,
+	"graph":  func(c byte) bool { return c > ' ' && c < 0x7f },
+	"lower":  func(c byte) bool { return c >= 'a' && c <= 'z' },
+	"print":  func(c byte) bool { return c >= ' ' && c < 0x7f },
+	"punct":  func(c byte) bool { return c > ' ' && c < 0x7f && !isAlpha(c) && !isDigit(c) },
+	"space":  func(c byte) bool { return c == ' ' || c >= '\t' && c <= '\r' },
+	"upper":  func(c byte) bool { return c >= 'A' && c <= 'Z' },
+	"xdigit": func(c byte) bool { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' },
+}
+
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// matchClass matches c with the character class at the start of p, and returns
+// the length of the class, or 0 if it is not terminated or names an unknown
+// class. Classes never match slashes.
+func matchClass(p string, c byte) (int, bool) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return i + 1, c != '/' && matched != negate
+		}
+		if strings.HasPrefix(p[i:], "[:") {
+			end := strings.Index(p[i+2:], ":]")
+			if end < 0 {
+				return 0, false
+			}
+			class, ok := charClasses[p[i+2:i+2+end]]
+			if !ok {
+				return 0, false
+			}
+			if class(c) {
+				matched = true
+			}
+			i += 2 + end + 2
+			continue
+		}
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return 0, false
+}
+
+// excludesFile returns the path of core.excludesFile of the git config cfg,
+// or of its default.
+func excludesFile(cfg map[string]string) string {
+	if path, ok := cfg["core.excludesfile"]; ok {
+		if strings.HasPrefix(path, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[2:])
+			}
+		}
+		return path
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "git", "ignore")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "git", "ignore")
+	}
+	return ""
+}
+
+// nativeUntracked reports whether there are untracked files which are not
+// ignored in the work tree at root, like "git ls-files --others
+// --exclude-standard". It returns errNotNative if git has to be run instead,
+// and errUntrackedLimit if it gave up.
+func nativeUntracked(root string) (bool, error) {
+	cfg, err := readNativeConfig(root)
+	if err != nil {
+		return false, err
+	}
+	if gitBool(cfg["core.ignorecase"]) {
+		return false, fmt.Errorf("core.ignoreCase: %w", errNotNative)
+	}
+	hashSize := sha1.Size
+	switch cfg["extensions.objectformat"] {
+	case "", "sha1":
+	case "sha256":
+		hashSize = sha256.Size
+	default:
+		return false, fmt.Errorf("object format %s: %w", cfg["extensions.objectformat"], errNotNative)
+	}
+
+	// directories with tracked files are walked, and submodules are not.
+	// The directories of sparse indexes, which are outside of the sparse
+	// checkout, are left to git if they are in the work tree, as which of
+	// their files are tracked is only in their tree.
+	tracked := map[string]bool{}
+	gitlinks := map[string]bool{}
+	sparse := map[string]bool{}
+	idx, err := readIndex(filepath.Join(root, ".git", "index"), hashSize)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if idx != nil {
+		for _, e := range idx.entries {
+			tracked[e.name] = true
+			switch e.mode & modeType {
+			case modeGitlink:
+				gitlinks[e.name] = true
+			case modeTree:
+				sparse[strings.TrimSuffix(e.name, "/")] = true
+			}
+		}
+		idx.close()
+	}
+
+	var patterns []ignorePattern
+	for _, path := range []string{excludesFile(cfg), filepath.Join(root, ".git", "info", "exclude")} {
+		ps, err := readIgnoreFile(path, "")
+		if err != nil {
+			return false, err
+		}
+		patterns = append(patterns, ps...)
+	}
+
+	// the walk is breadth first, so that untracked files near the root are
+	// found first. Each directory has the patterns which apply to it.
+	type dir struct {
+		name     string // relative to the root, with a slash, or empty
+		patterns []ignorePattern
+	}
+	queue := []dir{{"", patterns}}
+	for walked := 0; len(queue) > 0; walked++ {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if *maxUntrack > 0 && walked >= *maxUntrack {
+			return false, errUntrackedLimit
+		}
+		d := queue[0]
+		queue = queue[1:]
+
+		ps, err := readIgnoreFile(filepath.Join(root, filepath.FromSlash(d.name), ".gitignore"), d.name)
+		if err != nil {
+			return false, err
+		}
+		patterns := append(d.patterns[:len(d.patterns):len(d.patterns)], ps...)
+
+		files, err := ioutil.ReadDir(filepath.Join(root, filepath.FromSlash(d.name)))
+		if err != nil {
+			return false, err
+		}
+		for _, fi := range files {
+			name := d.name + fi.Name()
+			if d.name == "" && fi.Name() == ".git" || tracked[name] {
+				continue
+			}
+			if !fi.IsDir() {
+				if !ignored(patterns, name, false) {
+					debugf("git: %s is untracked", name)
+					return true, nil
+				}
+				continue
+			}
+			if gitlinks[name] || ignored(patterns, name, true) {
+				continue
+			}
+			if sparse[name] {
+				return false, fmt.Errorf("%s/ outside of the sparse checkout: %w", name, errNotNative)
+			}
+			// nested repositories are untracked directories.
+			if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name), ".git")); err == nil {
+				debugf("git: %s/ is untracked", name)
+				return true, nil
+			}
+			queue = append(queue, dir{name + "/", patterns})
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWildmatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "foobar", false},
+		{"*.o", "main.o", true},
+		{"*.o", "dir/main.o", false},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", false},
+		{"a*", "ab/c", false},
+		{"a**", "abc", true},
+		{"a**", "ab/c", false},
+		{"**", "a/b/c", true},
+		{"**/z", "z", true},
+		{"**/z", "a/b/z", true},
+		{"**/z", "a/bz", false},
+		{"x/**", "x/a/b", true},
+		{"x/**", "x", false},
+		{"x/**/y", "x/y", true},
+		{"x/**/y", "x/m/n/y", true},
+		{"x/**/y", "x/my", false},
+		{"x/**y", "x/my", true},
+		{"x/**y", "x/m/y", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"*.[ch]", "q.c", true},
+		{"*.[ch]", "q.o", false},
+		{"[!a]x", "bx", true},
+		{"[!a]x", "ax", false},
+		{"a[!b]c", "a/c", false},
+		{"a[/]c", "a/c", false},
+		{"[[:digit:]]x", "1x", true},
+		{"[[:digit:]]x", "ax", false},
+		{"[[:upper:][:digit:]]", "Q", true},
+		{"[[:bogus:]]", "a", false},
+		{"[abc", "[abc", false},
+		{"[abc", "a", false},
+		{"[]]", "]", true},
+		{"[a-c]", "b", true},
+		{"[a-c]", "d", false},
+		{"[a-]", "-", true},
+	}
+	for _, tt := range tests {
+		if got := wildmatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("wildmatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchClass(t *testing.T) {
+	tests := []struct {
+		class string
+		c     byte
+		n     int
+		ok    bool
+	}{
+		{"[abc]", 'b', 5, true},
+		{"[abc]", 'd', 5, false},
+		{"[!abc]", 'd', 6, true},
+		{"[^abc]", 'a', 6, false},
+		{"[!abc]", '/', 6, false},
+		{"[]a]", ']', 4, true},
+		{"[a-z]x", 'q', 5, true},
+		{`[\]]`, ']', 4, true},
+		{"[[:alpha:]]", 'Z', 11, true},
+		{"[[:alpha:]]", '1', 11, false},
+		{"[[:space:]]", '\t', 11, true},
+		{"[![:alnum:]]", '-', 12, true},
+		{"[[:nope:]]", 'a', 0, false},
+		{"[[:alpha:", 'a', 0, false},
+		{"[abc", 'a', 0, false},
+	}
+	for _, tt := range tests {
+		if n, ok := matchClass(tt.class, tt.c); n != tt.n || ok != tt.ok {
+			t.Errorf("matchClass(%q, %q) = %d, %v, want %d, %v", tt.class, tt.c, n, ok, tt.n, tt.ok)
+		}
+	}
+}
+
+// ignoreTests are lines of .gitignore files, as git reads them, and whether
+// they ignore paths, which end with a slash for directories.
+var ignoreTests = []struct {
+	gitignore string
+	path      string
+	want      bool
+}{
+	{"*.log", "a.log", true},
+	{"*.log", "dir/a.log", true},
+	{"*.log", "a.logx", false},
+	{"build/", "build/", true},
+	{"build/", "build", false},
+	{"build/", "src/build/x", true},
+	{"/top", "top", true},
+	{"/top", "dir/top", false},
+	{"doc/*.txt", "doc/a.txt", true},
+	{"doc/*.txt", "doc/sub/a.txt", false},
+	{"doc/*.txt", "x/doc/a.txt", false},
+	{"**/logs", "a/b/logs/", true},
+	{"**/logs/x", "a/logs/x", true},
+	{"a/**/b", "a/x/y/b", true},
+	{"*.o\n!keep.o", "keep.o", false},
+	{"*.o\n!keep.o", "other.o", true},
+	{"!keep.o\n*.o", "keep.o", true},
+	{"dir/\n!dir/keep", "dir/keep", true},
+	{"dir/*\n!dir/keep", "dir/keep", false},
+	{`\!bang`, "!bang", true},
+	{`\#hash`, "#hash", true},
+	{"#comment", "#comment", false},
+	{"trailing   ", "trailing", true},
+	{`space\ `, "space ", true},
+	{"[0-9]*.tmp", "1a.tmp", true},
+	{"[0-9]*.tmp", "a1.tmp", false},
+	{"[abc", "[abc", false},
+}
+
+// pathIgnored reports whether patterns ignore path, or one of its
+// directories, as the walk of nativeUntracked sees it.
+func pathIgnored(patterns []ignorePattern, path string) bool {
+	isDir := strings.HasSuffix(path, "/")
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for i := range parts {
+		name := strings.Join(parts[:i+1], "/")
+		if ignored(patterns, name, i < len(parts)-1 || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIgnored(t *testing.T) {
+	for _, tt := range ignoreTests {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{".gitignore": tt.gitignore + "\n"})
+		patterns, err := readIgnoreFile(filepath.Join(dir, ".gitignore"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pathIgnored(patterns, tt.path); got != tt.want {
+			t.Errorf("%q ignores %q: %v, want %v", tt.gitignore, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoredLikeGit(t *testing.T) {
+	dir := testRepo(t)
+	for _, tt := range ignoreTests {
+		writeFiles(t, dir, map[string]string{".gitignore": tt.gitignore + "\n"})
+		cmd := exec.Command("git", "check-ignore", "-q", "--no-index", "--", tt.path)
+		cmd.Dir = dir
+		err := cmd.Run()
+		var exit *exec.ExitError
+		if err != nil && !errors.As(err, &exit) {
+			t.Fatal(err)
+		}
+		if got := err == nil; got != tt.want {
+			t.Errorf("git: %q ignores %q: %v, want %v", tt.gitignore, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNativeUntrackedConfig(t *testing.T) {
+	dir := testRepo(t)
+	writeFiles(t, dir, map[string]string{"tracked": "a\n", "scratch.tmp": "b\n"})
+	runGit(t, dir, "add", "tracked")
+	files := t.TempDir()
+	writeFiles(t, files, map[string]string{
+		"ignore":  "*.tmp\n",
+		"global":  "[core]\n\texcludesFile = " + filepath.Join(files, "ignore") + "\n",
+		"include": "[includeIf \"gitdir:/\"]\n\tpath = " + filepath.Join(files, "global") + "\n",
+	})
+
+	if untracked, err := nativeUntracked(dir); err != nil || !untracked {
+		t.Errorf("without excludes: %v, %v, want true", untracked, err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(files, "global"))
+	if untracked, err := nativeUntracked(dir); err != nil || untracked {
+		t.Errorf("with core.excludesFile in $GIT_CONFIG_GLOBAL: %v, %v, want false", untracked, err)
+	}
+	if out := runGit(t, dir, "ls-files", "--others", "--exclude-standard"); out != "" {
+		t.Errorf("git sees untracked files: %q", out)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(files, "include"))
+	if _, err := nativeUntracked(dir); !errors.Is(err, errNotNative) {
+		t.Errorf("with includeIf: %v, want errNotNative", err)
+	}
+}
@@ -1,48 +1,137 @@
 // vcprompt is a simple Go program that prints version control system
 // informations. It is designed to be used by shell prompts.
 //
-// You can customize the output of vcprompt using format strings:
+// It reports on the repository containing the working directory, or the
+// directories given as arguments. You can customize the output of vcprompt
+// using format strings:
 //
-//   vcprompt -f="%b"
+//	vcprompt -f="%b"
 //
 // Format strings use printf-like "%" escape sequences:
 //
-// %n  current vcs name
-// %b  current branch name
-// %r  current revision
-// %m  + if there are any uncommitted changes (added, modified, or
-//     removed files)
+//	%n       current vcs name
+//	%b       current branch name
+//	%r       current revision
+//	%m       + if there are any uncommitted changes (added, modified,
+//	         or removed files)
+//	%u       ? if there are untracked files
+//	%c       ! if there are unmerged files
+//	%p       ↑ and the number of commits not pushed to upstream
+//	%P       ↓ and the number of upstream commits not pulled
+//	%s       $ and the number of stashed changes
+//	%N       icon of the current vcs, if an icon set is in use
+//	%B       branch icon, if an icon set is in use and HEAD is a branch
+//	%R       name of the repository, that of the directory of its work tree
+//	%x{cmd}  output of the command cmd
+//	%{color} switch to the given color
+//	%(...)   conditional section, expanded only if any placeholder in it
+//	         has a value, e.g. "%(on %b)"
 //
 // All other characters are expanded as-is.
 //
 // The default format string is
 //
-//	 "%n:%b"
+//	"%n:%b"
 //
+// Settings can also come from $XDG_CONFIG_HOME/vcprompt/config.toml and from
+// VCPROMPT_* environment variables. Themes, output modes for other tools,
+// shell integration, the daemon and the cache are described in README.md, and
+// "vcprompt -h" lists the flags.
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	githead       = ".git/HEAD"
 	refPrefix     = "ref: refs/heads/"
 	defaultFormat = `%n:%b`
+	defaultTitle  = `%R%( (%b%))`
 )
 
 var (
-	debug  = flag.Bool("d", false, "debug")
-	format = flag.String("f", defaultFormat, "format")
+	debug      = flag.Bool("d", false, "log what vcprompt does, and how long it takes, to stderr or $VCPROMPT_LOG")
+	trace      = flag.Bool("dd", false, "like -d, and log each command run")
+	format     = flag.String("f", defaultFormat, "format")
+	shell      = flag.String("shell", "", "quote output for the given shell (bash, zsh, fish, tcsh, powershell, cmd, tmux)")
+	ellipsis   = flag.String("ellipsis", "…", "suffix of truncated fields")
+	themeName  = flag.String("theme", "", "use a built-in theme (minimal, informative, powerline, emoji)")
+	colorMode  = flag.String("color", "auto", "print colors: auto, always or never")
+	icons      = flag.String("icons", "", "use an icon set for symbols (nerd, emoji)")
+	output     = flag.String("o", "", "output mode (powerline, powerline-json, env, porcelain, starship, oh-my-posh, statusline, statusline-json, iterm2, iterm2-badge)")
+	strictFmt  = flag.Bool("strict-format", false, "fail on unknown escapes in the format")
+	unknownEsc = flag.String("unknown-escape", "echo", "print unknown escapes as-is (echo), drop them, or fail (error)")
+	strict     = flag.Bool("strict", false, "fail instead of printing a partial output on errors, implies -strict-format")
+	rprompt    = flag.Bool("rprompt", false, "trim trailing whitespace, for right prompts")
+	prefix     = flag.String("prefix", "", "`text` printed before the prompt, if it is not empty")
+	suffix     = flag.String("suffix", "", "`text` printed after the prompt, if it is not empty")
+	newline    = flag.Bool("newline", false, "end the prompt with a newline, if it is not empty")
+	printWidth = flag.Bool("print-width", false, "print the display width and a tab before the prompt")
+	nul        = flag.Bool("z", false, "terminate porcelain records with NUL")
+	ascii      = flag.Bool("ascii", false, "never print non-ASCII characters, overrides -theme and -icons")
+	profile    = flag.String("profile", "", "use the `name`d profile of the config file")
+	backends   = flag.String("backends", "git", "comma separated `list` of vcs to look for, in order")
+	showVer    = flag.Bool("version", false, "print the version and exit")
+	withPath   = flag.Bool("with-path", false, "print the path and a tab before each line")
+	quiet      = flag.Bool("q", false, "print nothing, exit with 1 if dirty, 2 if not in a repository, 3 during a merge, rebase etc.")
+	noDirty    = flag.Bool("no-dirty", false, "do not check for uncommitted changes")
+	noUntrack  = flag.Bool("no-untracked", false, "do not check for untracked files")
+	noUpstream = flag.Bool("no-ahead-behind", false, "do not count commits ahead of and behind upstream")
+	timeout    = flag.Duration("t", 0, "give up on checks which take longer than `duration`, e.g. 100ms")
+	budget     = flag.Duration("budget", 0, "print what is ready after `duration`, e.g. 50ms, with the pending symbol for the rest")
+	stdin      = flag.Bool("stdin", false, "read the paths from stdin, separated by newlines or NUL")
+	useDaemon  = flag.Bool("daemon", false, "ask the daemon for the state, and start it if it is not running")
+	skipSlow   = flag.Duration("skip-slow", 0, "skip the dirty and untracked checks in repositories where they took longer than `duration` 3 times in a row")
+	adaptive   = flag.Bool("adaptive", false, "check the work tree natively, with git, or not at all, depending on how long each took in the repository")
+	maxUntrack = flag.Int("untracked-limit", 0, "give up on the untracked check after walking `n` directories without finding any")
+	stale      = flag.Bool("stale", false, "print the last state of the repository at once, and refresh it in the background")
+	cachedAge  = flag.Duration("cached-max-age", 0, "like -stale, but refresh the last state only if it is older than `duration`, e.g. 2s")
+	useCache   = flag.Bool("cache", false, "keep the state of repositories in $XDG_CACHE_HOME/vcprompt until their git directory changes")
+	outputFD   = flag.Int("output-fd", -1, "write the output to file descriptor `fd` instead of stdout")
+	outputFile = flag.String("output-file", "", "write the output to `path`, replacing it at once when complete")
+	notifyPID  = flag.Int("notify-pid", 0, "send -notify-signal to process `pid` when the output is written")
+	notifySig  = flag.String("notify-signal", "USR1", "`signal` sent to -notify-pid: USR1, USR2 or WINCH")
+	async      = flag.Bool("async", false, "return at once, and write the output from the background, to -state-file or -output-file")
+	stateFile  = flag.String("state-file", "", "write the directory and the output to `path`, replacing it at once when complete")
+	cpuProfile = flag.String("cpuprofile", "", "write a CPU profile to `path`")
+	memProfile = flag.String("memprofile", "", "write a memory profile to `path` before exiting")
+	traceFile  = flag.String("trace", "", "write an execution trace to `path`")
+	assertOff  = flag.Bool("assert-offline", false, "exit with 4 instead of running anything which would use the network")
+	memoTTL    = flag.Duration("memo", 0, "with -w and in the daemon, keep states for `duration` while the git directory does not change")
+	setTitle   = flag.Bool("set-title", false, "also set the title of the terminal, as given by -title-format")
+	titleFmt   = flag.String("title-format", defaultTitle, "`format` of the title of the terminal, with -set-title")
 )
 
+var (
+	narrowFormats narrowFlag
+	watchMode     watchFlag
+)
+
+// symbolFlags holds the -symbol-<name> flags, by symbol name.
+var symbolFlags = map[string]*string{}
+
+func init() {
+	flag.Var(&narrowFormats, "narrow", "use `WIDTH:FORMAT` on terminals narrower than WIDTH (repeatable)")
+	flag.Var(&watchMode, "w", "keep running, and print the output again when it changes (-w=5s checks every 5 seconds instead of 2)")
+
+	for _, name := range symbolNames {
+		symbolFlags[name] = flag.String("symbol-"+name, "", "`symbol` shown for "+name)
+	}
+}
+
 // vcs represents a version-control-system state through a user perspective.
 type vcs struct {
 	available bool
@@ -51,66 +140,192 @@ type vcs struct {
 	branch     string
 	revision   string
 	isModified bool
+	untracked  bool   // there are files which are neither tracked nor ignored
+	conflict   bool   // there are unmerged files
+	ahead      int    // commits not in upstream
+	behind     int    // upstream commits not in HEAD
+	stash      int    // number of stashed changes
+	operation  string // operation in progress, such as "merge" or "rebase"
+
+	timedOut map[string]bool // checks which did not finish before -t
+	skipped  map[string]bool // checks skipped because of -skip-slow or -adaptive
+	pending  map[string]bool // checks not done when -budget was spent
+	strategy string          // of the work tree checks, with -adaptive
+	prompt   string          // rendered by the daemon, if asked
+	root     string          // of the work tree
 }
 
-func (v vcs) String() string {
-	if !v.available {
-		return ""
+// expired reports whether the result of the check name is to be thrown away:
+// if it is pending after -budget, or if the deadline of -t has passed, which
+// it records.
+func (v *vcs) expired(name string) bool {
+	if v.pending[name] {
+		return true
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return false
 	}
+	if v.timedOut == nil {
+		v.timedOut = map[string]bool{}
+	}
+	v.timedOut[name] = true
+	debugf("%s: timed out", name)
+	return true
+}
 
-	var buf bytes.Buffer
-	var eof rune = 0
+// gitInfo checks for a git project containing dir and extracts several states
+// of it, such as branch, revision etc., with the options o.
+func gitInfo(dir string, o collectOptions) vcs {
+	v := vcs{name: "git", available: true}
 
-	reader := bufio.NewReader(strings.NewReader(*format))
+	root, err := probeWithin(dir)
+	if err != nil {
+		debugf("git: looking for a repository above %s: %v", dir, err)
+		v.available = false
+		v.timedOut = map[string]bool{"fs": true}
+		return v
+	}
+	if root == "" {
+		debugf("git: no .git directory found above %s", dir)
+		v.available = false
+		return v
+	}
 
-	for {
-		r, _, _ := reader.ReadRune()
-		if r == eof {
-			break
-		}
+	debugf("git: repository at %s", root)
+	v.root = root
 
-		// write ordinary characters.
-		if r != '%' {
-			buf.WriteString(string(r))
-			continue
-		}
+	// the checks run at the same time, and write to r only.
+	dirty, untracked, conflict, upstream, stash := o.needed("dirty"), o.needed("untracked"), o.needed("conflict"), o.needed("upstream"), o.needed("stash")
+	var r vcs
+	var checks []check
+	var batch gitBatch // checks which need git, run after the others
 
-		// we have format string
-		next, _, _ := reader.ReadRune()
-		switch next {
-		case 'n': // version control system name
-			buf.WriteString(v.name)
-		case 'b': // branch name
-			buf.WriteString(v.branch)
-		case 'r': // revision number
-			buf.WriteString(v.revision)
-		case 'm': // is modified flag
-			if v.isModified {
-				buf.WriteString("+")
+	// checks which were too slow in this repository are skipped, and the
+	// others timed.
+	v.skipped = skippedChecks(root, o.skipSlow)
+	// with -adaptive, the work tree is checked as was the fastest in this
+	// repository, if it was fast enough.
+	strategy := pickStrategy(root, o)
+	if strategy == strategyCached {
+		v.strategy = strategy
+		for name, ok := range map[string]bool{"dirty": dirty, "untracked": untracked} {
+			if ok {
+				if v.skipped == nil {
+					v.skipped = map[string]bool{}
+				}
+				v.skipped[name] = true
 			}
-		default:
-			buf.WriteString(string(next))
 		}
 	}
+	useCached := *useCache || strategy == strategyCached
+	dirty = dirty && !v.skipped["dirty"]
+	untracked = untracked && !v.skipped["untracked"]
+	var dirtyTook, untrackedTook time.Duration
+	if dirty {
+		checks = append(checks, check{"dirty", func() {
+			defer timed("git: dirty check")()
+			start := time.Now()
+			var ok bool
+			if strategy != strategyExec {
+				r.isModified, ok = nativeDirty(root)
+			}
+			if !ok {
+				batch.need("dirty")
+			}
+			dirtyTook = time.Since(start)
+		}})
+	}
+	if untracked {
+		checks = append(checks, check{"untracked", func() {
+			defer timed("git: untracked check")()
+			start := time.Now()
+			var complete, ok bool
+			if strategy != strategyExec {
+				r.untracked, complete, ok = nativeHasUntracked(root)
+			}
+			if !ok {
+				batch.need("untracked")
+				complete = true
+			}
+			if !complete {
+				r.timedOut = map[string]bool{"untracked": true}
+			}
+			untrackedTook = time.Since(start)
+		}})
+	}
+	// the time of git counts for each check which needed it. The checks are
+	// pending if git is not done within -budget.
+	runBatch := func() []string {
+		if !canExec && len(batch.needs) > 0 {
+			debugf("git: cannot run git, skipping the %v checks", batch.names())
+			if v.skipped == nil {
+				v.skipped = map[string]bool{}
+			}
+			for name := range batch.needs {
+				v.skipped[name] = true
+			}
+			return nil
+		}
+		var took time.Duration
+		if runChecks([]check{{"git", func() { took = batch.run(root, &r) }}}) != nil {
+			return batch.names()
+		}
+		if batch.needs["dirty"] {
+			dirtyTook += took
+		}
+		if batch.needs["untracked"] {
+			untrackedTook += took
+		}
+		return nil
+	}
+	defer func() {
+		took := map[string]time.Duration{}
+		if dirty && !v.pending["dirty"] {
+			took["dirty"] = dirtyTook
+		}
+		if untracked && !v.pending["untracked"] {
+			took["untracked"] = untrackedTook
+		}
+		recordChecks(root, o.skipSlow, took, v.timedOut)
+		if (dirty || untracked) && !v.pending["dirty"] && !v.pending["untracked"] {
+			recordStrategy(root, o, strategy, dirtyTook+untrackedTook, v.timedOut["dirty"] || v.timedOut["untracked"])
+		}
+	}()
 
-	return buf.String()
-}
-
-// gitInfo checks for a git project and extracts several states of it, such as
-// branch, revision etc.
-func gitInfo() vcs {
-	v := vcs{name: "git", available: true}
-
-	cwd := probeParent()
-	if cwd == "" {
-		printdebug("no .git/ directory found")
-		v.available = false
-		return v
+	// the cache holds what only depends on the git directory, as long as
+	// its files do not change: the work tree is checked every time.
+	var fp string
+	var cachedChecks []string
+	for name, ok := range map[string]bool{"conflict": conflict, "upstream": upstream, "stash": stash} {
+		if ok {
+			cachedChecks = append(cachedChecks, name)
+		}
+	}
+	sort.Strings(cachedChecks)
+	if useCached {
+		fp = fingerprint(root)
+		w, ok := readCache(root, fp, cachedChecks)
+		if !ok {
+			unlock := lockCache(root)
+			defer unlock()
+			w, ok = readCache(root, fp, cachedChecks)
+		}
+		if ok {
+			debugf("cache: hit for %s", root)
+			countCache(true)
+			v.setPending(runChecks(checks))
+			v.setPending(runBatch())
+			v.branch, v.revision, v.operation = w.Branch, w.Revision, w.Operation
+			v.conflict, v.ahead, v.behind, v.stash = w.Conflict, w.Ahead, w.Behind, w.Stash
+			v.setWorktree(r, dirty, untracked)
+			return v
+		}
+		countCache(false)
 	}
 
-	line, err := readFirstLine(path.Join(cwd, githead))
+	line, err := readHead(root)
 	if err != nil {
-		printdebug(err.Error())
+		collectError(fmt.Errorf("git: %v", err))
 		return v
 	}
 
@@ -121,39 +336,454 @@ func gitInfo() vcs {
 		v.revision = line
 	}
 
-	v.isModified = isModified()
+	if conflict && canExec {
+		// the conflict check needs git, where it can run.
+		batch.need("conflict")
+	} else if conflict {
+		checks = append(checks, check{"conflict", func() {
+			var err error
+			if r.conflict, err = nativeConflicts(root); err != nil {
+				collectError(fmt.Errorf("git: conflict check: %v", err))
+			}
+		}})
+	}
+	if upstream {
+		checks = append(checks, check{"upstream", func() {
+			defer timed("git: upstream check")()
+			var ok bool
+			if r.ahead, r.behind, ok = nativeUpstream(root); !ok {
+				batch.need("upstream")
+			}
+		}})
+	}
+	if stash {
+		checks = append(checks, check{"stash", func() { r.stash = stashCount(root) }})
+	}
+	errs := len(collectErrors)
+	v.setPending(runChecks(checks))
+	v.setPending(runBatch())
 
+	// results of commands which were cut by -t are thrown away.
+	v.setWorktree(r, dirty, untracked)
+	if conflict && !v.expired("conflict") {
+		v.conflict = r.conflict
+	}
+	if upstream && !v.expired("upstream") {
+		v.ahead, v.behind = r.ahead, r.behind
+	}
+	if !v.pending["stash"] {
+		v.stash = r.stash
+	}
+	v.operation = gitOperation(root)
+
+	if useCached && len(v.timedOut) == 0 && len(v.pending) == 0 && !v.skipped["conflict"] && !v.skipped["upstream"] && len(collectErrors) == errs {
+		// the work tree checks are not cached.
+		w := v.wire()
+		w.Modified, w.Untracked, w.Skipped = false, false, nil
+		if err := writeCache(root, fp, cachedChecks, w); err != nil {
+			debugf("cache: %v", err)
+		}
+	}
 	return v
 }
 
+// setWorktree sets the results of the dirty and untracked checks of v to those
+// of r, for the checks which ran and were not cut by -t.
+func (v *vcs) setWorktree(r vcs, dirty, untracked bool) {
+	if dirty && !v.expired("dirty") {
+		v.isModified = r.isModified
+	}
+	if untracked && !v.expired("untracked") {
+		v.untracked = r.untracked
+		if r.timedOut["untracked"] {
+			// the walk gave up at -untracked-limit.
+			v.timedOut = map[string]bool{"untracked": true}
+		}
+	}
+}
+
+// checkVerbs are the placeholders which show the result of each check.
+var checkVerbs = map[string]string{
+	"dirty":     "m",
+	"untracked": "u",
+	"conflict":  "c",
+	"upstream":  "pP",
+	"stash":     "s",
+}
+
+// needed reports whether the check name has to be run: it is not turned off
+// with the flag off, if any, and the output shows its result. Prompts only
+// need the checks of the placeholders in the format.
+func needed(name string, off *bool) bool {
+	switch {
+	case off != nil && *off:
+		debugf("%s check disabled", name)
+		return false
+	case inDaemon, *output != "" && *output != "starship" && *output != "statusline":
+		// the daemon gets what it needs with the requests.
+		return true
+	case *quiet:
+		return name == "dirty"
+	}
+	verbs := string(lintFormat(*format).verbs)
+	if *setTitle {
+		verbs += string(lintFormat(*titleFmt).verbs)
+	}
+	if !strings.ContainsAny(verbs, checkVerbs[name]) {
+		debugf("%s check not needed by the format", name)
+		return false
+	}
+	return true
+}
+
+// collectOptions are the settings which change how the state is collected.
+// They are those of the flags, but in the daemon, where each request has its
+// own.
+type collectOptions struct {
+	backends      string
+	noDirty       bool
+	noUntracked   bool
+	noAheadBehind bool
+	adaptive      bool
+	timeout       time.Duration
+	skipSlow      time.Duration
+}
+
+// flagOptions returns the options set by the flags.
+func flagOptions() collectOptions {
+	return collectOptions{
+		backends:      *backends,
+		noDirty:       *noDirty,
+		noUntracked:   *noUntrack,
+		noAheadBehind: *noUpstream,
+		adaptive:      *adaptive,
+		timeout:       *timeout,
+		skipSlow:      *skipSlow,
+	}
+}
+
+// needed is needed, with the checks turned off in o.
+func (o collectOptions) needed(name string) bool {
+	switch name {
+	case "dirty":
+		return needed(name, &o.noDirty)
+	case "untracked":
+		return needed(name, &o.noUntracked)
+	case "upstream":
+		return needed(name, &o.noAheadBehind)
+	}
+	return needed(name, nil)
+}
+
+// ctx bounds the commands run to collect the state of the repository. It is
+// cancelled after -t.
+var ctx = context.Background()
+
+// collectErrors are the errors met while collecting the state of the
+// repository, which -strict reports.
+var (
+	collectErrors   []error
+	collectErrorsMu sync.Mutex
+)
+
+// collectError records err, unless it is due to -t.
+func collectError(err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	debugf("%v", err)
+	collectErrorsMu.Lock()
+	collectErrors = append(collectErrors, err)
+	collectErrorsMu.Unlock()
+}
+
+// strictFailed prints the errors met while collecting the state with -strict,
+// and reports whether there were any. It forgets them.
+func strictFailed() bool {
+	errs := collectErrors
+	collectErrors = nil
+	if !*strict {
+		return false
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+	}
+	return len(errs) > 0
+}
+
+// git returns a git command run in the repository at root.
+func git(root string, args ...string) *exec.Cmd {
+	cmd := gitCommand(ctx, args...)
+	cmd.Dir = root
+	logCommand(root, cmd.Args)
+	return cmd
+}
+
 // isModified reports whether there are things that are modified.
-func isModified() bool {
-	cmd := exec.Command("git", "diff", "--no-ext-diff", "--quiet", "--exit-code")
+func isModified(root string) bool {
+	defer timed("git: dirty check")()
+
+	if modified, ok := nativeDirty(root); ok {
+		return modified
+	}
+	return diffModified(root)
+}
+
+// nativeDirty is isModified without git. It reports false for ok if git has
+// to be run instead.
+func nativeDirty(root string) (modified, ok bool) {
+	modified, err := nativeModified(root)
+	if err == nil {
+		return modified, true
+	}
+	if errors.Is(err, errNotNative) {
+		debugf("git: native dirty check: %v", err)
+	} else {
+		collectError(fmt.Errorf("git: %v", err))
+	}
+	return false, false
+}
+
+// diffModified is isModified with git diff.
+func diffModified(root string) bool {
+	cmd := git(root, "diff", "--no-ext-diff", "--quiet", "--exit-code")
 	if err := cmd.Run(); err != nil {
-		// ExitError indicates there is a change
-		if _, ok := err.(*exec.ExitError); ok {
+		// exit status 1 indicates there is a change
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
 			return true
 		}
+		collectError(fmt.Errorf("git diff: %v", err))
 	}
 
 	return false
 }
 
-// probeParent tries to find a ".git" directory until it hits root directory.
-func probeParent() string {
-	var cwd string
+// hasUntracked reports whether there are untracked files which are not
+// ignored. It reports false for complete if it gave up after -untracked-limit
+// directories.
+func hasUntracked(root string) (found, complete bool) {
+	defer timed("git: untracked check")()
+
+	if found, complete, ok := nativeHasUntracked(root); ok {
+		return found, complete
+	}
+	return gitUntracked(root), true
+}
+
+// nativeHasUntracked is hasUntracked without git. It reports false for ok if
+// git has to be run instead.
+func nativeHasUntracked(root string) (found, complete, ok bool) {
+	// git status uses the fsmonitor and the untracked cache, which git
+	// ls-files does not.
+	if usesFsmonitor(root) {
+		debugf("git: native untracked check: fsmonitor in use")
+		return false, false, false
+	}
+
+	found, err := nativeUntracked(root)
+	switch {
+	case err == nil:
+		return found, true, true
+	case err == errUntrackedLimit:
+		debugf("git: no untracked files in the first %d directories", *maxUntrack)
+		return false, false, true
+	case errors.Is(err, errNotNative):
+		debugf("git: native untracked check: %v", err)
+	default:
+		collectError(fmt.Errorf("git: %v", err))
+	}
+	return false, false, false
+}
+
+// usesFsmonitor reports whether the repository at root has a file system
+// monitor configured.
+func usesFsmonitor(root string) bool {
+	cfg, err := readGitConfigs(root)
+	if err != nil {
+		return false
+	}
+	hook, daemon := fsmonitorConfig(cfg)
+	return hook != "" || daemon
+}
+
+// gitUntracked is hasUntracked with git status if a file system monitor is
+// configured, and git ls-files otherwise.
+func gitUntracked(root string) bool {
+	if usesFsmonitor(root) {
+		return statusUntracked(root)
+	}
+	return lsFilesUntracked(root)
+}
+
+// lsFilesUntracked is hasUntracked with git ls-files.
+func lsFilesUntracked(root string) bool {
+	out, err := git(root, "ls-files", "--others", "--exclude-standard", "--directory", "--no-empty-directory").Output()
+	if err != nil {
+		collectError(fmt.Errorf("git ls-files: %v", err))
+		return false
+	}
+	return len(out) > 0
+}
+
+// statusUntracked is hasUntracked with git status.
+func statusUntracked(root string) bool {
+	out, err := git(root, "status", "--porcelain", "-z", "--untracked-files=normal", "--ignore-submodules=all", "--no-renames").Output()
+	if err != nil {
+		collectError(fmt.Errorf("git status: %v", err))
+		return false
+	}
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if bytes.HasPrefix(entry, []byte("?? ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConflicts reports whether there are unmerged files.
+func hasConflicts(root string) bool {
+	defer timed("git: conflict check")()
+
+	return lsFilesConflicts(root)
+}
+
+// lsFilesConflicts is hasConflicts with git ls-files.
+func lsFilesConflicts(root string) bool {
+	out, err := git(root, "ls-files", "--unmerged").Output()
+	if err != nil {
+		collectError(fmt.Errorf("git ls-files: %v", err))
+		return false
+	}
+	return len(out) > 0
+}
+
+// stashCount counts the entries of the stash reflog of the repository at dir.
+func stashCount(dir string) int {
+	data, err := os.ReadFile(filepath.Join(dir, ".git", "logs", "refs", "stash"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			collectError(fmt.Errorf("git: %v", err))
+		}
+		return 0
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// gitOperations are the operations which may be in progress in a repository,
+// and the files git keeps in .git while they are.
+var gitOperations = []struct {
+	name, file string
+}{
+	{"rebase", "rebase-merge"},
+	{"rebase", "rebase-apply"},
+	{"merge", "MERGE_HEAD"},
+	{"cherry-pick", "CHERRY_PICK_HEAD"},
+	{"revert", "REVERT_HEAD"},
+	{"bisect", "BISECT_LOG"},
+}
+
+// gitOperation returns the operation in progress in the repository at root, or
+// an empty string if there is none.
+func gitOperation(root string) string {
+	for _, op := range gitOperations {
+		if _, err := os.Stat(filepath.Join(root, ".git", op.file)); err == nil {
+			return op.name
+		}
+	}
+	return ""
+}
+
+// aheadBehind counts the commits which HEAD and its upstream branch have that
+// the other does not. It returns zeros if there is no upstream.
+func aheadBehind(root string) (int, int) {
+	defer timed("git: upstream check")()
+
+	if ahead, behind, ok := nativeUpstream(root); ok {
+		return ahead, behind
+	}
+	return revListAheadBehind(root)
+}
+
+// nativeUpstream is aheadBehind without git. It reports false for ok if git
+// has to be run instead.
+func nativeUpstream(root string) (ahead, behind int, ok bool) {
+	ahead, behind, err := nativeAheadBehind(root)
+	switch {
+	case err == nil:
+		return ahead, behind, true
+	case errors.Is(err, errNoUpstream):
+		debugf("git: %v", err)
+		return 0, 0, true
+	case errors.Is(err, errNotNative):
+		debugf("git: native upstream check: %v", err)
+	default:
+		collectError(fmt.Errorf("git: %v", err))
+	}
+	return 0, 0, false
+}
+
+// revListAheadBehind is aheadBehind with git rev-list.
+func revListAheadBehind(root string) (int, int) {
+	out, err := git(root, "rev-list", "--left-right", "--count", "HEAD...@{upstream}").Output()
+	if err != nil {
+		debugf("git: no upstream: %v", err)
+		return 0, 0
+	}
+
+	var ahead, behind int
+	if _, err := fmt.Sscan(string(out), &ahead, &behind); err != nil {
+		collectError(fmt.Errorf("git rev-list: %v", err))
+		return 0, 0
+	}
+	return ahead, behind
+}
+
+// probeParent tries to find a ".git" directory in dir and its parents until it
+// hits root directory. dir must be absolute.
+func probeParent(dir string) string {
 	for {
-		cwd, _ = os.Getwd()
-		if pathExists(".git") {
-			return cwd
+		if probeGitDir(dir) {
+			return dir
 		}
 
-		if cwd == "/" {
+		parent := filepath.Dir(dir)
+		if parent == dir {
 			return ""
 		}
+		dir = parent
+	}
+}
+
+// errFSTimeout is returned when the file system does not answer in time.
+var errFSTimeout = errors.New("file system timeout")
+
+// probeTimeout bounds the time probeWithin waits for the file system without
+// -t.
+const probeTimeout = time.Second
+
+// probeWithin is probeParent, which gives up at the deadline of -t, or after
+// probeTimeout, so that a hung mount above dir does not hang vcprompt too. The
+// probe is left running.
+func probeWithin(dir string) (string, error) {
+	found := make(chan string, 1)
+	go func() { found <- probeParent(dir) }()
 
-		os.Chdir("..")
+	timer := time.NewTimer(probeTimeout)
+	defer timer.Stop()
+	select {
+	case root := <-found:
+		return root, nil
+	case <-ctx.Done():
+	case <-timer.C:
 	}
+
+	// the probe may have finished at the deadline too.
+	select {
+	case root := <-found:
+		return root, nil
+	default:
+	}
+	return "", errFSTimeout
 }
 
 // readFirstLine reads the first line of the given filename.
@@ -172,39 +802,526 @@ func readFirstLine(filename string) (string, error) {
 	return strings.TrimSpace(line), nil
 }
 
+// pathExists reports whether dir is a directory. Directories which cannot be
+// looked at, e.g. for lack of permission, do not exist for probeParent.
 func pathExists(dir string) bool {
 	f, err := os.Stat(dir)
-	if err != nil && os.IsNotExist(err) {
-		return false
-	}
-	if !f.IsDir() {
+	if err != nil {
 		return false
 	}
-
-	return true
+	return f.IsDir()
 }
 
-func printdebug(format string, a ...interface{}) {
-	if *debug {
-		fmt.Printf(format, a...)
-	}
+// isFlagSet reports whether the flag with the given name was set on the
+// command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: vcprompt [options]")
+	fmt.Fprintln(os.Stderr, "usage: vcprompt [options] [path...]")
+	fmt.Fprintln(os.Stderr, "       vcprompt init [-async] <shell>")
+	fmt.Fprintln(os.Stderr, "       vcprompt install [-print] <framework>")
+	fmt.Fprintln(os.Stderr, "       vcprompt completion <shell>")
+	fmt.Fprintln(os.Stderr, "       vcprompt fmt-check <format>")
+	fmt.Fprintln(os.Stderr, "       vcprompt config [path]")
+	fmt.Fprintln(os.Stderr, "       vcprompt doctor [path]")
+	fmt.Fprintln(os.Stderr, "       vcprompt bench [-n runs] [path]")
+	fmt.Fprintln(os.Stderr, "       vcprompt explain [path]")
+	fmt.Fprintln(os.Stderr, "       vcprompt cache <stats|clear|path>")
+	fmt.Fprintln(os.Stderr, "       vcprompt hook <install|uninstall> [-print] [path]")
+	fmt.Fprintln(os.Stderr, "       vcprompt serve [-max-age duration] [-idle duration]")
+	fmt.Fprintln(os.Stderr, "       vcprompt gitstatusd")
+	fmt.Fprintln(os.Stderr, "       vcprompt rpc")
+	fmt.Fprintln(os.Stderr, "       vcprompt placeholders")
+	fmt.Fprintln(os.Stderr, "       vcprompt self-update [-check] [-version tag]")
+	fmt.Fprintln(os.Stderr, "       vcprompt version")
 	fmt.Fprintln(os.Stderr, "options:")
 	flag.PrintDefaults()
 	fmt.Fprintln(os.Stderr, "formats:")
-	fmt.Fprintln(os.Stderr, `  %n show vcs name`)
-	fmt.Fprintln(os.Stderr, `  %b show branch`)
-	fmt.Fprintln(os.Stderr, `  %r show revision`)
-	fmt.Fprintln(os.Stderr, `  %m show modified`)
+	for _, p := range placeholders {
+		fmt.Fprintf(os.Stderr, "  %%%c show %s\n", p.verb, p.desc)
+	}
+	fmt.Fprintf(os.Stderr, "  %%{color} switch color\n")
+	fmt.Fprintf(os.Stderr, "  %%.20b truncate branch to 20 columns\n")
+	fmt.Fprintf(os.Stderr, "  %%-10b pad branch to 10 columns\n")
+	fmt.Fprintf(os.Stderr, "  %%(on %%b) show section only if a field in it has a value\n")
+	fmt.Fprintf(os.Stderr, "  %%(git:%%s) show section only in git repositories\n")
+	fmt.Fprintf(os.Stderr, "  %%%% show a literal %%\n")
 	os.Exit(2)
 }
 
+// backendFuncs collect the state of the repository containing the given
+// directory, for each supported vcs.
+var backendFuncs = map[string]func(dir string, o collectOptions) vcs{
+	"git": gitInfo,
+}
+
+// optionalBackends are the backends which are only built in with a build tag,
+// by name.
+var optionalBackends = map[string]string{
+	"gogit": "gogit",
+	"git2":  "git2",
+}
+
+// collect returns the state of the first repository containing dir found among
+// -backends, within -t. It asks the daemon first, if one is running.
+func collect(dir string) vcs {
+	defer timed("collect " + dir)()
+
+	if askDaemon() {
+		if vs, ok := queryDaemon(dir); ok {
+			// the daemon does not send the root, which the probe finds.
+			if vs[0].available {
+				vs[0].root, _ = probeWithin(dir)
+			}
+			return vs[0]
+		}
+	}
+	return collectLocal(dir)
+}
+
+// collectLocal is collect without the daemon.
+func collectLocal(dir string) vcs {
+	return collectWith(dir, flagOptions())
+}
+
+// collectWith is collectLocal with the options o instead of the flags.
+func collectWith(dir string, o collectOptions) vcs {
+	key, ok := memoFor(dir, o)
+	if !ok {
+		return collectState(dir, o)
+	}
+	if v, ok := memoized(key); ok {
+		return v
+	}
+	v := collectState(dir, o)
+	memoize(key, v)
+	return v
+}
+
+// collectState is collectLocal without -memo.
+func collectState(dir string, o collectOptions) vcs {
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), o.timeout)
+		// the deadline is over for what runs next, such as the next
+		// request of the daemon.
+		defer func() {
+			cancel()
+			ctx = context.Background()
+		}()
+	}
+
+	if *budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		budgetEnd, budgetCancel = time.Now().Add(*budget), cancel
+		defer func() {
+			cancel()
+			budgetEnd, budgetCancel = time.Time{}, nil
+			ctx = context.Background()
+		}()
+	}
+
+	// when the file system did not answer, whether there is a repository is
+	// unknown, and shown as such.
+	var none vcs
+	for _, name := range strings.Split(o.backends, ",") {
+		if name == "" {
+			continue
+		}
+		v := backendFuncs[name](dir, o)
+		if v.available {
+			return v.sanitized()
+		}
+		if v.timedOut["fs"] {
+			none.timedOut = v.timedOut
+		}
+	}
+	return none
+}
+
+// userConfig is the user's config file, loaded by configure.
+var userConfig config
+
+// isExcluded reports whether dir is excluded by the user's config file, or by
+// an ignore marker.
+func isExcluded(dir string) (bool, error) {
+	by, err := excludedBy(dir)
+	return by != "", err
+}
+
+// excludedBy returns what excludes dir, or an empty string if it is not.
+func excludedBy(dir string) (string, error) {
+	excluded, err := userConfig.isExcluded(dir)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", configPath(), err)
+	}
+	if excluded {
+		return configPath() + " (excluded path)", nil
+	}
+	if enabled, ok := userConfig["enabled"].(bool); ok && !enabled {
+		return configPath() + " (enabled = false)", nil
+	}
+	return disabledBy(dir), nil
+}
+
+// configure applies the environment and the config files for dir to the flags,
+// and validates them. If dir is empty, the config file of the repository is not
+// read, and excluded paths are left to the caller.
+func configure(dir string) error {
+	defer timed("configure")()
+
+	if err := applyEnv(); err != nil {
+		return err
+	}
+
+	userPath := configPath()
+	userCfg, err := loadConfig(userPath)
+	if err != nil {
+		return err
+	}
+	userConfig = userCfg
+
+	// nothing under excluded paths is looked at, not even the config file
+	// of the repository.
+	var by string
+	if dir != "" {
+		if by, err = excludedBy(dir); err != nil {
+			return err
+		}
+	}
+	if envDisabled() {
+		by = "$VCPROMPT_DISABLE"
+	}
+	excluded := by != ""
+
+	// the config file of the repository takes precedence over the user's.
+	paths := []string{"", userPath}
+	configs := []config{{}, userCfg}
+	if !excluded && dir != "" {
+		paths[0] = repoConfigPath(dir)
+		if configs[0], err = loadConfig(paths[0]); err != nil {
+			return err
+		}
+	}
+
+	// the profile in use may come from the config file too.
+	if !isFlagSet("profile") {
+		*profile, _ = userCfg.getString("profile")
+	}
+	found := *profile == ""
+	for i, cfg := range configs {
+		var ok bool
+		configs[i], ok = cfg.withProfile(*profile)
+		found = found || ok
+	}
+	if !found {
+		return fmt.Errorf("unknown profile %q", *profile)
+	}
+
+	if err := checkRepoConfig(configs[0], paths[0]); err != nil {
+		return err
+	}
+	for i, cfg := range configs {
+		if err := applyConfig(cfg, paths[i]); err != nil {
+			return err
+		}
+	}
+	userCommands = commandsOf(configs[1])
+	inlineCommands = !usesCommands(configs[0])
+
+	if excluded {
+		*backends = ""
+		sources["backends"] = by
+	}
+
+	if _, ok := shellModes[*shell]; !ok {
+		return fmt.Errorf("unknown shell %q", *shell)
+	}
+
+	if _, ok := outputs[*output]; !ok {
+		return fmt.Errorf("unknown output mode %q", *output)
+	}
+
+	switch *colorMode {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("bad -color %q, want auto, always or never", *colorMode)
+	}
+	switch *unknownEsc {
+	case "echo", "drop", "error":
+	default:
+		return fmt.Errorf("bad -unknown-escape %q, want echo, drop or error", *unknownEsc)
+	}
+
+	for _, name := range strings.Split(*backends, ",") {
+		if _, ok := backendFuncs[name]; !ok && name != "" {
+			if tag, ok := optionalBackends[name]; ok {
+				return fmt.Errorf("backend %q is not built in, build vcprompt with -tags %s", name, tag)
+			}
+			return fmt.Errorf("unknown backend %q", name)
+		}
+	}
+
+	if *themeName != "" {
+		t, ok := themes[*themeName]
+		if !ok {
+			return fmt.Errorf("unknown theme %q", *themeName)
+		}
+		if !isFlagSet("f") {
+			*format = t.format
+			sources["f"] = "theme " + *themeName
+		}
+		symbolSet = t.symbols
+		symbolsSource = "theme " + *themeName
+	}
+
+	if *icons != "" {
+		set, ok := iconSets[*icons]
+		if !ok {
+			return fmt.Errorf("unknown icon set %q", *icons)
+		}
+		symbolSet = set
+		symbolsSource = "icons " + *icons
+	}
+
+	if *ascii {
+		symbolSet = asciiSymbols
+		symbolsSource = "ascii"
+		if !isFlagSet("ellipsis") {
+			*ellipsis = "..."
+			sources["ellipsis"] = "ascii"
+		}
+	}
+
+	for _, name := range symbolNames {
+		if isFlagSet("symbol-" + name) {
+			*symbolSet.lookup(name) = *symbolFlags[name]
+		}
+	}
+
+	if columns := terminalWidth(); columns > 0 {
+		if f, ok := narrowFormats.pick(columns); ok {
+			*format = f
+			sources["f"] = fmt.Sprintf("narrow, %d columns", columns)
+		}
+	}
+
+	if strings.HasPrefix(*format, "@") {
+		alias := (*format)[1:]
+		var f string
+		var ok bool
+		for i, cfg := range configs {
+			if f, ok = cfg.getString("formats." + alias); ok {
+				sources["f"] = fmt.Sprintf("%s (alias @%s)", paths[i], alias)
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown format alias %q", alias)
+		}
+		*format = f
+	}
+
+	if *strictFmt || *strict || *unknownEsc == "error" {
+		if err := checkFormat(*format); err != nil {
+			return fmt.Errorf("bad format: %v", err)
+		}
+		if *setTitle {
+			if err := checkFormat(*titleFmt); err != nil {
+				return fmt.Errorf("bad -title-format: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Exit statuses of -q.
+const (
+	statusClean     = 0
+	statusDirty     = 1
+	statusNoRepo    = 2
+	statusOperation = 3
+)
+
+// status returns the exit status of -q for v.
+func (v vcs) status() int {
+	switch {
+	case !v.available:
+		return statusNoRepo
+	case v.operation != "":
+		return statusOperation
+	case v.isModified:
+		return statusDirty
+	}
+	return statusClean
+}
+
+// targetDir returns the absolute path of the directory vcprompt reports on:
+// arg, or the working directory if it is empty.
+func targetDir(arg string) (string, error) {
+	if arg == "" {
+		arg = "."
+	}
+	dir, err := filepath.Abs(arg)
+	if err != nil {
+		return "", err
+	}
+	if f, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !f.IsDir() {
+		return "", fmt.Errorf("%s: not a directory", arg)
+	}
+	return dir, nil
+}
+
 func main() {
+	if isGitstatusd() {
+		exit(runGitstatusd(os.Args[1:]))
+	}
 	flag.Usage = usage
 	flag.Parse()
 
-	fmt.Print(gitInfo())
+	if err := setupLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		exit(2)
+	}
+	if err := startProfiles(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "init":
+		exit(runInit(flag.Args()[1:]))
+	case "completion":
+		exit(runCompletion(flag.Args()[1:]))
+	case "fmt-check":
+		exit(runFmtCheck(flag.Args()[1:]))
+	case "config":
+		exit(runConfig(flag.Args()[1:]))
+	case "version":
+		exit(runVersion(flag.Args()[1:]))
+	case "doctor":
+		exit(runDoctor(flag.Args()[1:]))
+	case "bench":
+		exit(runBench(flag.Args()[1:]))
+	case "explain":
+		exit(runExplain(flag.Args()[1:]))
+	case "self-update":
+		exit(runSelfUpdate(flag.Args()[1:]))
+	case "placeholders":
+		exit(runPlaceholders(flag.Args()[1:]))
+	case "install":
+		exit(runInstall(flag.Args()[1:]))
+	case "cache":
+		exit(runCache(flag.Args()[1:]))
+	case "hook":
+		exit(runHook(flag.Args()[1:]))
+	case "serve":
+		exit(runServe(flag.Args()[1:]))
+	case "gitstatusd":
+		exit(runGitstatusd(flag.Args()[1:]))
+	case "rpc":
+		exit(runRPC(flag.Args()[1:]))
+	}
+	if *showVer {
+		exit(runVersion(nil))
+	}
+
+	if *quiet && (*stdin || flag.NArg() > 1) {
+		fmt.Fprintln(os.Stderr, "vcprompt: -q takes a single path")
+		exit(2)
+	}
+	if watchMode.interval > 0 && (*quiet || *stdin || flag.NArg() > 1) {
+		fmt.Fprintln(os.Stderr, "vcprompt: -w takes a single path")
+		exit(2)
+	}
+	if *async && (*quiet || *stdin || flag.NArg() > 1 || watchMode.interval > 0) {
+		fmt.Fprintln(os.Stderr, "vcprompt: -async takes a single path, without -q or -w")
+		exit(2)
+	}
+	// the background runs of -stale write -output-file, but not to the file
+	// descriptor of the foreground run.
+	refreshing := os.Getenv(staleEnv) != ""
+	if refreshing {
+		*outputFD = -1
+	}
+	if err := openOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		exit(2)
+	}
+	if *stdin {
+		if flag.NArg() > 0 {
+			usage()
+		}
+		exit(flushed(reportStdin(os.Stdin)))
+	}
+	if flag.NArg() > 1 {
+		exit(flushed(report(flag.Args())))
+	}
+
+	dir, err := targetDir(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		exit(2)
+	}
+
+	if err := configure(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		exit(2)
+	}
+
+	stateDir = dir
+	if _, background := asyncStart(); *async && !background {
+		exit(startAsync())
+	}
+	if watchMode.interval > 0 {
+		stopProfilesOnInterrupt()
+		watch(dir, watchMode.interval)
+	}
+
+	var v vcs
+	switch {
+	case staleMode() && refreshing:
+		exit(refreshStale(dir))
+	case staleMode() && !*strict:
+		v = collectStale(dir)
+	default:
+		v = collect(dir)
+	}
+	if strictFailed() {
+		exit(flushed(2))
+	}
+	if *quiet {
+		exit(v.status())
+	}
+
+	done := timed("render")
+	out := v.prompt
+	if out == "" {
+		out = outputs[*output](v)
+	}
+	out = titled(v, out)
+	done()
+	if *withPath {
+		out = prefixLines(out, filepath.Clean(flag.Arg(0)))
+	}
+	fmt.Fprint(stdout, out)
+
+	// starship hides custom modules whose "when" command fails.
+	status := 0
+	if *output == "starship" && !v.available {
+		status = 1
+	}
+	exit(flushed(status))
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	rtdebug "runtime/debug"
+	"strings"
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// buildVersion returns the version of the binary: the one set at link time,
+// or the module version for "go install"ed binaries.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := rtdebug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// runVersion prints the version, build metadata and compiled-in backends.
+func runVersion(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: vcprompt version")
+		return 2
+	}
+
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+
+	fmt.Printf("vcprompt %s\n", buildVersion())
+	fmt.Printf("commit: %s\n", unknown(commit))
+	fmt.Printf("built: %s\n", unknown(date))
+	fmt.Printf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("backends: %s\n", strings.Join(keys(backendFuncs), ", "))
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultWatchInterval is the interval of -w without a value.
+const defaultWatchInterval = 2 * time.Second
+
+// errWatchUnsupported is returned by watchRepo on platforms without inotify.
+var errWatchUnsupported = errors.New("watching files is only supported on Linux")
+
+// watchFlag is the -w flag. It may be given without a value, as "-w", or with
+// the interval between checks, as "-w=5s".
+type watchFlag struct {
+	interval time.Duration // 0 if not watching
+}
+
+func (w *watchFlag) String() string {
+	if w == nil || w.interval == 0 {
+		return ""
+	}
+	return w.interval.String()
+}
+
+func (w *watchFlag) Set(s string) error {
+	switch s {
+	case "true":
+		w.interval = defaultWatchInterval
+		return nil
+	case "false":
+		w.interval = 0
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("bad interval %q", s)
+	}
+	w.interval = d
+	return nil
+}
+
+func (w *watchFlag) IsBoolFlag() bool { return true }
+
+// watch prints the output for dir, and checks it again every interval, or as
+// soon as files of the repository change where they can be watched. It is
+// printed again when it changes: over the previous one on terminals, or on a
+// new line for status bars which read lines from vcprompt. It never returns.
+func watch(dir string, interval time.Duration) {
+	inPlace := outputIsTerminal()
+
+	// without a watcher, changed is nil and never receives.
+	var changed chan struct{}
+	root := probeParent(dir)
+	if root != "" {
+		if w, err := watchRepo(root); err == errWatchUnsupported {
+			fmt.Fprintf(os.Stderr, "vcprompt: -w: %v; checking every %s instead\n", err, interval)
+		} else if err != nil {
+			debugf("watch: %v", err)
+		} else {
+			changed = w.changed
+		}
+	}
+
+	var last string
+	for i := 0; ; i++ {
+		if i > 0 {
+			select {
+			case <-changed:
+				debugf("watch: %s changed", dir)
+				forgetMemos(root)
+			case <-time.After(interval):
+			}
+		}
+
+		v := collect(dir)
+		if strictFailed() {
+			continue
+		}
+		out := titled(v, strings.TrimSuffix(outputs[*output](v), "\n"))
+		if i > 0 && out == last {
+			continue
+		}
+		last = out
+
+		if *withPath {
+			out = prefixLines(out, dir)
+		}
+		if inPlace {
+			fmt.Fprint(stdout, "\r\x1b[K"+out)
+		} else {
+			fmt.Fprintln(stdout, out)
+		}
+		if err := flushOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "vcprompt: %v\n", err)
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,141 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask are the inotify events which may change the state of a repository.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR | syscall.IN_EXCL_UNLINK
+
+// fsWatcher tells when files of a repository change, with inotify.
+type fsWatcher struct {
+	changed chan struct{} // receives once for changes since the last receive
+
+	fd   int
+	f    *os.File // fd, for reads which Close interrupts
+	root string
+
+	mu   sync.Mutex
+	dirs map[int32]string // watched directories, by watch descriptor
+}
+
+// watchRepo watches the work tree and the git directory of the repository at
+// root, but for its objects.
+func watchRepo(root string) (*fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &fsWatcher{
+		changed: make(chan struct{}, 1),
+		fd:      fd,
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		root:    root,
+		dirs:    map[int32]string{},
+	}
+	if err := w.add(root); err != nil {
+		w.Close()
+		return nil, err
+	}
+	debugf("watch: %d directories of %s", len(w.dirs), root)
+	go w.read()
+	return w, nil
+}
+
+// Close stops watching.
+func (w *fsWatcher) Close() error {
+	return w.f.Close()
+}
+
+// add watches dir and the directories below it.
+func (w *fsWatcher) add(dir string) error {
+	gitDir := filepath.Join(w.root, ".git")
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// directories may go away while they are walked.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		switch {
+		case path == filepath.Join(gitDir, "objects"):
+			return filepath.SkipDir
+		case fi.Name() == ".git" && path != gitDir:
+			// the git directories of submodules.
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err == syscall.ENOSPC {
+			return errors.New("too many directories to watch, see fs.inotify.max_user_watches")
+		}
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// read reads the events until the watcher is closed.
+func (w *fsWatcher) read() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			debugf("watch: %v", err)
+			return
+		}
+
+		changed := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+int(e.Len)]), "\x00")
+			off += syscall.SizeofInotifyEvent + int(e.Len)
+
+			w.mu.Lock()
+			dir := w.dirs[e.Wd]
+			if e.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, e.Wd)
+			}
+			w.mu.Unlock()
+
+			switch {
+			case e.Mask&syscall.IN_Q_OVERFLOW != 0:
+				changed = true
+			case strings.HasSuffix(name, ".lock"):
+				// git renames lock files over the files it changes.
+			case e.Mask&syscall.IN_IGNORED != 0:
+			default:
+				changed = true
+				if e.Mask&syscall.IN_ISDIR != 0 && e.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && dir != "" {
+					if err := w.add(filepath.Join(dir, name)); err != nil {
+						debugf("watch: %v", err)
+					}
+				}
+			}
+		}
+
+		if changed {
+			select {
+			case w.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
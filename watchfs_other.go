@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+// fsWatcher tells when files of a repository change. It needs inotify, so
+// that -w, the daemon and vcs/subscribe check repositories at intervals here.
+type fsWatcher struct {
+	changed chan struct{}
+}
+
+// watchRepo is not supported on this platform.
+func watchRepo(root string) (*fsWatcher, error) {
+	return nil, errWatchUnsupported
+}
+
+// Close stops watching.
+func (w *fsWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// narrowFormat is a format used on terminals narrower than width columns.
+type narrowFormat struct {
+	width  int
+	format string
+}
+
+// narrowFlag collects the repeatable -narrow flag.
+type narrowFlag []narrowFormat
+
+func (n *narrowFlag) String() string {
+	var s []string
+	for _, f := range *n {
+		s = append(s, fmt.Sprintf("%d:%s", f.width, f.format))
+	}
+	return strings.Join(s, " ")
+}
+
+func (n *narrowFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return fmt.Errorf("expected WIDTH:FORMAT")
+	}
+	width, err := strconv.Atoi(s[:i])
+	if err != nil || width <= 0 {
+		return fmt.Errorf("bad width %q", s[:i])
+	}
+	*n = append(*n, narrowFormat{width: width, format: s[i+1:]})
+	return nil
+}
+
+// pick returns the format for a terminal of the given number of columns: the
+// one with the smallest width above columns. It reports false if there is no
+// such format, or the width of the terminal is unknown.
+func (n narrowFlag) pick(columns int) (string, bool) {
+	if columns <= 0 {
+		return "", false
+	}
+
+	best := -1
+	for i, f := range n {
+		if columns < f.width && (best < 0 || f.width < n[best].width) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return n[best].format, true
+}
+
+// terminalWidth returns the number of columns of the terminal, from $COLUMNS
+// or the terminal itself. It returns 0 if it is unknown.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return ttyWidth()
+}